@@ -113,7 +113,7 @@ func newRoomRates(roomRates *ratecache.RoomRates, startDate time.Time, maxLos in
 		lastCheckIn = firstCheckIn.AddDate(0, 0, rand.Intn(12))
 		for i <= days {
 			dateSpan = rand.Intn(12)
-			roomRates.AddRate(firstCheckIn, lastCheckIn, uint8(los), float32(2500+rand.Intn(6500))/100*float32(los))
+			roomRates.AddRate(firstCheckIn, lastCheckIn, uint8(los), ratecache.NewDecimal(int64((2500+rand.Intn(6500))*los), 2))
 			firstCheckIn = lastCheckIn.AddDate(0, 0, 1)
 			lastCheckIn = firstCheckIn.AddDate(0, 0, dateSpan)
 			i += dateSpan
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
+)
+
+// check runs the integrity check and prints the report. It
+// returns false if the files could not be checked or have issues.
+func check(cacheFilename string, idxFilename string) bool {
+	report, err := ratecache.CheckCache(cacheFilename, idxFilename)
+	if report.Header != nil {
+		fmt.Printf("Format version %d, %d rate blocks, room for %d rate blocks\n",
+			report.Header.Version, report.Header.RateBlockCount, report.BlockCapacity)
+		fmt.Printf("Index file version %d, %d index records\n", report.IdxVersion, report.IdxRecordCount)
+	}
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	if err != nil {
+		fmt.Printf("Check failed: %v\n", err)
+		return false
+	}
+	if report.OK() {
+		fmt.Println("No issues found")
+	} else {
+		fmt.Printf("%d issues found\n", len(report.Issues))
+	}
+	return report.OK()
+}
+
+func main() {
+	repair := flag.Bool("repair", false, "rebuilds the index file from the rate block headers of the cache file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [-repair] <wswrite config file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	settings, err := wswrite.LoadSettings(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cacheFilename := filepath.Join(settings.CacheDir, settings.CacheFilename)
+	idxFilename := filepath.Join(settings.IndexDir, settings.CacheFilename+".idx")
+	fmt.Printf("Checking %v and %v\n", cacheFilename, idxFilename)
+	ok := check(cacheFilename, idxFilename)
+	if ok || !*repair {
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	lock, cacheLock, err := wswrite.LockMaintenance(settings)
+	if err != nil {
+		log.Fatalf("Cannot repair: %v", err)
+	}
+	defer lock.Unlock()
+	defer cacheLock.Unlock()
+	count, err := ratecache.RepairIndex(cacheFilename, idxFilename)
+	if err != nil {
+		fmt.Printf("Repair failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Index rebuilt with %d records, checking again\n", count)
+	if !check(cacheFilename, idxFilename) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
+)
+
+func printEntries(title string, entries []ratecache.IdxEntry) {
+	for _, entry := range entries {
+		fmt.Printf("%v: %v %v %v -> rate block %d\n", title, entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx.Occupancy, entry.RoomOccIdx.Idx)
+	}
+}
+
+func main() {
+	dryRun := flag.Bool("n", false, "only compares the index file with the rebuilt index")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [-n] <wswrite config file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	settings, err := wswrite.LoadSettings(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*dryRun {
+		lock, cacheLock, err := wswrite.LockMaintenance(settings)
+		if err != nil {
+			log.Fatalf("Cannot rebuild index: %v", err)
+		}
+		defer lock.Unlock()
+		defer cacheLock.Unlock()
+	}
+	cacheFilename := filepath.Join(settings.CacheDir, settings.CacheFilename)
+	idxFilename := filepath.Join(settings.IndexDir, settings.CacheFilename+".idx")
+	result, err := ratecache.RebuildIndex(cacheFilename, idxFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d index entries rebuilt from %v\n", result.Rebuilt.GetEntryCount(), cacheFilename)
+	if result.Diff.IsEmpty() {
+		fmt.Printf("%v matches the rebuilt index\n", idxFilename)
+		return
+	}
+	printEntries("missing", result.Diff.Missing)
+	printEntries("extra", result.Diff.Extra)
+	fmt.Printf("%v: %v\n", idxFilename, &result.Diff)
+	if *dryRun {
+		os.Exit(1)
+	}
+	err = ratecache.WriteIndexFile(result.Rebuilt, result.Header, idxFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%v replaced by rebuilt index\n", idxFilename)
+}
@@ -5,11 +5,31 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/navegotel/openratecache/pkg/wssearch"
 )
 
+// reloadOnSignal reloads cache and index whenever SIGHUP is received.
+func reloadOnSignal(context *wssearch.HandlerContext) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Println("SIGHUP received, reloading cache")
+		err := context.Reload()
+		if err != nil {
+			log.Printf("Reload failed, keeping current cache: %v", err)
+			continue
+		}
+		log.Println("Cache reloaded")
+	}
+}
+
 func main() {
+	snapshotUrl := flag.String("snapshot", "", "replaces cache and index with a snapshot from this url before start")
 	flag.Parse()
 	configFilename := flag.Args()[0]
 	settings, err := wssearch.LoadSettings(configFilename)
@@ -17,15 +37,61 @@ func main() {
 		log.Fatal(err)
 	}
 	log.Printf("Settings loaded from %v", configFilename)
-	mp, idx, fhdr, err := wssearch.LoadCache(settings)
-	if err != nil {
-		log.Fatal(err)
+	if len(*snapshotUrl) > 0 {
+		manifest, err := wssearch.FetchSnapshot(settings, *snapshotUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Snapshot of %v with %d rate blocks loaded from %v", manifest.Created, manifest.RateBlockCount, *snapshotUrl)
+	}
+	var context *wssearch.HandlerContext
+	if settings.Replica {
+		replica, err := wssearch.NewReplica(settings)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Replica is up to date with %v", settings.WriterUrl)
+		context = replica.Context
+		go replica.Follow()
+	} else {
+		mp, idx, fhdr, lock, err := wssearch.LoadCache(settings)
+		if err != nil {
+			log.Fatal(err)
+		}
+		context = wssearch.NewHandlerContext(settings, mp, idx, fhdr, lock)
+		err = context.LoadTags()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go reloadOnSignal(context)
+		if len(settings.WriterUrl) > 0 {
+			count, err := wssearch.CatchUpIndex(context)
+			if err != nil {
+				log.Printf("Could not catch up on index entries: %v", err)
+			} else {
+				log.Printf("%d index entries added from %v", count, settings.WriterUrl)
+			}
+		}
+		if settings.FollowIndex {
+			go wssearch.NewIndexFollower(context).Follow()
+			log.Printf("Following index file in %v", settings.IndexDir)
+		} else {
+			go context.FollowTags(time.Second)
+		}
 	}
-	context := wssearch.HandlerContext{Settings: settings, Map: mp, Fhdr: fhdr, Idx: idx}
 
-	http.HandleFunc("/list/accommodation", context.AccoListHandler)
-	http.HandleFunc("/list/rooms/", context.RoomListHandler)
-	http.HandleFunc("/find", context.FindHandler)
-	http.HandleFunc("/addindex", context.AddIndexHandler)
+	handle := func(pattern string, handler http.HandlerFunc) {
+		http.HandleFunc(pattern, context.Metrics.HTTP.Instrument(pattern, handler))
+	}
+	handle("/list/accommodation", context.AccoListHandler)
+	handle("/list/rooms/", context.RoomListHandler)
+	handle("/find", context.FindHandler)
+	handle("/export", context.ExportHandler)
+	handle("/addindex", context.AddIndexHandler)
+	handle("/admin/reload", context.ReloadHandler)
+	handle("/version", context.VersionHandler)
+	http.HandleFunc("/healthz", context.HealthzHandler)
+	http.HandleFunc("/readyz", context.ReadyzHandler)
+	http.Handle("/metrics", context.Metrics.Registry)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", settings.Port), nil))
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 
 	"github.com/navegotel/openratecache/pkg/wswrite"
@@ -21,24 +20,53 @@ func main() {
 	}
 	log.Printf("Settings loaded from %v", configFilename)
 
+	cachefile, idx, lock, err := wswrite.LoadOrCreateCache(settings, *clean)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lock.Unlock()
 	if *clean == true {
-		os.Remove(filepath.Join(settings.CacheDir, settings.CacheFilename))
-		os.Remove(filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"))
 		log.Printf("Files %v and %v removed from fs",
 			filepath.Join(settings.CacheDir, settings.CacheFilename),
 			filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"))
 	}
-	cachefile, idx, err := wswrite.LoadOrCreateCache(settings)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	context, err := wswrite.NewHandlerContext(settings, cachefile, idx)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if settings.ChangeStream {
+		context.Journal, err = wswrite.OpenJournal(settings, cachefile, context.Idx, context.Tags)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Change stream enabled, journal %v", context.Journal.ID())
+	}
 
-	http.HandleFunc("/version", context.VersionHandler)
-	http.HandleFunc("/import", context.ImportHandler)
+	if settings.Notify && len(settings.AddIndexUrls) > 0 {
+		context.Outbox, err = wswrite.NewOutbox(context)
+		if err != nil {
+			log.Fatal(err)
+		}
+		context.Outbox.Start()
+	}
+
+	handle := func(pattern string, handler http.HandlerFunc) {
+		http.HandleFunc(pattern, context.Metrics.HTTP.Instrument(pattern, handler))
+	}
+	handle("/version", context.VersionHandler)
+	handle("/import", context.ImportHandler)
+	handle("/close", context.CloseHandler)
+	handle("/open", context.OpenHandler)
+	handle("/clear", context.ClearHandler)
+	handle("/remove", context.RemoveHandler)
+	handle("/export", context.ExportHandler)
+	handle("/changes", context.ChangesHandler)
+	handle("/snapshot", context.SnapshotHandler)
+	handle("/indexentries", context.IndexEntriesHandler)
+	handle("/tags", context.TagsHandler)
+	http.HandleFunc("/healthz", context.HealthzHandler)
+	http.HandleFunc("/readyz", context.ReadyzHandler)
+	http.Handle("/metrics", context.Metrics.Registry)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", settings.Port), nil))
 }
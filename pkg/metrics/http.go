@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPMetrics counts the requests and measures the latency per handler.
+type HTTPMetrics struct {
+	Requests *Counter
+	Duration *Histogram
+}
+
+// NewHTTPMetrics adds the request metrics to registry.
+func NewHTTPMetrics(registry *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		Requests: registry.NewCounter("http_requests_total", "Number of HTTP requests by handler and status code.", "handler", "code"),
+		Duration: registry.NewHistogram("http_request_duration_seconds", "Latency of HTTP requests by handler.", DefaultBuckets, "handler"),
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(buf []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(buf)
+}
+
+// Instrument returns a handler that calls handler and records its
+// requests with the label handler set to name.
+func (httpMetrics *HTTPMetrics) Instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		httpMetrics.Duration.Observe(time.Since(start).Seconds(), name)
+		httpMetrics.Requests.Inc(name, strconv.Itoa(recorder.status))
+	}
+}
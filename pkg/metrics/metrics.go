@@ -0,0 +1,281 @@
+// Package metrics collects counters, gauges and histograms and exports
+// them in the Prometheus text exposition format, without depending on
+// a metrics library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of
+// request latency histograms.
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// metric is one metric family of a registry.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry contains the metrics exported by a service. All metric names
+// are prefixed with the namespace of the registry.
+type Registry struct {
+	namespace string
+	metrics   []metric
+	mu        sync.Mutex
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry(namespace string) *Registry {
+	return &Registry{namespace: namespace}
+}
+
+// desc describes a metric family.
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (registry *Registry) newDesc(name string, help string, labelNames []string) desc {
+	if len(registry.namespace) > 0 {
+		name = registry.namespace + "_" + name
+	}
+	return desc{name: name, help: help, labelNames: labelNames}
+}
+
+func (registry *Registry) register(m metric) {
+	registry.mu.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.mu.Unlock()
+}
+
+// seriesKey returns the key of the series with labelValues.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// escapeLabelValue escapes backslash, double quote and line feed.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatLabels returns the label set of a series, with an optional
+// additional label, e.g. le of histogram buckets.
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+`="`+escapeLabelValue(value)+`"`)
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		// whole numbers like sizes without exponent
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (d *desc) writeHeader(w *bufio.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", d.name, metricType)
+}
+
+// Counter is a counter with one series per combination of label values.
+type Counter struct {
+	desc
+	series map[string]*counterSeries
+	mu     sync.Mutex
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounter adds a counter to the registry.
+func (registry *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{desc: registry.newDesc(name, help, labelNames), series: make(map[string]*counterSeries)}
+	registry.register(counter)
+	return counter
+}
+
+// Inc increments the series of labelValues by 1.
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series of labelValues.
+func (counter *Counter) Add(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	counter.mu.Lock()
+	series, ok := counter.series[key]
+	if !ok {
+		series = &counterSeries{labelValues: append([]string(nil), labelValues...)}
+		counter.series[key] = series
+	}
+	series.value += v
+	counter.mu.Unlock()
+}
+
+// Value returns the value of the series of labelValues.
+func (counter *Counter) Value(labelValues ...string) float64 {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if series, ok := counter.series[seriesKey(labelValues)]; ok {
+		return series.value
+	}
+	return 0
+}
+
+func (counter *Counter) write(w *bufio.Writer) {
+	counter.writeHeader(w, "counter")
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if len(counter.labelNames) == 0 && len(counter.series) == 0 {
+		fmt.Fprintf(w, "%v 0\n", counter.name)
+		return
+	}
+	keys := make([]string, 0, len(counter.series))
+	for key := range counter.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := counter.series[key]
+		fmt.Fprintf(w, "%v%v %v\n", counter.name, formatLabels(counter.labelNames, series.labelValues, "", ""), formatValue(series.value))
+	}
+}
+
+// GaugeFunc is a gauge whose value is determined by a function when
+// the metrics are written.
+type GaugeFunc struct {
+	desc
+	f func() float64
+}
+
+// NewGaugeFunc adds a gauge to the registry whose value is returned by f.
+func (registry *Registry) NewGaugeFunc(name string, help string, f func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{desc: registry.newDesc(name, help, nil), f: f}
+	registry.register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) write(w *bufio.Writer) {
+	gauge.writeHeader(w, "gauge")
+	fmt.Fprintf(w, "%v %v\n", gauge.name, formatValue(gauge.f()))
+}
+
+// Histogram counts observations in buckets, with one series per
+// combination of label values.
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+	mu      sync.Mutex
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts contains the number of observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram adds a histogram with the upper bounds buckets, which
+// must be sorted, to the registry.
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	histogram := &Histogram{desc: registry.newDesc(name, help, labelNames), buckets: buckets, series: make(map[string]*histogramSeries)}
+	registry.register(histogram)
+	return histogram
+}
+
+// Observe adds v to the series of labelValues.
+func (histogram *Histogram) Observe(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	bucket := sort.SearchFloat64s(histogram.buckets, v)
+	histogram.mu.Lock()
+	series, ok := histogram.series[key]
+	if !ok {
+		series = &histogramSeries{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+	if bucket < len(series.counts) {
+		series.counts[bucket]++
+	}
+	series.count++
+	series.sum += v
+	histogram.mu.Unlock()
+}
+
+func (histogram *Histogram) write(w *bufio.Writer) {
+	histogram.writeHeader(w, "histogram")
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	keys := make([]string, 0, len(histogram.series))
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := histogram.series[key]
+		cumulative := uint64(0)
+		for i, upperBound := range histogram.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %d\n", histogram.name, formatLabels(histogram.labelNames, series.labelValues, "le", formatValue(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %d\n", histogram.name, formatLabels(histogram.labelNames, series.labelValues, "le", "+Inf"), series.count)
+		labels := formatLabels(histogram.labelNames, series.labelValues, "", "")
+		fmt.Fprintf(w, "%v_sum%v %v\n", histogram.name, labels, formatValue(series.sum))
+		fmt.Fprintf(w, "%v_count%v %d\n", histogram.name, labels, series.count)
+	}
+}
+
+// Write writes all metrics of the registry in the text exposition format.
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mu.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP returns all metrics of the registry.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	registry.Write(w)
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := NewRegistry("test")
+	counter := registry.NewCounter("requests_total", "Number of requests.", "handler", "code")
+	counter.Inc("/find", "200")
+	counter.Add(2, "/find", "200")
+	counter.Inc(`/a"b`, "400")
+	registry.NewCounter("blocks_total", "Number of blocks.")
+	registry.NewGaugeFunc("entries", "Number of entries.", func() float64 { return 42 })
+	histogram := registry.NewHistogram("duration_seconds", "Latency.", []float64{0.1, 1}, "handler")
+	histogram.Observe(0.05, "/find")
+	histogram.Observe(0.1, "/find")
+	histogram.Observe(3, "/find")
+	var buf bytes.Buffer
+	err := registry.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{handler="/a\"b",code="400"} 1
+test_requests_total{handler="/find",code="200"} 3
+# HELP test_blocks_total Number of blocks.
+# TYPE test_blocks_total counter
+test_blocks_total 0
+# HELP test_entries Number of entries.
+# TYPE test_entries gauge
+test_entries 42
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="/find",le="0.1"} 2
+test_duration_seconds_bucket{handler="/find",le="1"} 2
+test_duration_seconds_bucket{handler="/find",le="+Inf"} 3
+test_duration_seconds_sum{handler="/find"} 3.15
+test_duration_seconds_count{handler="/find"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%v", buf.String())
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	registry := NewRegistry("")
+	httpMetrics := NewHTTPMetrics(registry)
+	handler := httpMetrics.Instrument("/find", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+		w.Write([]byte("[]"))
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/find", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/find", nil))
+	if httpMetrics.Requests.Value("/find", "200") != 1 || httpMetrics.Requests.Value("/find", "405") != 1 {
+		t.Error("Expected one request with status 200 and one with 405")
+	}
+	rsp := httptest.NewRecorder()
+	registry.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rsp.Body.String(), `http_request_duration_seconds_count{handler="/find"} 2`) {
+		t.Errorf("Unexpected metrics %v", rsp.Body.String())
+	}
+}
@@ -1,11 +1,14 @@
 package ratecache
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -43,26 +46,48 @@ type RoomOccIdx struct {
 // Match matches a specific group of guests, represented by
 // a slice of ages against a room occupancy and returns true
 // if the group matches the occupancy requirements.
+// Guests are assigned in ascending order of age, each one to the
+// fitting occupancy item with the lowest MaxAge that still has
+// places left. As age ranges are intervals this finds an assignment
+// whenever one exists, also if age ranges overlap.
 func (roomOccIdx *RoomOccIdx) Match(guests []uint8) bool {
 	if len(guests) != int(roomOccIdx.Total) {
 		return false
 	}
-	counters := make([]uint8, len(roomOccIdx.Occupancy))
-	for i, occItem := range roomOccIdx.Occupancy {
-		counters[i] = occItem.Count
+	var sortedBuf [16]uint8
+	sorted := sortedBuf[:0]
+	if len(guests) > len(sortedBuf) {
+		sorted = make([]uint8, 0, len(guests))
 	}
-	for _, guest := range guests {
-		fit := false
+	sorted = append(sorted, guests...)
+	// insertion sort, groups of guests are small
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j] < sorted[j-1]; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
+	var countersBuf [8]uint8
+	counters := countersBuf[:0]
+	if len(roomOccIdx.Occupancy) > len(countersBuf) {
+		counters = make([]uint8, 0, len(roomOccIdx.Occupancy))
+	}
+	for _, occItem := range roomOccIdx.Occupancy {
+		counters = append(counters, occItem.Count)
+	}
+	for _, guest := range sorted {
+		fit := -1
 		for i, occItem := range roomOccIdx.Occupancy {
-			if counters[i] > 0 && guest >= occItem.MinAge && guest <= occItem.MaxAge {
-				fit = true
-				counters[i] -= 1
-				break
+			if counters[i] == 0 || guest < occItem.MinAge || guest > occItem.MaxAge {
+				continue
+			}
+			if fit < 0 || occItem.MaxAge < roomOccIdx.Occupancy[fit].MaxAge {
+				fit = i
 			}
 		}
-		if fit == false {
+		if fit < 0 {
 			return false
 		}
+		counters[fit] -= 1
 	}
 	for _, count := range counters {
 		if count > 0 {
@@ -87,18 +112,7 @@ func (roomOccIdx *RoomOccIdx) ToByteStr() *[]byte {
 // AppendToIdxFile appends a new index entry to the index file
 // without having to re-write the whole index on disk
 func (roomOccIdx *RoomOccIdx) AppendToIdxFile(fhdr FileHeader, filename string, accoCode string, roomRateCode string) error {
-	blockSize := fhdr.AccoCodeLength + fhdr.RoomRateCodeLength + FixIdxRecSize
-	buf := make([]byte, blockSize)
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	copy(buf[0:], []byte(accoCode))
-	copy(buf[fhdr.AccoCodeLength:], []byte(roomRateCode))
-	copy(buf[fhdr.AccoCodeLength+fhdr.RoomRateCodeLength:], *roomOccIdx.ToByteStr())
-	f.Write(buf)
-	return nil
+	return AppendIdxRecord(&fhdr, filename, IdxRecord{Entry: IdxEntry{AccoCode: accoCode, RoomRateCode: roomRateCode, RoomOccIdx: *roomOccIdx}})
 }
 
 // AddOccItem adds one occupuncy item to the occupancy.
@@ -115,12 +129,24 @@ func (roomOccIdx *RoomOccIdx) AddOccItem(MinAge uint8, MaxAge uint8, Count uint8
 	return nil
 }
 
-// CacheIndex contains a map with the nested map
-// and slice structure for the cache index,
-// protected by a mutex.
+// idxShardCount is the number of shards of a CacheIndex.
+const idxShardCount = 256
+
+// CacheIndex is the cache index. Accommodations are distributed over
+// shards by a hash of their code, so that searches only share a lock
+// with writes to the same shard and never wait for each other.
+// Accommodation and room rate codes and occupancies are stored once in
+// dictionaries, the entries only contain their ids, see idxShard.
 type CacheIndex struct {
-	m map[string]map[string][]RoomOccIdx
-	sync.RWMutex
+	shards [idxShardCount]idxShard
+	// mu protects records, legacy and removed
+	mu sync.RWMutex
+	// records is the number of records read by Load or written by Save
+	records int64
+	// legacy is set if Load read an index file without header
+	legacy bool
+	// removed are the entries of removed rate blocks by block index
+	removed map[uint32]IdxEntry
 }
 
 // NewCacheIndex returns a pointer to a new CacheIndex
@@ -128,16 +154,50 @@ type CacheIndex struct {
 // returning a copy of a mutex is not safe.
 func NewCacheIndex() *CacheIndex {
 	idx := CacheIndex{}
-	idx.m = make(map[string]map[string][]RoomOccIdx)
 	return &idx
 }
 
+// shard returns the shard of accoCode using the FNV-1a hash.
+func (idx *CacheIndex) shard(accoCode string) *idxShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(accoCode); i++ {
+		h ^= uint32(accoCode[i])
+		h *= 16777619
+	}
+	return &idx.shards[h%idxShardCount]
+}
+
+// rlockAll read locks all shards for a consistent view of the
+// whole index.
+func (idx *CacheIndex) rlockAll() {
+	for i := range idx.shards {
+		idx.shards[i].RLock()
+	}
+}
+
+func (idx *CacheIndex) runlockAll() {
+	for i := range idx.shards {
+		idx.shards[i].RUnlock()
+	}
+}
+
 // RoomIdx is part of IdxResult and contains a
 // room rate code and the corresponding index
 // of the room rate block
 type RoomIdx struct {
 	RoomRateCode string
 	Index        uint32
+	// Alternatives are the rate blocks of further matching occupancies.
+	// They are only set if the cheapest occupancy is to be selected.
+	Alternatives []uint32
+}
+
+// IdxEntry is one entry of the cache index, i.e. one
+// occupancy of a room rate with the index of its rate block.
+type IdxEntry struct {
+	AccoCode     string
+	RoomRateCode string
+	RoomOccIdx   RoomOccIdx
 }
 
 // A slice of IdexResult is returned by "Find" as
@@ -149,183 +209,544 @@ type IdxResult struct {
 	Rooms    []RoomIdx
 }
 
+// Find returns the rate blocks of the requested room rates whose
+// occupancy matches the guests of the search request. By default only
+// the first matching occupancy of a room rate is returned, with
+// OccupancySelectionCheapest the other matches are added as
+// alternatives to choose the best-priced one from.
 func (idx *CacheIndex) Find(searchRq *SearchRq) []IdxResult {
-	var idxResults []IdxResult
+	return idx.FindOccupancies(searchRq, []Ages{searchRq.Occupancy})[0]
+}
+
+// FindOccupancies works like Find for several groups of guests in one
+// pass over the index. The result contains the IdxResults of every
+// group in the order of occupancies.
+func (idx *CacheIndex) FindOccupancies(searchRq *SearchRq, occupancies []Ages) [][]IdxResult {
+	cheapest := searchRq.OccupancySelection == OccupancySelectionCheapest
+	idxResults := make([][]IdxResult, len(occupancies))
 	for _, accommodation := range searchRq.Accommodations {
+		shard := idx.shard(accommodation.AccoCode)
+		shard.RLock()
+		lo, hi := shard.accoRange(accommodation.AccoCode)
+		var roomRanges [][2]int
 		if len(accommodation.RoomRateCodes) == 0 {
-			idx.Lock()
-			for key, _ := range idx.m[accommodation.AccoCode] {
-				accommodation.RoomRateCodes = append(accommodation.RoomRateCodes, key)
+			pattern := accommodation.RoomRateCodePattern
+			for first := lo; first < hi; {
+				_, last := shard.roomIdRange(first, hi, shard.entries[first].room)
+				if len(pattern) == 0 || MatchCode(pattern, shard.codes[shard.entries[first].room]) {
+					roomRanges = append(roomRanges, [2]int{first, last})
+				}
+				first = last
+			}
+		} else {
+			for _, room := range accommodation.RoomRateCodes {
+				first, last := shard.roomRange(lo, hi, room)
+				roomRanges = append(roomRanges, [2]int{first, last})
 			}
-			idx.Unlock()
 		}
-		idxResult := IdxResult{AccoCode: accommodation.AccoCode}
-		for _, room := range accommodation.RoomRateCodes {
-			idx.Lock()
-			for _, roomOccIdx := range idx.m[accommodation.AccoCode][room] {
-				if roomOccIdx.Match(searchRq.Occupancy) {
-					roomIdx := RoomIdx{RoomRateCode: room, Index: roomOccIdx.Idx}
-					idxResult.Rooms = append(idxResult.Rooms, roomIdx)
+		// the occupancy ids are ids of the shard
+		matches := make([]int8, len(shard.occs)*len(occupancies))
+		accoResults := make([]IdxResult, len(occupancies))
+		for _, roomRange := range roomRanges {
+			if roomRange[0] == roomRange[1] {
+				continue
+			}
+			room := shard.codes[shard.entries[roomRange[0]].room]
+			roomIdxs := make([]*RoomIdx, len(occupancies))
+			found := 0
+			for _, entry := range shard.entries[roomRange[0]:roomRange[1]] {
+				for i, guests := range occupancies {
+					if roomIdxs[i] != nil && !cheapest {
+						continue
+					}
+					// matches caches the result of Match by occupancy and group
+					// of guests: 0 not matched yet, 1 match, -1 no match
+					match := &matches[int(entry.occ)*len(occupancies)+i]
+					if *match == 0 {
+						roomOccIdx := shard.roomOccIdx(entry)
+						*match = -1
+						if roomOccIdx.Match(guests) {
+							*match = 1
+						}
+					}
+					if *match < 0 {
+						continue
+					}
+					if roomIdxs[i] != nil {
+						roomIdxs[i].Alternatives = append(roomIdxs[i].Alternatives, entry.idx)
+						continue
+					}
+					roomIdxs[i] = &RoomIdx{RoomRateCode: room, Index: entry.idx}
+					found++
+				}
+				if found == len(occupancies) && !cheapest {
 					break
 				}
 			}
-			idx.Unlock()
+			for i, roomIdx := range roomIdxs {
+				if roomIdx != nil {
+					accoResults[i].Rooms = append(accoResults[i].Rooms, *roomIdx)
+				}
+			}
 		}
-		if len(idxResult.Rooms) > 0 {
-			idxResults = append(idxResults, idxResult)
+		shard.RUnlock()
+		for i, accoResult := range accoResults {
+			if len(accoResult.Rooms) > 0 {
+				accoResult.AccoCode = accommodation.AccoCode
+				idxResults[i] = append(idxResults[i], accoResult)
+			}
 		}
 	}
 	return idxResults
 }
 
+// Select returns all index entries of an accommodation, of one room rate
+// of an accommodation or of all room rates starting with prefix. Empty
+// parameters are not used for selection, e.g. if accoCode is empty, room
+// rate codes with prefix are selected in all accommodations.
+func (idx *CacheIndex) Select(accoCode string, roomRateCode string, prefix string) []IdxEntry {
+	var entries []IdxEntry
+	selectRooms := func(shard *idxShard, lo int, hi int) {
+		for _, entry := range shard.entries[lo:hi] {
+			room := shard.codes[entry.room]
+			if len(roomRateCode) > 0 && room != roomRateCode {
+				continue
+			}
+			if !strings.HasPrefix(room, prefix) {
+				continue
+			}
+			entries = append(entries, IdxEntry{AccoCode: shard.codes[entry.acco], RoomRateCode: room, RoomOccIdx: shard.roomOccIdx(entry)})
+		}
+	}
+	if len(accoCode) > 0 {
+		shard := idx.shard(accoCode)
+		shard.RLock()
+		lo, hi := shard.accoRange(accoCode)
+		selectRooms(shard, lo, hi)
+		shard.RUnlock()
+	} else {
+		for i := range idx.shards {
+			shard := &idx.shards[i]
+			shard.RLock()
+			selectRooms(shard, 0, len(shard.entries))
+			shard.RUnlock()
+		}
+	}
+	return entries
+}
+
 // GetAccoCount returns the number of accommodations in the idx.
 func (idx *CacheIndex) GetAccoCount() int {
-	return len(idx.m)
+	count := 0
+	for i := range idx.shards {
+		idx.shards[i].RLock()
+		count += idx.shards[i].accoCount
+		idx.shards[i].RUnlock()
+	}
+	return count
+}
+
+// GetEntryCount returns the number of rate blocks in the idx.
+func (idx *CacheIndex) GetEntryCount() int {
+	count := 0
+	for i := range idx.shards {
+		idx.shards[i].RLock()
+		count += len(idx.shards[i].entries)
+		idx.shards[i].RUnlock()
+	}
+	return count
+}
+
+// GetNextIndex returns the index following the highest rate block
+// index in the idx, including removed rate blocks, or 0 if the idx
+// is empty.
+func (idx *CacheIndex) GetNextIndex() uint32 {
+	next := uint32(0)
+	for i := range idx.shards {
+		idx.shards[i].RLock()
+		for _, entry := range idx.shards[i].entries {
+			if entry.idx >= next {
+				next = entry.idx + 1
+			}
+		}
+		idx.shards[i].RUnlock()
+	}
+	idx.mu.RLock()
+	for index := range idx.removed {
+		if index >= next {
+			next = index + 1
+		}
+	}
+	idx.mu.RUnlock()
+	return next
 }
 
 // Get AccoList returns a slice of all accommodations in the idx.
 func (idx *CacheIndex) GetAccoList() []string {
-	idx.Lock()
-	l := make([]string, len(idx.m))
-	i := 0
-	for accoCode := range idx.m {
-		l[i] = accoCode
-		i++
-	}
-	idx.Unlock()
+	return idx.GetAccoListByPrefix("")
+}
+
+// GetAccoListByPrefix returns a sorted slice of the accommodations in
+// the idx whose code starts with prefix.
+func (idx *CacheIndex) GetAccoListByPrefix(prefix string) []string {
+	var l []string
+	for i := range idx.shards {
+		shard := &idx.shards[i]
+		shard.RLock()
+		for j, entry := range shard.entries {
+			if j > 0 && entry.acco == shard.entries[j-1].acco {
+				continue
+			}
+			if strings.HasPrefix(shard.codes[entry.acco], prefix) {
+				l = append(l, shard.codes[entry.acco])
+			}
+		}
+		shard.RUnlock()
+	}
+	sort.Strings(l)
+	return l
+}
+
+// GetRoomRateCodes returns the sorted room rate codes of an
+// accommodation which match pattern, see MatchCode. An empty
+// pattern matches all room rate codes.
+func (idx *CacheIndex) GetRoomRateCodes(accoCode string, pattern string) []string {
+	var l []string
+	shard := idx.shard(accoCode)
+	shard.RLock()
+	lo, hi := shard.accoRange(accoCode)
+	for i := lo; i < hi; i++ {
+		if i > lo && shard.entries[i].room == shard.entries[i-1].room {
+			continue
+		}
+		room := shard.codes[shard.entries[i].room]
+		if len(pattern) == 0 || MatchCode(pattern, room) {
+			l = append(l, room)
+		}
+	}
+	shard.RUnlock()
 	sort.Strings(l)
 	return l
 }
 
 func (idx *CacheIndex) GetAccommodation(AccoCode string) map[string][][]OccupancyItem {
 	rooms := make(map[string][][]OccupancyItem)
-	idx.Lock()
-	entries := idx.m[AccoCode]
-	for code, occupancies := range entries {
-		for _, occupancy := range occupancies {
-			var o []OccupancyItem
-			o = append(o, occupancy.Occupancy...)
-			rooms[code] = append(rooms[code], o)
-		}
+	shard := idx.shard(AccoCode)
+	shard.RLock()
+	lo, hi := shard.accoRange(AccoCode)
+	for _, entry := range shard.entries[lo:hi] {
+		var o []OccupancyItem
+		o = append(o, shard.occs[entry.occ].items...)
+		room := shard.codes[entry.room]
+		rooms[room] = append(rooms[room], o)
 	}
-	idx.Unlock()
+	shard.RUnlock()
 	return rooms
 }
 
 //AddRoomOccIdx adds a new RoomOccIdx to the index.
 func (idx *CacheIndex) AddRoomOccIdx(accoCode string, roomRateCode string, roomOccIdx RoomOccIdx) error {
-	idx.Lock()
-	_, ok := idx.m[accoCode]
-	if !ok {
-		idx.m[accoCode] = make(map[string][]RoomOccIdx)
-	}
-	idx.m[accoCode][roomRateCode] = append(idx.m[accoCode][roomRateCode], roomOccIdx)
-	idx.Unlock()
+	shard := idx.shard(accoCode)
+	shard.Lock()
+	shard.insert(shard.newEntry(accoCode, roomRateCode, roomOccIdx))
+	shard.Unlock()
 	return nil
 }
 
-// Save saves the whole index to a file.
-// Index format is:
+// AddRoomOccIdxIfNew adds a RoomOccIdx to the index unless the room rate
+// already has an entry for the same rate block. It returns true if the
+// entry was added. Use it for entries that may be received more than once.
+func (idx *CacheIndex) AddRoomOccIdxIfNew(accoCode string, roomRateCode string, roomOccIdx RoomOccIdx) bool {
+	shard := idx.shard(accoCode)
+	shard.Lock()
+	defer shard.Unlock()
+	lo, hi := shard.accoRange(accoCode)
+	first, last := shard.roomRange(lo, hi, roomRateCode)
+	for _, existing := range shard.entries[first:last] {
+		if existing.idx == roomOccIdx.Idx {
+			return false
+		}
+	}
+	shard.insert(shard.newEntry(accoCode, roomRateCode, roomOccIdx))
+	return true
+}
+
+// RemoveRoomOccIdx removes the entry for the rate block with index from
+// a room rate. It returns false if there is no such entry. The rate
+// block is remembered as removed, see Removed.
+func (idx *CacheIndex) RemoveRoomOccIdx(accoCode string, roomRateCode string, index uint32) bool {
+	shard := idx.shard(accoCode)
+	shard.Lock()
+	defer shard.Unlock()
+	lo, hi := shard.accoRange(accoCode)
+	first, last := shard.roomRange(lo, hi, roomRateCode)
+	for i := first; i < last; i++ {
+		if shard.entries[i].idx == index {
+			idx.setRemoved(IdxEntry{AccoCode: accoCode, RoomRateCode: roomRateCode, RoomOccIdx: shard.roomOccIdx(shard.entries[i])})
+			shard.remove(i)
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *CacheIndex) setRemoved(entry IdxEntry) {
+	idx.mu.Lock()
+	if idx.removed == nil {
+		idx.removed = make(map[uint32]IdxEntry)
+	}
+	idx.removed[entry.RoomOccIdx.Idx] = entry
+	idx.mu.Unlock()
+}
+
+// Removed returns the entries of the removed rate blocks in the
+// order of the blocks.
+func (idx *CacheIndex) Removed() []IdxEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	entries := make([]IdxEntry, 0, len(idx.removed))
+	for _, entry := range idx.removed {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RoomOccIdx.Idx < entries[j].RoomOccIdx.Idx })
+	return entries
+}
+
+// RemovedBlocks returns the indexes of the removed rate blocks
+// in ascending order.
+func (idx *CacheIndex) RemovedBlocks() []uint32 {
+	var blocks []uint32
+	for _, entry := range idx.Removed() {
+		blocks = append(blocks, entry.RoomOccIdx.Idx)
+	}
+	return blocks
+}
+
+// IsRemoved tells whether the rate block with index was removed.
+func (idx *CacheIndex) IsRemoved(index uint32) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	_, ok := idx.removed[index]
+	return ok
+}
+
+// Save saves the whole index to a file in the current index file
+// format, see IdxFileHeader. Removed rate blocks are saved as entry
+// followed by a tombstone, so that they stay removed when the index
+// is rebuilt from the cache file. Record format is:
 // - AccoCode (length as of FileHeader object)
 // - RoomCode (length as of FileHeader object)
 // - 8 Occupancy items (1 MinAge, 1 MaxAge, 1 Count)
-// - Index (uint16)
+// - Index (uint32)
+// - Record type (1 byte)
+// - Checksum of the bytes before (crc32)
 func (idx *CacheIndex) Save(fhdr *FileHeader, filename string) error {
-	blockSize := fhdr.AccoCodeLength + fhdr.RoomRateCodeLength + FixIdxRecSize
-	buf := make([]byte, blockSize)
+	ihdr := NewIdxFileHeader(fhdr)
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	idx.Lock()
-	for accoCode, roomRateMap := range idx.m {
-		for roomRateCode, occupancies := range roomRateMap {
-			for _, occupancy := range occupancies {
-				copy(buf[0:], []byte(accoCode))
-				copy(buf[fhdr.AccoCodeLength:], []byte(roomRateCode))
-				copy(buf[fhdr.AccoCodeLength+fhdr.RoomRateCodeLength:], *occupancy.ToByteStr())
-				//copy(buf[blockSize-4:])
-				f.Write(buf)
+	idx.rlockAll()
+	defer idx.runlockAll()
+	removed := idx.Removed()
+	for i := range idx.shards {
+		ihdr.RecordCount += uint32(len(idx.shards[i].entries))
+	}
+	ihdr.RecordCount += uint32(2 * len(removed))
+	_, err = f.Write(ihdr.ToByteStr())
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i := range idx.shards {
+		shard := &idx.shards[i]
+		for _, entry := range shard.entries {
+			buf, err := ihdr.RecordToByteStr(IdxRecord{Entry: IdxEntry{AccoCode: shard.codes[entry.acco], RoomRateCode: shard.codes[entry.room], RoomOccIdx: shard.roomOccIdx(entry)}})
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(buf)
+			if err != nil {
+				return err
 			}
 		}
 	}
-	idx.Unlock()
-	return nil
+	for _, entry := range removed {
+		for _, tombstone := range []bool{false, true} {
+			buf, err := ihdr.RecordToByteStr(IdxRecord{Entry: entry, Tombstone: tombstone})
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	idx.records = int64(ihdr.RecordCount)
+	idx.mu.Unlock()
+	return f.Sync()
 }
 
-// Load reads the cache index from a file.
+// Load reads the cache index from a file. Index files without header
+// (legacy format) are still read, see IsLegacyFile. Tombstone records
+// remove the entry of their rate block again.
 func (idx *CacheIndex) Load(fhdr *FileHeader, filename string) error {
 	f, err := os.OpenFile(filename, os.O_RDONLY, 644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	recordSize := int64(fhdr.AccoCodeLength + fhdr.RoomRateCodeLength + FixIdxRecSize)
+	ihdr, err := ReadIdxFileHeader(f)
+	if err != nil {
+		return err
+	}
+	err = ihdr.Check(fhdr)
+	if err != nil {
+		return err
+	}
 	statInfo, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	fSize := statInfo.Size()
-	if fSize%recordSize != 0 {
+	recordCount, partial := ihdr.CountRecords(statInfo.Size())
+	if partial {
 		return errors.New("Incorrect file size. File may be corrupt")
 	}
+	if recordCount < int64(ihdr.RecordCount) {
+		return fmt.Errorf("Index file has %d records, header expects %d. File may be truncated", recordCount, ihdr.RecordCount)
+	}
+	recordSize := ihdr.RecordSize()
 	buf := make([]byte, recordSize)
-	var accoCode string
-	var roomRateCode string
-	var idxValue uint32
-	var roomOccIdx RoomOccIdx
-	recordCount := fSize / recordSize
+	removed := make(map[uint32]IdxEntry)
+	loader := idx.beginBulk()
+	defer loader.done()
 	for i := int64(0); i < recordCount; i++ {
-		f.ReadAt(buf, i*recordSize)
-		accoCode = string(bytes.Trim(buf[0:fhdr.AccoCodeLength], "\x00"))
-		roomRateCode = string(bytes.Trim(buf[fhdr.AccoCodeLength:fhdr.AccoCodeLength+fhdr.RoomRateCodeLength], "\x00"))
-		idxValue = binary.BigEndian.Uint32(buf[recordSize-4 : recordSize])
-		roomOccIdx = RoomOccIdx{Idx: idxValue}
-		for j := 0; j < 8; j++ {
-			offStart := int(fhdr.AccoCodeLength+fhdr.RoomRateCodeLength) + j*3
-			tripleBuf := buf[offStart : offStart+3]
-			if tripleBuf[2] > 0 {
-				roomOccIdx.AddOccItem(uint8(tripleBuf[0]), uint8(tripleBuf[1]), uint8(tripleBuf[2]))
-			}
+		_, err = f.ReadAt(buf, ihdr.RecordPos(i))
+		if err != nil {
+			return err
+		}
+		rec, err := ihdr.RecordFromByteStr(buf)
+		if err != nil {
+			return fmt.Errorf("Index record %d: %v", i, err)
+		}
+		if !rec.Tombstone {
+			loader.add(rec.Entry)
+		} else if loader.remove(rec.Entry.AccoCode, rec.Entry.RoomRateCode, rec.Entry.RoomOccIdx.Idx) {
+			removed[rec.Entry.RoomOccIdx.Idx] = rec.Entry
 		}
-		idx.AddRoomOccIdx(accoCode, roomRateCode, roomOccIdx)
 	}
+	idx.mu.Lock()
+	idx.records = recordCount
+	idx.legacy = ihdr.IsLegacy()
+	idx.removed = removed
+	idx.mu.Unlock()
 	return nil
 }
 
-func (idx *CacheIndex) LoadFromCache(filename string) error {
+// GetRecordCount returns the number of records read by Load
+// or written by Save.
+func (idx *CacheIndex) GetRecordCount() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.records
+}
+
+// IsLegacyFile tells whether Load read an index file without header.
+func (idx *CacheIndex) IsLegacyFile() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.legacy
+}
+
+// IdxEntryFromIdxRecord creates an index entry from a record
+// of the index file.
+func IdxEntryFromIdxRecord(buf []byte, AccoCodeLength uint8, RoomRateCodeLength uint8) IdxEntry {
+	offset := int(AccoCodeLength) + int(RoomRateCodeLength)
+	recordSize := offset + FixIdxRecSize
+	entry := IdxEntry{}
+	entry.AccoCode = string(bytes.Trim(buf[0:AccoCodeLength], "\x00"))
+	entry.RoomRateCode = string(bytes.Trim(buf[AccoCodeLength:offset], "\x00"))
+	entry.RoomOccIdx = RoomOccIdx{Idx: binary.BigEndian.Uint32(buf[recordSize-4 : recordSize])}
+	for j := offset; j < offset+24; j += 3 {
+		if buf[j+2] > 0 {
+			entry.RoomOccIdx.AddOccItem(uint8(buf[j]), uint8(buf[j+1]), uint8(buf[j+2]))
+		}
+	}
+	return entry
+}
+
+// LoadFromCache rebuilds the index from the rate block headers of
+// the cache file filename. The rate blocks in removed, e.g. those
+// removed by tombstones of the index file, are left out and remembered
+// as removed, see Removed.
+func (idx *CacheIndex) LoadFromCache(filename string, removed []uint32) error {
 	f, err := os.OpenFile(filename, os.O_RDONLY, 644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	buf := make([]byte, FileHeaderSize)
-	f.Read(buf)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		return err
+	}
 	fhdr, err := FileHeaderFromByteStr(buf)
 	if err != nil {
 		return err
 	}
+	statInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if statInfo.Size() < fhdr.GetRateBlockStart(fhdr.RateBlockCount) {
+		return errors.New("Cache file is too short for its RateBlockCount")
+	}
+	skip := make(map[uint32]bool)
+	for _, index := range removed {
+		skip[index] = true
+	}
 	blockHeaderSize := fhdr.GetBlockHeaderSize()
 	hdrbuf := make([]byte, blockHeaderSize)
-	var accoCode string
-	var roomRateCode string
-	var roomOccIdx RoomOccIdx
+	loader := idx.beginBulk()
+	defer loader.done()
 	for i := uint32(0); i < fhdr.RateBlockCount; i++ {
-		f.ReadAt(hdrbuf, fhdr.GetRateBlockStart(i))
-		accoCode = string(bytes.Trim(hdrbuf[0:fhdr.AccoCodeLength], "\x00"))
-		roomRateCode = string(bytes.Trim(hdrbuf[fhdr.AccoCodeLength:fhdr.AccoCodeLength+fhdr.RoomRateCodeLength], "\x00"))
-		roomOccIdx = RoomOccIdx{Idx: i}
-		for j := int(fhdr.AccoCodeLength + fhdr.RoomRateCodeLength); j < blockHeaderSize; j += 3 {
-			if uint8(hdrbuf[j+2]) > 0 {
-				roomOccIdx.AddOccItem(uint8(hdrbuf[j]), uint8(hdrbuf[j+1]), uint8(hdrbuf[j+2]))
-			}
+		_, err = f.ReadAt(hdrbuf, fhdr.GetRateBlockStart(i))
+		if err != nil {
+			return err
+		}
+		entry := IdxEntryFromBlockHeader(hdrbuf, fhdr.AccoCodeLength, fhdr.RoomRateCodeLength, i)
+		if skip[i] {
+			idx.setRemoved(entry)
+			continue
 		}
-		idx.AddRoomOccIdx(accoCode, roomRateCode, roomOccIdx)
+		loader.add(entry)
 	}
 	return nil
 }
 
+// IdxEntryFromBlockHeader creates the index entry for the rate block
+// with index from the rate block header in byteStr.
+func IdxEntryFromBlockHeader(byteStr []byte, AccoCodeLength uint8, RoomRateCodeLength uint8, index uint32) IdxEntry {
+	entry := IdxEntry{}
+	entry.AccoCode = string(bytes.Trim(byteStr[0:AccoCodeLength], "\x00"))
+	entry.RoomRateCode = string(bytes.Trim(byteStr[AccoCodeLength:int(AccoCodeLength)+int(RoomRateCodeLength)], "\x00"))
+	entry.RoomOccIdx = RoomOccIdx{Idx: index}
+	offset := int(AccoCodeLength) + int(RoomRateCodeLength)
+	for j := offset; j < offset+24; j += 3 {
+		if uint8(byteStr[j+2]) > 0 {
+			entry.RoomOccIdx.AddOccItem(uint8(byteStr[j]), uint8(byteStr[j+1]), uint8(byteStr[j+2]))
+		}
+	}
+	return entry
+}
+
 func cmpOccupancy(occ1 []OccupancyItem, occ2 []OccupancyItem) bool {
 	if len(occ1) != len(occ2) {
 		return false
@@ -346,17 +767,18 @@ func cmpOccupancy(occ1 []OccupancyItem, occ2 []OccupancyItem) bool {
 }
 
 func (idx *CacheIndex) Get(q IndexQuery) (uint32, bool) {
-	idx.Lock()
-	occupancies := idx.m[q.AccoCode][q.RoomRateCode]
-	for _, occupancy := range occupancies {
-		if occupancy.Total == q.OccTotal {
-			if cmpOccupancy(q.Occupancy, occupancy.Occupancy) == true {
-				index := occupancy.Idx
-				idx.Unlock()
-				return index, true
+	shard := idx.shard(q.AccoCode)
+	shard.RLock()
+	defer shard.RUnlock()
+	lo, hi := shard.accoRange(q.AccoCode)
+	first, last := shard.roomRange(lo, hi, q.RoomRateCode)
+	for _, entry := range shard.entries[first:last] {
+		occ := shard.occs[entry.occ]
+		if occ.total == q.OccTotal {
+			if cmpOccupancy(q.Occupancy, occ.items) == true {
+				return entry.idx, true
 			}
 		}
 	}
-	idx.Unlock()
 	return 0, false
 }
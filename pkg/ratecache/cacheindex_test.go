@@ -1,8 +1,11 @@
 package ratecache
 
 import (
+	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -24,26 +27,26 @@ func TestCacheIndex(t *testing.T) {
 	roomOccIdx.AddOccItem(9, 14, 1)
 	roomOccIdx.AddOccItem(15, 100, 2)
 	idx.AddRoomOccIdx("ALC001", "DBL001", roomOccIdx)
-	if len(idx.m) != 1 {
-		t.Errorf("Value: %d, expected 1", len(idx.m))
+	if idx.GetAccoCount() != 1 {
+		t.Errorf("Value: %d, expected 1", idx.GetAccoCount())
 	}
 	roomOccIdx = RoomOccIdx{}
 	roomOccIdx.AddOccItem(9, 14, 1)
 	roomOccIdx.AddOccItem(15, 100, 2)
 	idx.AddRoomOccIdx("ALC001", "DBL001", roomOccIdx)
-	if len(idx.m) != 1 {
-		t.Errorf("Value: %d, expected 1", len(idx.m))
+	if idx.GetAccoCount() != 1 {
+		t.Errorf("Value: %d, expected 1", idx.GetAccoCount())
 	}
-	if len(idx.m["ALC001"]["DBL001"]) != 2 {
-		t.Errorf("Value: %d, expected 1", len(idx.m["ALC001"]["DBL001"]))
+	if len(idx.Select("ALC001", "DBL001", "")) != 2 {
+		t.Errorf("Value: %d, expected 1", len(idx.Select("ALC001", "DBL001", "")))
 	}
 	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
 	idxFilename := "../../test/data/test.idx"
 	idx.Save(fhdr, idxFilename)
 	idx2 := NewCacheIndex()
 	idx2.Load(fhdr, idxFilename)
-	if len(idx2.m) != 1 {
-		t.Errorf("Value: %d, expected 1", len(idx.m))
+	if idx2.GetAccoCount() != 1 {
+		t.Errorf("Value: %d, expected 1", idx.GetAccoCount())
 	}
 
 }
@@ -65,7 +68,7 @@ func TestLoadFromCache(t *testing.T) {
 	AddRateBlockToFile(f, byteStr)
 	f.Close()
 	idx2 := NewCacheIndex()
-	idx2.LoadFromCache(filepath.Join(testfolder, filename))
+	idx2.LoadFromCache(filepath.Join(testfolder, filename), nil)
 
 }
 
@@ -138,3 +141,244 @@ func TestOccIdxMatch(t *testing.T) {
 		t.Error("Expected true")
 	}
 }
+
+func TestOccIdxMatchOverlapping(t *testing.T) {
+	roomOccIdx := RoomOccIdx{Idx: 1}
+	roomOccIdx.AddOccItem(0, 17, 1)
+	roomOccIdx.AddOccItem(2, 99, 2)
+	for _, guests := range [][]uint8{{1, 30, 40}, {30, 1, 40}, {5, 8, 40}, {8, 1, 40}, {30, 40, 50}} {
+		expected := !(guests[0] >= 30 && guests[1] >= 30)
+		if roomOccIdx.Match(guests) != expected {
+			t.Errorf("Guests %v: expected %v", guests, expected)
+		}
+	}
+	roomOccIdx = RoomOccIdx{Idx: 2}
+	roomOccIdx.AddOccItem(2, 99, 2)
+	roomOccIdx.AddOccItem(0, 17, 1)
+	guests := []uint8{30, 1, 40}
+	if !roomOccIdx.Match(guests) {
+		t.Error("Expected true independent of the order of occupancy items")
+	}
+	if guests[0] != 30 || guests[1] != 1 {
+		t.Error("Match must not reorder the guests")
+	}
+}
+
+func TestFindOccupancySelection(t *testing.T) {
+	idx := NewCacheIndex()
+	for i, maxAge := range []uint8{100, 17, 50} {
+		roomOccIdx := RoomOccIdx{Idx: uint32(i)}
+		roomOccIdx.AddOccItem(2, maxAge, 2)
+		idx.AddRoomOccIdx("ALC001", "DBL001", roomOccIdx)
+	}
+	searchRq := SearchRq{Occupancy: []uint8{10, 12}, Accommodations: []AccoRoomRate{{AccoCode: "ALC001"}}}
+	result := idx.Find(&searchRq)
+	if len(result) != 1 || len(result[0].Rooms) != 1 {
+		t.Fatalf("Unexpected result %v", result)
+	}
+	if result[0].Rooms[0].Index != 0 || len(result[0].Rooms[0].Alternatives) != 0 {
+		t.Errorf("Expected first matching occupancy only, got %v", result[0].Rooms[0])
+	}
+	searchRq.OccupancySelection = OccupancySelectionCheapest
+	result = idx.Find(&searchRq)
+	room := result[0].Rooms[0]
+	if room.Index != 0 || len(room.Alternatives) != 2 || room.Alternatives[0] != 1 || room.Alternatives[1] != 2 {
+		t.Errorf("Expected all matching occupancies, got %v", room)
+	}
+}
+
+func TestFindOccupancies(t *testing.T) {
+	idx := NewCacheIndex()
+	roomOccIdx := RoomOccIdx{Idx: 0}
+	roomOccIdx.AddOccItem(17, 100, 2)
+	idx.AddRoomOccIdx("ALC001", "DBL001", roomOccIdx)
+	roomOccIdx = RoomOccIdx{Idx: 1}
+	roomOccIdx.AddOccItem(2, 16, 1)
+	roomOccIdx.AddOccItem(17, 100, 2)
+	idx.AddRoomOccIdx("ALC001", "DBL001", roomOccIdx)
+	idx.AddRoomOccIdx("ALC002", "FAM001", roomOccIdx)
+	searchRq := SearchRq{Accommodations: []AccoRoomRate{{AccoCode: "ALC001"}, {AccoCode: "ALC002"}}}
+	results := idx.FindOccupancies(&searchRq, []Ages{{30, 32}, {30, 32, 8}, {1}})
+	if len(results) != 3 {
+		t.Fatalf("Value: %v, expected: 3", len(results))
+	}
+	if len(results[0]) != 1 || results[0][0].AccoCode != "ALC001" || results[0][0].Rooms[0].Index != 0 {
+		t.Errorf("Unexpected result for 2 adults: %v", results[0])
+	}
+	if len(results[1]) != 2 || results[1][0].Rooms[0].Index != 1 || results[1][1].AccoCode != "ALC002" {
+		t.Errorf("Unexpected result for 2 adults and 1 child: %v", results[1])
+	}
+	if len(results[2]) != 0 {
+		t.Errorf("Unexpected result for 1 infant: %v", results[2])
+	}
+}
+
+func TestCodeLookup(t *testing.T) {
+	idx := NewCacheIndex()
+	roomOccIdx := RoomOccIdx{}
+	roomOccIdx.AddOccItem(17, 100, 2)
+	for i, code := range []string{"PMI00001/DBLSTDHB01", "PMI00001/DBLSTDBB01", "PMI00001/SGLSTDHB01", "PMI00002/DBLSUPHB01", "ZRH00001/DBLSTDHB01"} {
+		codes := strings.Split(code, "/")
+		roomOccIdx.Idx = uint32(i)
+		idx.AddRoomOccIdx(codes[0], codes[1], roomOccIdx)
+	}
+	accoList := idx.GetAccoListByPrefix("PMI")
+	if len(accoList) != 2 || accoList[0] != "PMI00001" || accoList[1] != "PMI00002" {
+		t.Errorf("Unexpected accommodations %v", accoList)
+	}
+	roomRateCodes := idx.GetRoomRateCodes("PMI00001", "DBL*")
+	if len(roomRateCodes) != 2 || roomRateCodes[0] != "DBLSTDBB01" || roomRateCodes[1] != "DBLSTDHB01" {
+		t.Errorf("Unexpected room rate codes %v", roomRateCodes)
+	}
+	searchRq := SearchRq{Occupancy: []uint8{30, 32}, Accommodations: []AccoRoomRate{
+		{AccoCode: "PMI00001", RoomRateCodePattern: "*HB*"},
+		{AccoCode: "PMI00002", RoomRateCodePattern: "SGL*"},
+	}}
+	result := idx.Find(&searchRq)
+	if len(result) != 1 || len(result[0].Rooms) != 2 {
+		t.Fatalf("Unexpected result %v", result)
+	}
+	for _, room := range result[0].Rooms {
+		if !strings.Contains(room.RoomRateCode, "HB") {
+			t.Errorf("Unexpected room rate %v", room.RoomRateCode)
+		}
+	}
+}
+
+func TestAddRoomOccIdxIfNew(t *testing.T) {
+	idx := NewCacheIndex()
+	roomOccIdx := RoomOccIdx{Idx: 3}
+	roomOccIdx.AddOccItem(18, 100, 2)
+	if !idx.AddRoomOccIdxIfNew("ALC001", "DBL001", roomOccIdx) {
+		t.Error("Expected new entry to be added")
+	}
+	if idx.AddRoomOccIdxIfNew("ALC001", "DBL001", roomOccIdx) {
+		t.Error("Expected entry for the same rate block to be ignored")
+	}
+	roomOccIdx.Idx = 4
+	idx.AddRoomOccIdxIfNew("ALC001", "DBL001", roomOccIdx)
+	if idx.GetEntryCount() != 2 {
+		t.Errorf("Value: %d, expected 2", idx.GetEntryCount())
+	}
+	idx.RemoveRoomOccIdx("ALC001", "DBL001", 3)
+	if idx.GetNextIndex() != 5 {
+		t.Errorf("Value: %d, expected 5", idx.GetNextIndex())
+	}
+}
+
+func TestCacheIndexConcurrent(t *testing.T) {
+	idx := newBenchmarkIndex(100)
+	done := make(chan bool)
+	go func() {
+		for i := uint32(0); i < 1000; i++ {
+			roomOccIdx := RoomOccIdx{Idx: 10000 + i}
+			roomOccIdx.AddOccItem(17, 100, 3)
+			idx.AddRoomOccIdx(fmt.Sprintf("ALC%06d", i%150), "TRP001", roomOccIdx)
+			idx.RemoveRoomOccIdx(fmt.Sprintf("ALC%06d", i%100), "SGL001", i%100*12)
+		}
+		close(done)
+	}()
+	searchRq := SearchRq{Occupancy: []uint8{30, 32}, Accommodations: []AccoRoomRate{{AccoCode: "ALC000001"}, {AccoCode: "ALC000120"}}}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		idx.Find(&searchRq)
+		idx.Select("", "", "TRP")
+		idx.GetAccoList()
+	}
+	if idx.GetAccoCount() != 150 {
+		t.Errorf("Value: %v, expected: 150", idx.GetAccoCount())
+	}
+	if idx.GetEntryCount() != 100*12+1000-100 {
+		t.Errorf("Value: %v, expected: %v", idx.GetEntryCount(), 100*12+1000-100)
+	}
+}
+
+func TestIndexMemoryStats(t *testing.T) {
+	idx := newBenchmarkIndex(10)
+	stats := idx.MemoryStats()
+	if stats.Entries != 120 {
+		t.Errorf("Value: %v, expected: 120", stats.Entries)
+	}
+	// every shard stores its own codes and occupancies
+	if stats.Codes < 14 || stats.Codes > 10*5 || stats.Occupancies < 3 || stats.Occupancies > 10*3 {
+		t.Errorf("Unexpected dictionary sizes %v", stats)
+	}
+	if stats.Bytes < 120*16 {
+		t.Errorf("Value: %v, expected at least %v", stats.Bytes, 120*16)
+	}
+}
+
+// newBenchmarkIndex returns an index with count accommodations with
+// 4 room rates of 3 occupancies each.
+func newBenchmarkIndex(count int) *CacheIndex {
+	idx := NewCacheIndex()
+	index := uint32(0)
+	for i := 0; i < count; i++ {
+		accoCode := fmt.Sprintf("ALC%06d", i)
+		for _, roomRateCode := range []string{"SGL001", "DBL001", "DBL002", "FAM001"} {
+			for children := uint8(0); children < 3; children++ {
+				roomOccIdx := RoomOccIdx{Idx: index}
+				roomOccIdx.AddOccItem(17, 100, 2)
+				if children > 0 {
+					roomOccIdx.AddOccItem(2, 16, children)
+				}
+				idx.AddRoomOccIdx(accoCode, roomRateCode, roomOccIdx)
+				index++
+			}
+		}
+	}
+	return idx
+}
+
+func benchmarkFindParallel(b *testing.B, withWrites bool) {
+	const accoCount = 100000
+	idx := newBenchmarkIndex(accoCount)
+	done := make(chan bool)
+	if withWrites {
+		go func() {
+			index := uint32(accoCount * 12)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				roomOccIdx := RoomOccIdx{Idx: index}
+				roomOccIdx.AddOccItem(17, 100, 3)
+				idx.AddRoomOccIdxIfNew(fmt.Sprintf("ALC%06d", index%accoCount), "TRP001", roomOccIdx)
+				index++
+			}
+		}()
+	}
+	codes := make([]string, accoCount)
+	for i := range codes {
+		codes[i] = fmt.Sprintf("ALC%06d", i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		searchRq := SearchRq{Occupancy: []uint8{30, 32, 8}, Accommodations: make([]AccoRoomRate, 10)}
+		for pb.Next() {
+			for i := range searchRq.Accommodations {
+				searchRq.Accommodations[i] = AccoRoomRate{AccoCode: codes[rnd.Intn(accoCount)]}
+			}
+			if len(idx.Find(&searchRq)) != len(searchRq.Accommodations) {
+				b.Fatal("Expected a result for every accommodation")
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+}
+
+func BenchmarkFindParallel(b *testing.B) {
+	benchmarkFindParallel(b, false)
+}
+
+func BenchmarkFindParallelWithWrites(b *testing.B) {
+	benchmarkFindParallel(b, true)
+}
@@ -0,0 +1,261 @@
+package ratecache
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// CodeField is a fixed-width field of a code, starting at Start
+// (0-based) with Length characters.
+type CodeField struct {
+	Name   string `json:"name"`
+	Start  int    `json:"start"`
+	Length int    `json:"length"`
+}
+
+// CodeFormat defines the fields of a code, either as named groups of
+// the regular expression Pattern, e.g. "^(?P<roomType>[A-Z]{3})", or
+// as fixed-width Fields. Surrounding spaces are removed from values.
+type CodeFormat struct {
+	Pattern string      `json:"pattern"`
+	Fields  []CodeField `json:"fields"`
+	re      *regexp.Regexp
+	// cache contains the parsed fields of the codes in the index,
+	// see CodeSchema.AddIndex
+	cache map[string]map[string]string
+	mu    sync.RWMutex
+}
+
+// compile checks the format and compiles the regular expression.
+func (format *CodeFormat) compile() error {
+	if len(format.Pattern) > 0 {
+		re, err := regexp.Compile(format.Pattern)
+		if err != nil {
+			return err
+		}
+		format.re = re
+	}
+	for _, field := range format.Fields {
+		if len(field.Name) == 0 || field.Start < 0 || field.Length <= 0 {
+			return fmt.Errorf("Invalid field %v", field)
+		}
+	}
+	format.cache = make(map[string]map[string]string)
+	return nil
+}
+
+// FieldNames returns the names of all fields of the format.
+func (format *CodeFormat) FieldNames() []string {
+	var names []string
+	if format.re != nil {
+		for _, name := range format.re.SubexpNames() {
+			if len(name) > 0 {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, field := range format.Fields {
+		names = append(names, field.Name)
+	}
+	return names
+}
+
+// isEmpty tells whether the format defines no fields.
+func (format *CodeFormat) isEmpty() bool {
+	return format.re == nil && len(format.Fields) == 0
+}
+
+// Parse returns the fields of code. Fields the code does not contain,
+// e.g. because it does not match Pattern, are left out. The fields of
+// codes added with add are taken from the cache, other codes are parsed
+// on every call. The returned map is shared and must not be changed.
+func (format *CodeFormat) Parse(code string) map[string]string {
+	if format.isEmpty() {
+		return nil
+	}
+	format.mu.RLock()
+	fields, ok := format.cache[code]
+	format.mu.RUnlock()
+	if ok {
+		return fields
+	}
+	return format.parse(code)
+}
+
+func (format *CodeFormat) parse(code string) map[string]string {
+	fields := make(map[string]string)
+	if format.re != nil {
+		match := format.re.FindStringSubmatch(code)
+		for i, name := range format.re.SubexpNames() {
+			if match != nil && len(name) > 0 {
+				fields[name] = strings.TrimSpace(match[i])
+			}
+		}
+	}
+	for _, field := range format.Fields {
+		if field.Start >= len(code) {
+			continue
+		}
+		end := field.Start + field.Length
+		if end > len(code) {
+			end = len(code)
+		}
+		fields[field.Name] = strings.TrimSpace(code[field.Start:end])
+	}
+	return fields
+}
+
+// add parses codes that are not cached yet and adds them to the cache.
+func (format *CodeFormat) add(codes []string) {
+	if format.isEmpty() {
+		return
+	}
+	format.mu.Lock()
+	defer format.mu.Unlock()
+	for _, code := range codes {
+		if _, ok := format.cache[code]; !ok {
+			format.cache[code] = format.parse(code)
+		}
+	}
+}
+
+// replace replaces the cache with the parsed fields of codes.
+func (format *CodeFormat) replace(codes []string) {
+	if format.isEmpty() {
+		return
+	}
+	cache := make(map[string]map[string]string, len(codes))
+	for _, code := range codes {
+		if _, ok := cache[code]; !ok {
+			cache[code] = format.parse(code)
+		}
+	}
+	format.mu.Lock()
+	format.cache = cache
+	format.mu.Unlock()
+}
+
+// CodeSchema defines how accommodation codes and room rate codes are
+// composed, so that searches can be filtered by the fields of the codes.
+type CodeSchema struct {
+	AccoCode     CodeFormat `json:"accoCode"`
+	RoomRateCode CodeFormat `json:"roomRateCode"`
+}
+
+// CodeFilter restricts a search to the room rates whose code field
+// Field has one of Values. Field may be a field of the room rate code
+// or of the accommodation code.
+type CodeFilter struct {
+	Field  string   `json:"field"`
+	Values []string `json:"values"`
+}
+
+// Compile checks the schema and compiles the regular expressions. It
+// must be called before the schema is used.
+func (schema *CodeSchema) Compile() error {
+	err := schema.AccoCode.compile()
+	if err != nil {
+		return fmt.Errorf("accoCode: %v", err)
+	}
+	err = schema.RoomRateCode.compile()
+	if err != nil {
+		return fmt.Errorf("roomRateCode: %v", err)
+	}
+	return nil
+}
+
+// AddIndex replaces the parsed codes with the codes in idx. Only codes
+// of the index are kept parsed, so that codes sent in search requests
+// cannot grow the cache.
+func (schema *CodeSchema) AddIndex(idx *CacheIndex) {
+	var accoCodes, roomRateCodes []string
+	for _, accoCode := range idx.GetAccoList() {
+		accoCodes = append(accoCodes, accoCode)
+		roomRateCodes = append(roomRateCodes, idx.GetRoomRateCodes(accoCode, "")...)
+	}
+	schema.AccoCode.replace(accoCodes)
+	schema.RoomRateCode.replace(roomRateCodes)
+}
+
+// AddEntries parses the codes of entries that are added to the index.
+func (schema *CodeSchema) AddEntries(entries []IdxEntry) {
+	accoCodes := make([]string, len(entries))
+	roomRateCodes := make([]string, len(entries))
+	for i, entry := range entries {
+		accoCodes[i], roomRateCodes[i] = entry.AccoCode, entry.RoomRateCode
+	}
+	schema.AccoCode.add(accoCodes)
+	schema.RoomRateCode.add(roomRateCodes)
+}
+
+// ValidateFilters returns a message for every filter with an
+// unknown field or without values.
+func (schema *CodeSchema) ValidateFilters(filters []CodeFilter) []string {
+	var msgList []string
+	fieldNames := make(map[string]bool)
+	for _, name := range append(schema.AccoCode.FieldNames(), schema.RoomRateCode.FieldNames()...) {
+		fieldNames[name] = true
+	}
+	for _, filter := range filters {
+		if !fieldNames[filter.Field] {
+			msgList = append(msgList, fmt.Sprintf("Unknown code field %v", filter.Field))
+		}
+		if len(filter.Values) == 0 {
+			msgList = append(msgList, fmt.Sprintf("Filter for %v has no values", filter.Field))
+		}
+	}
+	return msgList
+}
+
+// Matches tells whether the codes match all filters.
+func (schema *CodeSchema) Matches(accoCode string, roomRateCode string, filters []CodeFilter) bool {
+	roomFields := schema.RoomRateCode.Parse(roomRateCode)
+	accoFields := schema.AccoCode.Parse(accoCode)
+	for _, filter := range filters {
+		value, ok := roomFields[filter.Field]
+		if !ok {
+			value, ok = accoFields[filter.Field]
+		}
+		if !ok {
+			return false
+		}
+		match := false
+		for _, v := range filter.Values {
+			if v == value {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterRoomRates restricts the accommodations of searchRq to the room
+// rates for which match returns true. The room rates of every
+// accommodation are looked up in idx, by RoomRateCodes or
+// RoomRateCodePattern, and the matching ones are kept in RoomRateCodes.
+// Accommodations without matching room rate are removed.
+func FilterRoomRates(searchRq *SearchRq, idx *CacheIndex, match func(accoCode string, roomRateCode string) bool) {
+	var accommodations []AccoRoomRate
+	for _, accommodation := range searchRq.Accommodations {
+		codes := accommodation.RoomRateCodes
+		if len(codes) == 0 {
+			codes = idx.GetRoomRateCodes(accommodation.AccoCode, accommodation.RoomRateCodePattern)
+		}
+		var matching []string
+		for _, code := range codes {
+			if match(accommodation.AccoCode, code) {
+				matching = append(matching, code)
+			}
+		}
+		if len(matching) > 0 {
+			accommodations = append(accommodations, AccoRoomRate{AccoCode: accommodation.AccoCode, RoomRateCodes: matching})
+		}
+	}
+	searchRq.Accommodations = accommodations
+}
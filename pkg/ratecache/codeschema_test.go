@@ -0,0 +1,125 @@
+package ratecache
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func newTestCodeSchema(t *testing.T) *CodeSchema {
+	var schema CodeSchema
+	err := json.Unmarshal([]byte(`{
+		"accoCode": {"pattern": "^(?P<destination>[A-Z]{3})"},
+		"roomRateCode": {"fields": [
+			{"name": "roomType", "start": 0, "length": 3},
+			{"name": "category", "start": 3, "length": 3},
+			{"name": "board", "start": 6, "length": 2}
+		]}
+	}`), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = schema.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+func TestCodeSchemaParse(t *testing.T) {
+	schema := newTestCodeSchema(t)
+	fields := schema.RoomRateCode.Parse("DBLSTDHB01")
+	if fields["roomType"] != "DBL" || fields["category"] != "STD" || fields["board"] != "HB" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+	fields = schema.RoomRateCode.Parse("JUS S")
+	if fields["roomType"] != "JUS" || fields["category"] != "S" || len(fields) != 2 {
+		t.Errorf("Unexpected fields of short code %v", fields)
+	}
+	fields = schema.AccoCode.Parse("PMI00001")
+	if fields["destination"] != "PMI" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+	if len(schema.AccoCode.Parse("00001")) != 0 {
+		t.Error("Expected no fields for code not matching the pattern")
+	}
+	msgs := schema.ValidateFilters([]CodeFilter{{Field: "board", Values: []string{"HB"}}, {Field: "view"}})
+	if len(msgs) != 2 {
+		t.Errorf("Unexpected validation messages %v", msgs)
+	}
+	invalid := CodeSchema{RoomRateCode: CodeFormat{Pattern: "(?P<roomType"}}
+	if invalid.Compile() == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
+
+func TestCodeSchemaFilterRoomRates(t *testing.T) {
+	schema := newTestCodeSchema(t)
+	idx := NewCacheIndex()
+	roomOccIdx := RoomOccIdx{}
+	roomOccIdx.AddOccItem(17, 100, 2)
+	for i, code := range []string{"PMI00001/DBLSTDHB01", "PMI00001/DBLSTDBB01", "PMI00001/JUSSUPHB01", "PMI00001/SGLSTDHB01", "PMI00002/SGLSTDBB01", "ZRH00001/DBLSTDHB01"} {
+		codes := strings.Split(code, "/")
+		roomOccIdx.Idx = uint32(i)
+		idx.AddRoomOccIdx(codes[0], codes[1], roomOccIdx)
+	}
+	searchRq := SearchRq{
+		Occupancy: []uint8{30, 32},
+		Accommodations: []AccoRoomRate{
+			{AccoCode: "PMI00001"},
+			{AccoCode: "PMI00002"},
+			{AccoCode: "ZRH00001", RoomRateCodes: []string{"DBLSTDHB01"}},
+		},
+		Filters: []CodeFilter{
+			{Field: "board", Values: []string{"HB"}},
+			{Field: "roomType", Values: []string{"DBL", "JUS"}},
+			{Field: "destination", Values: []string{"PMI"}},
+		},
+	}
+	FilterRoomRates(&searchRq, idx, func(accoCode string, roomRateCode string) bool {
+		return schema.Matches(accoCode, roomRateCode, searchRq.Filters)
+	})
+	if len(searchRq.Accommodations) != 1 {
+		t.Fatalf("Unexpected accommodations %v", searchRq.Accommodations)
+	}
+	roomRateCodes := searchRq.Accommodations[0].RoomRateCodes
+	if len(roomRateCodes) != 2 || roomRateCodes[0] != "DBLSTDHB01" || roomRateCodes[1] != "JUSSUPHB01" {
+		t.Errorf("Unexpected room rate codes %v", roomRateCodes)
+	}
+	result := idx.Find(&searchRq)
+	if len(result) != 1 || len(result[0].Rooms) != 2 {
+		t.Errorf("Unexpected result %v", result)
+	}
+}
+
+func TestCodeSchemaCache(t *testing.T) {
+	schema := newTestCodeSchema(t)
+	idx := NewCacheIndex()
+	roomOccIdx := RoomOccIdx{}
+	roomOccIdx.AddOccItem(17, 100, 2)
+	idx.AddRoomOccIdx("PMI00001", "DBLSTDHB01", roomOccIdx)
+	schema.AddIndex(idx)
+	if len(schema.RoomRateCode.cache) != 1 || len(schema.AccoCode.cache) != 1 {
+		t.Errorf("Expected the codes of the index to be parsed, got %v %v", schema.AccoCode.cache, schema.RoomRateCode.cache)
+	}
+	// codes of requests are parsed but not kept
+	searchRq := SearchRq{
+		Occupancy:      []uint8{30, 32},
+		Accommodations: []AccoRoomRate{{AccoCode: "PMI00001", RoomRateCodes: []string{"DBLSTDHB01", "DBLSTDHB02", "DBLSTDHB03"}}},
+		Filters:        []CodeFilter{{Field: "board", Values: []string{"HB"}}},
+	}
+	FilterRoomRates(&searchRq, idx, func(accoCode string, roomRateCode string) bool {
+		return schema.Matches(accoCode, roomRateCode, searchRq.Filters)
+	})
+	if len(searchRq.Accommodations[0].RoomRateCodes) != 3 {
+		t.Errorf("Unexpected room rate codes %v", searchRq.Accommodations[0].RoomRateCodes)
+	}
+	if len(schema.RoomRateCode.cache) != 1 {
+		t.Errorf("Codes of a request were cached: %v", schema.RoomRateCode.cache)
+	}
+	roomOccIdx.Idx = 1
+	schema.AddEntries([]IdxEntry{{AccoCode: "PMI00001", RoomRateCode: "SGLSTDBB01", RoomOccIdx: roomOccIdx}})
+	if schema.RoomRateCode.cache["SGLSTDBB01"]["board"] != "BB" {
+		t.Errorf("Unexpected cache %v", schema.RoomRateCode.cache)
+	}
+}
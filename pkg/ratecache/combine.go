@@ -0,0 +1,186 @@
+package ratecache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxSearchRooms is the maximum number of rooms of a multi-room search.
+const MaxSearchRooms = 8
+
+// MaxSearchOccupancies is the maximum number of alternative occupancies
+// of a search.
+const MaxSearchOccupancies = 8
+
+// SearchRsCombination is one combination of room options for all rooms
+// of a multi-room search. Rooms are in the order of SearchRq.Rooms,
+// Rate and RateMinorUnits are the sum of the room rates.
+type SearchRsCombination struct {
+	Rooms          []SearchRsRoomOption `json:"rooms"`
+	Rate           Decimal              `json:"rate"`
+	RateMinorUnits uint32               `json:"rateMinorUnits"`
+}
+
+// combinationKey identifies a combination independent of the order
+// of rooms with the same guests, so that e.g. two double rooms for two
+// adults each are not returned twice with swapped room rates.
+func combinationKey(rooms []Ages, chosen []SearchRsRoomOption) string {
+	items := make([]string, len(chosen))
+	for i, option := range chosen {
+		items[i] = fmt.Sprintf("%v:%v", rooms[i], option.RoomRateCode)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// MaxCombineSteps limits the room options CombineRooms tries for one
+// accommodation. If the limit is reached, the cheapest combinations
+// found so far are returned.
+const MaxCombineSteps = 100000
+
+// unitCounter counts the units of every room rate code in a partial
+// combination. If a code is chosen for rooms with different occupancies,
+// the lowest availability applies.
+type unitCounter struct {
+	count map[string]int
+	avail map[string]uint8
+}
+
+// add adds option to the counter and returns false, leaving the counter
+// unchanged, if not enough units of its room rate code are available.
+// The returned availability has to be passed to remove.
+func (units *unitCounter) add(option SearchRsRoomOption) (uint8, bool) {
+	code := option.RoomRateCode
+	prevAvail, ok := units.avail[code]
+	avail := option.Availability
+	if ok && prevAvail < avail {
+		avail = prevAvail
+	}
+	if units.count[code]+1 > int(avail) {
+		return prevAvail, false
+	}
+	units.count[code]++
+	units.avail[code] = avail
+	return prevAvail, true
+}
+
+// remove takes option, added before, off the counter again.
+func (units *unitCounter) remove(option SearchRsRoomOption, prevAvail uint8) {
+	code := option.RoomRateCode
+	units.count[code]--
+	if units.count[code] == 0 {
+		delete(units.count, code)
+		delete(units.avail, code)
+		return
+	}
+	units.avail[code] = prevAvail
+}
+
+// sameOptions tells whether two rooms have the same room rate codes
+// in the same order.
+func sameOptions(a []SearchRsRoomOption, b []SearchRsRoomOption) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].RoomRateCode != b[i].RoomRateCode {
+			return false
+		}
+	}
+	return true
+}
+
+// CombineRooms returns up to limit of the cheapest combinations of one
+// room option per requested room, ordered by the summed rate. options
+// contains the available room options of one accommodation for every
+// room in rooms. Combinations that need more units of a room rate than
+// available are left out. Units and duplicates are checked for every
+// room as it is chosen, and at most MaxCombineSteps options are tried.
+func CombineRooms(rooms []Ages, options [][]SearchRsRoomOption, decimalPlaces uint8, limit int) []SearchRsCombination {
+	if len(rooms) == 0 || len(options) != len(rooms) || limit <= 0 {
+		return nil
+	}
+	sorted := make([][]SearchRsRoomOption, len(options))
+	for i, roomOptions := range options {
+		if len(roomOptions) == 0 {
+			return nil
+		}
+		sorted[i] = make([]SearchRsRoomOption, len(roomOptions))
+		copy(sorted[i], roomOptions)
+		sort.SliceStable(sorted[i], func(a, b int) bool { return sorted[i][a].RateMinorUnits < sorted[i][b].RateMinorUnits })
+	}
+	// minRest[i] is the lowest possible sum of the rooms i to the last one
+	minRest := make([]uint32, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		minRest[i] = minRest[i+1] + sorted[i][0].RateMinorUnits
+	}
+	// rooms with the same guests and options are interchangeable. For
+	// these, only combinations where each room takes an option at the
+	// same or a later position than the previous such room are searched.
+	prevSame := make([]int, len(sorted))
+	for i := range sorted {
+		prevSame[i] = -1
+		for j := i - 1; j >= 0; j-- {
+			if fmt.Sprint(rooms[j]) == fmt.Sprint(rooms[i]) && sameOptions(sorted[j], sorted[i]) {
+				prevSame[i] = j
+				break
+			}
+		}
+	}
+	var combinations []SearchRsCombination
+	seen := make(map[string]bool)
+	chosen := make([]SearchRsRoomOption, len(sorted))
+	chosenPos := make([]int, len(sorted))
+	units := unitCounter{count: make(map[string]int), avail: make(map[string]uint8)}
+	steps := 0
+	var combine func(i int, total uint32)
+	combine = func(i int, total uint32) {
+		if i == len(sorted) {
+			key := combinationKey(rooms, chosen)
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+			combination := SearchRsCombination{
+				Rooms:          append([]SearchRsRoomOption{}, chosen...),
+				Rate:           NewDecimal(int64(total), decimalPlaces),
+				RateMinorUnits: total,
+			}
+			pos := sort.Search(len(combinations), func(j int) bool { return combinations[j].RateMinorUnits > total })
+			combinations = append(combinations, SearchRsCombination{})
+			copy(combinations[pos+1:], combinations[pos:])
+			combinations[pos] = combination
+			if len(combinations) > limit {
+				combinations = combinations[:limit]
+			}
+			return
+		}
+		first := 0
+		if prevSame[i] >= 0 {
+			first = chosenPos[prevSame[i]]
+		}
+		for pos := first; pos < len(sorted[i]); pos++ {
+			if steps >= MaxCombineSteps {
+				return
+			}
+			steps++
+			option := sorted[i][pos]
+			sum := total + option.RateMinorUnits
+			if len(combinations) == limit && sum+minRest[i+1] >= combinations[limit-1].RateMinorUnits {
+				// options are sorted by rate, so no further one can be cheaper
+				return
+			}
+			prevAvail, ok := units.add(option)
+			if !ok {
+				continue
+			}
+			chosen[i] = option
+			chosenPos[i] = pos
+			combine(i+1, sum)
+			units.remove(option, prevAvail)
+		}
+	}
+	combine(0, 0)
+	return combinations
+}
@@ -0,0 +1,95 @@
+package ratecache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCombineRooms(t *testing.T) {
+	rooms := []Ages{{30, 32}, {30, 32}, {8}}
+	dbl := []SearchRsRoomOption{
+		{RoomRateCode: "DBLSTD", RateMinorUnits: 10000, Availability: 1},
+		{RoomRateCode: "DBLSUP", RateMinorUnits: 12000, Availability: 5},
+	}
+	sgl := []SearchRsRoomOption{
+		{RoomRateCode: "SGLSTD", RateMinorUnits: 5000, Availability: 3},
+	}
+	combinations := CombineRooms(rooms, [][]SearchRsRoomOption{dbl, dbl, sgl}, 2, 10)
+	// DBLSTD twice needs 2 units, DBLSUP+DBLSTD and DBLSTD+DBLSUP are the same
+	if len(combinations) != 2 {
+		t.Fatalf("Value: %v, expected: 2 combinations", combinations)
+	}
+	if combinations[0].RateMinorUnits != 27000 || combinations[1].RateMinorUnits != 29000 {
+		t.Errorf("Value: %v/%v, expected: 27000/29000", combinations[0].RateMinorUnits, combinations[1].RateMinorUnits)
+	}
+	if combinations[0].Rate.String() != "270.00" {
+		t.Errorf("Value: %v, expected: 270.00", combinations[0].Rate.String())
+	}
+	if len(combinations[0].Rooms) != 3 || combinations[0].Rooms[2].RoomRateCode != "SGLSTD" {
+		t.Errorf("Unexpected rooms %v", combinations[0].Rooms)
+	}
+	combinations = CombineRooms(rooms, [][]SearchRsRoomOption{dbl, dbl, sgl}, 2, 1)
+	if len(combinations) != 1 || combinations[0].RateMinorUnits != 27000 {
+		t.Errorf("Expected the cheapest combination only, got %v", combinations)
+	}
+	combinations = CombineRooms(rooms, [][]SearchRsRoomOption{dbl, dbl, nil}, 2, 10)
+	if len(combinations) != 0 {
+		t.Errorf("Expected no combination if one room has no options, got %v", combinations)
+	}
+}
+
+// scarceOptions returns count room options with one unit each.
+func scarceOptions(count int) []SearchRsRoomOption {
+	options := make([]SearchRsRoomOption, count)
+	for i := range options {
+		options[i] = SearchRsRoomOption{RoomRateCode: fmt.Sprintf("DBL%02d", i), RateMinorUnits: 10000, Availability: 1}
+	}
+	return options
+}
+
+func TestCombineRoomsScarceAvailability(t *testing.T) {
+	rooms := make([]Ages, MaxSearchRooms)
+	options := make([][]SearchRsRoomOption, MaxSearchRooms)
+	for i := range rooms {
+		rooms[i] = Ages{30, 32}
+		options[i] = scarceOptions(7)
+	}
+	start := time.Now()
+	combinations := CombineRooms(rooms, options, 2, 10)
+	if len(combinations) != 0 {
+		t.Errorf("Value: %v, expected no combination for 8 rooms and 7 units", len(combinations))
+	}
+	for i := range rooms {
+		options[i] = scarceOptions(10)
+	}
+	combinations = CombineRooms(rooms, options, 2, 10)
+	if len(combinations) != 10 {
+		t.Errorf("Value: %v, expected: 10", len(combinations))
+	}
+	for _, combination := range combinations {
+		units := unitCounter{count: make(map[string]int), avail: make(map[string]uint8)}
+		for _, option := range combination.Rooms {
+			if _, ok := units.add(option); !ok {
+				t.Errorf("Combination %v needs more units than available", combination.Rooms)
+			}
+		}
+	}
+	// rooms with different guests cannot be swapped, the search is capped
+	for i := range rooms {
+		rooms[i] = Ages{30, uint8(i)}
+		options[i] = scarceOptions(20)
+	}
+	combinations = CombineRooms(rooms, options, 2, 10)
+	if len(combinations) != 10 {
+		t.Errorf("Value: %v, expected: 10", len(combinations))
+	}
+	rooms = append(rooms[:7:7], Ages{30, 32})
+	for i := range rooms {
+		options[i] = scarceOptions(7)
+	}
+	CombineRooms(rooms, options, 2, 10)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Combining scarce rooms took %v", time.Since(start))
+	}
+}
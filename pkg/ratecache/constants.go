@@ -7,7 +7,11 @@ const Signature = "LOSRATES"
 const Release = "1.0 Beta"
 
 // Version is the format version of the rate file
-const Version = 8
+const Version = 9
+
+// MinVersion is the oldest format version that can still be read.
+// Version 8 has no write counter in the rate block header.
+const MinVersion = 8
 
 // FileHeaderSize is the size of the rate file header in bytes
 const FileHeaderSize = 37
@@ -16,14 +20,27 @@ const FileHeaderSize = 37
 // that does not chane, i.e. without room rate code and acco code
 const FixBlockHeaderSize = 24
 
+// SeqCounterSize is the size of the write counter that follows the
+// occupancy in the rate block header since format version 9.
+const SeqCounterSize = 4
+
 // FixIdxRecSize is the portion of the record size in the
 // index file that does not change, i.e. without room rate code
 // and acco code.
 const FixIdxRecSize = 28
 
-// RateMask masks the upper 4 bytes of an uint32 which is used
-// to transport availability
-const RateMask uint32 = 268435455
+// RateMask masks the lower 27 bits of an uint32 which are used
+// to transport the rate
+const RateMask uint32 = 134217727
+
+// RateMaskV8 masks the lower 28 bits which are used for the rate in
+// format version 8. Version 8 has no closed flag.
+const RateMaskV8 uint32 = 268435455
+
+// ClosedFlag is the bit between rate and availability. If set,
+// the cell is closed for sale but keeps its rate, so it can be
+// opened again later. The flag exists since format version 9.
+const ClosedFlag uint32 = 134217728
 
 //AvailMask masks the lower 28 bits of an uint32
 const AvailMask uint32 = 4026531840
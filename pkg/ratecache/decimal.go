@@ -0,0 +1,148 @@
+package ratecache
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// maxScale is the maximum number of decimal places of a Decimal.
+const maxScale = 18
+
+// Decimal is an exact decimal number, i.e. Units / 10^Scale. Rates are
+// transported as Decimal so that they never pass through a binary
+// floating point representation, e.g. 31.02 is stored as Units 3102
+// and Scale 2.
+type Decimal struct {
+	Units int64
+	Scale uint8
+}
+
+// NewDecimal returns a Decimal from an unscaled value and the number of
+// decimal places, e.g. NewDecimal(3102, 2) is 31.02.
+func NewDecimal(units int64, scale uint8) Decimal {
+	return Decimal{Units: units, Scale: scale}
+}
+
+// ParseDecimal parses a decimal number such as "31.02", "-4", "2.5e1".
+func ParseDecimal(s string) (Decimal, error) {
+	var d Decimal
+	mantissa := s
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil || e > maxScale || e < -maxScale {
+			return d, errors.New("invalid decimal " + s)
+		}
+		mantissa = s[:i]
+		exp = e
+	}
+	negative := strings.HasPrefix(mantissa, "-")
+	mantissa = strings.TrimPrefix(strings.TrimPrefix(mantissa, "-"), "+")
+	parts := strings.Split(mantissa, ".")
+	if len(parts) > 2 || len(parts[0])+len(parts[len(parts)-1]) == 0 {
+		return d, errors.New("invalid decimal " + s)
+	}
+	digits := parts[0]
+	scale := 0
+	if len(parts) == 2 {
+		digits += parts[1]
+		scale = len(parts[1])
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return d, errors.New("invalid decimal " + s)
+		}
+	}
+	scale -= exp
+	for scale < 0 {
+		digits += "0"
+		scale++
+	}
+	// drop trailing zeros that exceed the maximum scale
+	for scale > maxScale && strings.HasSuffix(digits, "0") {
+		digits = digits[:len(digits)-1]
+		scale--
+	}
+	if scale > maxScale {
+		return d, errors.New("too many decimal places in " + s)
+	}
+	digits = strings.TrimLeft(digits, "0")
+	if len(digits) > 0 {
+		units, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return d, errors.New("decimal out of range " + s)
+		}
+		d.Units = units
+	}
+	if negative {
+		d.Units = -d.Units
+	}
+	d.Scale = uint8(scale)
+	return d, nil
+}
+
+// MinorUnits returns the value in minor units for a currency with
+// decimalPlaces digits, e.g. 31.02 is 3102 for 2 decimal places.
+// Values with more decimal places are rounded half away from zero.
+func (d Decimal) MinorUnits(decimalPlaces uint8) (int64, error) {
+	units := d.Units
+	for scale := d.Scale; scale < decimalPlaces; scale++ {
+		if units > 922337203685477580 || units < -922337203685477580 {
+			return 0, errors.New("decimal out of range")
+		}
+		units *= 10
+	}
+	if d.Scale > decimalPlaces {
+		divisor := int64(1)
+		for scale := decimalPlaces; scale < d.Scale; scale++ {
+			divisor *= 10
+		}
+		remainder := units % divisor
+		units /= divisor
+		if remainder*2 >= divisor {
+			units++
+		} else if remainder*2 <= -divisor {
+			units--
+		}
+	}
+	return units, nil
+}
+
+// String returns the decimal number with all its decimal places.
+func (d Decimal) String() string {
+	units := d.Units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	s := strconv.FormatInt(units, 10)
+	if d.Scale == 0 {
+		return sign + s
+	}
+	for len(s) <= int(d.Scale) {
+		s = "0" + s
+	}
+	return sign + s[:len(s)-int(d.Scale)] + "." + s[len(s)-int(d.Scale):]
+}
+
+// MarshalJSON returns the decimal as JSON number.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a string containing
+// a decimal number.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	if s == "null" {
+		return nil
+	}
+	dec, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = dec
+	return nil
+}
@@ -0,0 +1,68 @@
+package ratecache
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tests := map[string]Decimal{
+		"31.02":  {3102, 2},
+		"-4":     {-4, 0},
+		"2.5e1":  {25, 0},
+		"1e-3":   {1, 3},
+		"0.10":   {10, 2},
+		"250.00": {25000, 2},
+	}
+	for s, expected := range tests {
+		d, err := ParseDecimal(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if d != expected {
+			t.Errorf("Value: %v, expected: %v", d, expected)
+		}
+	}
+	for _, s := range []string{"", ".", "1.2.3", "abc", "1e"} {
+		_, err := ParseDecimal(s)
+		if err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestDecimalMinorUnits(t *testing.T) {
+	tests := []struct {
+		d        Decimal
+		places   uint8
+		expected int64
+	}{
+		{Decimal{3102, 2}, 2, 3102},
+		{Decimal{31, 0}, 2, 3100},
+		{Decimal{31025, 3}, 2, 3103},
+		{Decimal{31024, 3}, 2, 3102},
+		{Decimal{-31025, 3}, 2, -3103},
+		{Decimal{3102, 2}, 0, 31},
+	}
+	for _, test := range tests {
+		units, _ := test.d.MinorUnits(test.places)
+		if units != test.expected {
+			t.Errorf("Value: %v, expected: %v", units, test.expected)
+		}
+	}
+}
+
+func TestDecimalJSON(t *testing.T) {
+	var rates []Decimal
+	err := json.Unmarshal([]byte(`[31.02, "31.02", 5]`), &rates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates[0] != rates[1] || rates[0] != NewDecimal(3102, 2) {
+		t.Errorf("Value: %v, expected: 31.02", rates)
+	}
+	jsonStr, _ := json.Marshal([]Decimal{NewDecimal(5, 2), NewDecimal(-3102, 2), NewDecimal(7, 0)})
+	if string(jsonStr) != "[0.05,-31.02,7]" {
+		t.Errorf("Value: %s, expected: [0.05,-31.02,7]", jsonStr)
+	}
+}
@@ -0,0 +1,102 @@
+package ratecache
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// ExportRoomRates reads the rate block of an index entry and returns its
+// content as RoomRates which can be imported again. Consecutive check-in
+// dates with equal values are compressed into date ranges per length of
+// stay. Cells with unknown rate or availability (0) are left out. Closed
+// cells are exported with their rate and listed in Closed.
+func ExportRoomRates(r io.ReaderAt, fhdr *FileHeader, entry IdxEntry, DecimalPlaces uint8) (RoomRates, error) {
+	roomRates := RoomRates{AccoCode: entry.AccoCode, RoomRateCode: entry.RoomRateCode}
+	roomRates.Occupancy = append(roomRates.Occupancy, entry.RoomOccIdx.Occupancy...)
+	hdrSize := fhdr.GetBlockHeaderSize()
+	cells := make([]byte, fhdr.GetRateBlockSize()-hdrSize)
+	err := fhdr.ReadCellsAt(r, entry.RoomOccIdx.Idx, cells, fhdr.GetRateBlockStart(entry.RoomOccIdx.Idx)+int64(hdrSize))
+	if err != nil {
+		return roomRates, err
+	}
+	days := int(fhdr.Days)
+	for l := 0; l < int(fhdr.MaxLos); l++ {
+		los := uint8(l + 1)
+		var drr *DateRangeRate
+		var dra *DateRangeAvail
+		var dcl *DateRange
+		for d := 0; d < days; d++ {
+			pos := (l*days + d) * 4
+			rate, avail, closed := fhdr.UnpackCell(cells[pos : pos+4])
+			checkIn := JSONDate(fhdr.StartDate.AddDate(0, 0, d))
+			if !closed {
+				dcl = nil
+			} else if dcl != nil {
+				dcl.LastCheckIn = checkIn
+			} else {
+				roomRates.Closed = append(roomRates.Closed, DateRange{FirstCheckIn: checkIn, LastCheckIn: checkIn, LengthOfStay: los})
+				dcl = &roomRates.Closed[len(roomRates.Closed)-1]
+			}
+			if rate == 0 {
+				drr = nil
+			} else if drr != nil && drr.Rate.Units == int64(rate) {
+				drr.LastCheckIn = checkIn
+			} else {
+				roomRates.Rates = append(roomRates.Rates, DateRangeRate{FirstCheckIn: checkIn, LastCheckIn: checkIn, LengthOfStay: los, Rate: NewDecimal(int64(rate), DecimalPlaces)})
+				drr = &roomRates.Rates[len(roomRates.Rates)-1]
+			}
+			if avail == 0 {
+				dra = nil
+			} else if dra != nil && dra.Available == avail {
+				dra.LastCheckIn = checkIn
+			} else {
+				roomRates.Availabilities = append(roomRates.Availabilities, DateRangeAvail{FirstCheckIn: checkIn, LastCheckIn: checkIn, LengthOfStay: los, Available: avail})
+				dra = &roomRates.Availabilities[len(roomRates.Availabilities)-1]
+			}
+		}
+	}
+	return roomRates, nil
+}
+
+// WriteExport exports the rate blocks of entries and writes them as JSON
+// array to w or, if ndjson is true, as newline delimited JSON with one
+// RoomRates object per line.
+func WriteExport(w io.Writer, r io.ReaderAt, fhdr *FileHeader, entries []IdxEntry, DecimalPlaces uint8, ndjson bool) error {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].AccoCode != entries[j].AccoCode {
+			return entries[i].AccoCode < entries[j].AccoCode
+		}
+		if entries[i].RoomRateCode != entries[j].RoomRateCode {
+			return entries[i].RoomRateCode < entries[j].RoomRateCode
+		}
+		return entries[i].RoomOccIdx.Idx < entries[j].RoomOccIdx.Idx
+	})
+	if !ndjson {
+		w.Write([]byte("["))
+	}
+	for i, entry := range entries {
+		roomRates, err := ExportRoomRates(r, fhdr, entry, DecimalPlaces)
+		if err != nil {
+			return err
+		}
+		jsonStr, err := json.Marshal(roomRates)
+		if err != nil {
+			return err
+		}
+		if ndjson {
+			jsonStr = append(jsonStr, '\n')
+		} else if i > 0 {
+			w.Write([]byte(","))
+		}
+		_, err = w.Write(jsonStr)
+		if err != nil {
+			return err
+		}
+	}
+	if !ndjson {
+		_, err := w.Write([]byte("]"))
+		return err
+	}
+	return nil
+}
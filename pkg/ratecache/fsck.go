@@ -0,0 +1,248 @@
+package ratecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// CheckReport is the result of CheckCache.
+type CheckReport struct {
+	Header         *FileHeader
+	FileSize       int64
+	BlockCapacity  int64
+	IdxVersion     uint8
+	IdxRecordCount int64
+	Issues         []string
+}
+
+// OK tells whether no issues were found.
+func (report *CheckReport) OK() bool {
+	return len(report.Issues) == 0
+}
+
+func (report *CheckReport) addIssue(format string, a ...interface{}) {
+	report.Issues = append(report.Issues, fmt.Sprintf(format, a...))
+}
+
+// occupancyKey returns a key for a combination of accommodation code,
+// room rate code and occupancy that does not depend on the order of
+// the occupancy items.
+func occupancyKey(accoCode string, roomRateCode string, occupancy []OccupancyItem) string {
+	items := make([]string, len(occupancy))
+	for i, item := range occupancy {
+		items[i] = fmt.Sprintf("%d-%d:%d", item.MinAge, item.MaxAge, item.Count)
+	}
+	sort.Strings(items)
+	return fmt.Sprintf("%v/%v/%v", accoCode, roomRateCode, strings.Join(items, ","))
+}
+
+// CheckCache checks the cache file and the index file for consistency.
+// The file header must be readable and the file size must fit the
+// RateBlockCount. Every rate block header is compared with the index
+// records pointing to it. Index records pointing past RateBlockCount,
+// duplicate combinations of accommodation code, room rate code and
+// occupancy and rate blocks without index record are reported as issues.
+// Rate blocks removed by a tombstone record are not in use any more.
+// An error is only returned if the files cannot be read at all.
+func CheckCache(cacheFilename string, idxFilename string) (*CheckReport, error) {
+	report := &CheckReport{}
+	f, err := os.Open(cacheFilename)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+	statInfo, err := f.Stat()
+	if err != nil {
+		return report, err
+	}
+	report.FileSize = statInfo.Size()
+	if report.FileSize < FileHeaderSize {
+		return report, errors.New("Cache file is shorter than the file header")
+	}
+	buf := make([]byte, FileHeaderSize)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		return report, err
+	}
+	fhdr, err := FileHeaderFromByteStr(buf)
+	if err != nil {
+		return report, err
+	}
+	report.Header = fhdr
+	blockSize := int64(fhdr.GetRateBlockSize())
+	report.BlockCapacity = (report.FileSize - FileHeaderSize) / blockSize
+	if (report.FileSize-FileHeaderSize)%blockSize != 0 {
+		report.addIssue("Cache file size %d does not end at a rate block boundary", report.FileSize)
+	}
+	blockCount := fhdr.RateBlockCount
+	if report.BlockCapacity < int64(blockCount) {
+		report.addIssue("Cache file has room for %d rate blocks, but RateBlockCount is %d", report.BlockCapacity, blockCount)
+		blockCount = uint32(report.BlockCapacity)
+	}
+
+	// rate block headers
+	blocks := make([]IdxEntry, blockCount)
+	blockKeys := make(map[string]uint32)
+	hdrBuf := make([]byte, fhdr.GetBlockHeaderSize())
+	for i := uint32(0); i < blockCount; i++ {
+		_, err = f.ReadAt(hdrBuf, fhdr.GetRateBlockStart(i))
+		if err != nil {
+			return report, err
+		}
+		rbhdr, err := RateBlockHeaderFromByteStr(hdrBuf, fhdr.AccoCodeLength, fhdr.RoomRateCodeLength)
+		if err != nil {
+			report.addIssue("Rate block %d: %v", i, err)
+			continue
+		}
+		if rbhdr.accoCode == "" || rbhdr.roomRateCode == "" || len(rbhdr.occupancy) == 0 {
+			report.addIssue("Rate block %d has an empty header", i)
+			continue
+		}
+		entry := IdxEntry{AccoCode: rbhdr.accoCode, RoomRateCode: rbhdr.roomRateCode, RoomOccIdx: RoomOccIdx{Idx: i}}
+		for _, item := range rbhdr.occupancy {
+			entry.RoomOccIdx.AddOccItem(item.MinAge, item.MaxAge, item.Count)
+		}
+		blocks[i] = entry
+		key := occupancyKey(entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx.Occupancy)
+		if first, ok := blockKeys[key]; ok {
+			report.addIssue("Rate blocks %d and %d are duplicates of %v", first, i, key)
+		} else {
+			blockKeys[key] = i
+		}
+		if fhdr.HasSeqCounter() {
+			if binary.BigEndian.Uint32(hdrBuf[len(hdrBuf)-SeqCounterSize:])%2 == 1 {
+				report.addIssue("Rate block %d has an interrupted write", i)
+			}
+		}
+	}
+
+	// index records
+	idxFile, err := os.Open(idxFilename)
+	if err != nil {
+		return report, err
+	}
+	defer idxFile.Close()
+	statInfo, err = idxFile.Stat()
+	if err != nil {
+		return report, err
+	}
+	ihdr, err := ReadIdxFileHeader(idxFile)
+	if err != nil {
+		return report, err
+	}
+	err = ihdr.Check(fhdr)
+	if err != nil {
+		return report, err
+	}
+	report.IdxVersion = ihdr.Version
+	count, partial := ihdr.CountRecords(statInfo.Size())
+	if partial {
+		report.addIssue("Index file ends with an incomplete record")
+	}
+	report.IdxRecordCount = count
+	if count < int64(ihdr.RecordCount) {
+		report.addIssue("Index file has %d records, header expects %d", count, ihdr.RecordCount)
+	}
+	referenced := make([]int, blockCount)
+	// removed marks rate blocks deleted by a tombstone
+	removed := make([]bool, blockCount)
+	recordKeys := make(map[string]uint32)
+	recBuf := make([]byte, ihdr.RecordSize())
+	for i := int64(0); i < count; i++ {
+		_, err = idxFile.ReadAt(recBuf, ihdr.RecordPos(i))
+		if err != nil {
+			return report, err
+		}
+		rec, err := ihdr.RecordFromByteStr(recBuf)
+		if err != nil {
+			report.addIssue("Index record %d: %v", i, err)
+			continue
+		}
+		entry := rec.Entry
+		index := entry.RoomOccIdx.Idx
+		if index >= fhdr.RateBlockCount {
+			report.addIssue("Index record %d points to rate block %d past RateBlockCount %d", i, index, fhdr.RateBlockCount)
+			continue
+		}
+		if index >= blockCount {
+			report.addIssue("Index record %d points to rate block %d beyond the end of the cache file", i, index)
+			continue
+		}
+		key := occupancyKey(entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx.Occupancy)
+		if rec.Tombstone {
+			if referenced[index] == 0 {
+				report.addIssue("Index record %d removes rate block %d which has no index record", i, index)
+				continue
+			}
+			referenced[index]--
+			removed[index] = true
+			if recordKeys[key] == index {
+				delete(recordKeys, key)
+			}
+			continue
+		}
+		if other, ok := recordKeys[key]; ok && other != index {
+			report.addIssue("Index record %d for %v duplicates the entry for rate block %d", i, key, other)
+		} else {
+			recordKeys[key] = index
+		}
+		referenced[index]++
+		if referenced[index] == 2 {
+			report.addIssue("Rate block %d has more than one index record", index)
+		}
+		block := blocks[index]
+		if block.AccoCode == "" {
+			continue
+		}
+		if entry.AccoCode != block.AccoCode || entry.RoomRateCode != block.RoomRateCode || !cmpOccupancy(entry.RoomOccIdx.Occupancy, block.RoomOccIdx.Occupancy) {
+			report.addIssue("Index record %d (%v) does not match header of rate block %d (%v)", i, key, index, occupancyKey(block.AccoCode, block.RoomRateCode, block.RoomOccIdx.Occupancy))
+		}
+	}
+	for i, count := range referenced {
+		if count == 0 && !removed[i] {
+			report.addIssue("Rate block %d has no index record", i)
+		}
+	}
+	return report, nil
+}
+
+// RepairIndex rebuilds the index file from the rate block headers of the
+// cache file and resets write counters of interrupted writes. Rate blocks
+// removed by tombstones stay removed if the index file can be loaded. The
+// cache must not be in use. It returns the number of index entries written.
+func RepairIndex(cacheFilename string, idxFilename string) (int, error) {
+	f, err := os.OpenFile(cacheFilename, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, FileHeaderSize)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	fhdr, err := FileHeaderFromByteStr(buf)
+	if err != nil {
+		return 0, err
+	}
+	// tombstones are kept if the index file can still be loaded
+	var removed []uint32
+	loaded := NewCacheIndex()
+	if loaded.Load(fhdr, idxFilename) == nil {
+		removed = loaded.RemovedBlocks()
+	}
+	idx := NewCacheIndex()
+	err = idx.LoadFromCache(cacheFilename, removed)
+	if err != nil {
+		return 0, err
+	}
+	err = fhdr.ResetSeqCounters(f)
+	if err != nil {
+		return 0, err
+	}
+	return idx.GetEntryCount(), WriteIndexFile(idx, fhdr, idxFilename)
+}
@@ -0,0 +1,126 @@
+package ratecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCheckTestCache creates a cache file with three rate blocks and
+// an index file with records for the first two of them.
+func newCheckTestCache(t *testing.T) (string, string, string) {
+	dir, err := ioutil.TempDir("", "fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	filename, err := InitRateFile(fhdr, dir, "fsck.bin", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheFilename := filepath.Join(dir, filename)
+	idxFilename := cacheFilename + ".idx"
+	f, err := os.OpenFile(cacheFilename, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i, roomRateCode := range []string{"DBLSTDBRBAR", "SGLSTDBRBAR", "TWNSTDBRBAR"} {
+		rbhdr, _ := NewRateBlockHeader("ALC123", roomRateCode)
+		rbhdr.AddOccupancyItem(18, 100, 2)
+		index, err := AddRateBlockToFile(f, CreateRateBlock(fhdr, rbhdr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fhdr.RateBlockCount = index + 1
+		if i < 2 {
+			roomOccIdx := RoomOccIdx{Idx: index}
+			roomOccIdx.AddOccItem(18, 100, 2)
+			roomOccIdx.AppendToIdxFile(*fhdr, idxFilename, "ALC123", roomRateCode)
+		}
+	}
+	return dir, cacheFilename, idxFilename
+}
+
+func hasIssue(report *CheckReport, text string) bool {
+	for _, issue := range report.Issues {
+		if strings.Contains(issue, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckCache(t *testing.T) {
+	dir, cacheFilename, idxFilename := newCheckTestCache(t)
+	defer os.RemoveAll(dir)
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	roomOccIdx := RoomOccIdx{Idx: 7}
+	roomOccIdx.AddOccItem(18, 100, 2)
+	roomOccIdx.AppendToIdxFile(*fhdr, idxFilename, "ALC123", "QUASTDBRBAR")
+	roomOccIdx = RoomOccIdx{Idx: 0}
+	roomOccIdx.AddOccItem(18, 100, 1)
+	roomOccIdx.AppendToIdxFile(*fhdr, idxFilename, "ALC123", "DBLSTDBRBAR")
+	report, err := CheckCache(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Header.RateBlockCount != 3 || report.IdxRecordCount != 4 {
+		t.Errorf("Value: %v/%v, expected: 3/4", report.Header.RateBlockCount, report.IdxRecordCount)
+	}
+	for _, text := range []string{"past RateBlockCount", "more than one index record", "does not match header of rate block 0", "Rate block 2 has no index record"} {
+		if !hasIssue(report, text) {
+			t.Errorf("Expected issue %q, got %v", text, report.Issues)
+		}
+	}
+	count, err := RepairIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("Value: %v, expected: 3", count)
+	}
+	report, err = CheckCache(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("Expected no issues after repair, got %v", report.Issues)
+	}
+}
+
+func TestCheckCacheTruncated(t *testing.T) {
+	dir, cacheFilename, idxFilename := newCheckTestCache(t)
+	defer os.RemoveAll(dir)
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	os.Truncate(cacheFilename, fhdr.GetRateBlockStart(2)+10)
+	report, err := CheckCache(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasIssue(report, "room for 2 rate blocks") || !hasIssue(report, "rate block boundary") {
+		t.Errorf("Expected size issues, got %v", report.Issues)
+	}
+	_, err = RepairIndex(cacheFilename, idxFilename)
+	if err == nil {
+		t.Error("Expected repair of truncated cache file to fail")
+	}
+}
+
+func TestRateBlockHeaderFromByteStrRoomRateCode(t *testing.T) {
+	rbhdr, _ := NewRateBlockHeader("ALC123", "DBLSTDBRBAR")
+	rbhdr.AddOccupancyItem(18, 100, 2)
+	rbhdr2, err := RateBlockHeaderFromByteStr(rbhdr.ToByteStr(32, 64), 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rbhdr2.roomRateCode != "DBLSTDBRBAR" {
+		t.Errorf("Value: %v, expected: DBLSTDBRBAR", rbhdr2.roomRateCode)
+	}
+	if len(rbhdr2.occupancy) != 1 || rbhdr2.occupancy[0].Count != 2 {
+		t.Errorf("Expected one occupancy item with count 2")
+	}
+}
@@ -0,0 +1,255 @@
+package ratecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// IdxSignature is the signature string for index files
+const IdxSignature = "LOSINDEX"
+
+// IdxVersion is the format version of the index file. Index files
+// without header, written before there was a version, have version 0.
+const IdxVersion = 1
+
+// IdxFileHeaderSize is the size of the index file header in bytes
+const IdxFileHeaderSize = 32
+
+// IdxRecTrailerSize is the size of the record type and the checksum
+// that follow the index record body since index file version 1.
+const IdxRecTrailerSize = 5
+
+// Types of index records
+const (
+	// IdxRecordEntry adds an entry to the index.
+	IdxRecordEntry = 1
+	// IdxRecordTombstone removes the entry for the same rate block
+	// that was added by an earlier record.
+	IdxRecordTombstone = 2
+)
+
+// IdxFileHeader is the header of an index file. It ties the index
+// file to its cache file.
+// Header format is:
+// - Signature (8 bytes)
+// - Version (1 byte)
+// - AccoCodeLength, RoomRateCodeLength (1 byte each), 1 byte reserved
+// - CacheID (uint32)
+// - RecordCount (uint32)
+// - 8 bytes reserved
+// - Checksum of the bytes before (crc32)
+type IdxFileHeader struct {
+	Version            uint8
+	AccoCodeLength     uint8
+	RoomRateCodeLength uint8
+	CacheID            uint32
+	RecordCount        uint32
+}
+
+// IdxRecord is one record of the index file. A tombstone removes the
+// entry of the rate block in Entry.RoomOccIdx.Idx from the index.
+type IdxRecord struct {
+	Entry     IdxEntry
+	Tombstone bool
+}
+
+// CacheID identifies a cache file by its file header without the rate
+// block count, which changes when blocks are added.
+func CacheID(fhdr *FileHeader) uint32 {
+	return crc32.ChecksumIEEE(fhdr.ToByteStr()[:FileHeaderSize-4])
+}
+
+// NewIdxFileHeader returns the header of a new index file for the
+// cache file with header fhdr.
+func NewIdxFileHeader(fhdr *FileHeader) IdxFileHeader {
+	return IdxFileHeader{Version: IdxVersion, AccoCodeLength: fhdr.AccoCodeLength, RoomRateCodeLength: fhdr.RoomRateCodeLength, CacheID: CacheID(fhdr)}
+}
+
+// ToByteStr creates an index file header as byte string from object.
+func (ihdr *IdxFileHeader) ToByteStr() []byte {
+	byteStr := make([]byte, IdxFileHeaderSize)
+	copy(byteStr, IdxSignature)
+	byteStr[8] = ihdr.Version
+	byteStr[9] = ihdr.AccoCodeLength
+	byteStr[10] = ihdr.RoomRateCodeLength
+	binary.BigEndian.PutUint32(byteStr[12:16], ihdr.CacheID)
+	binary.BigEndian.PutUint32(byteStr[16:20], ihdr.RecordCount)
+	binary.BigEndian.PutUint32(byteStr[28:32], crc32.ChecksumIEEE(byteStr[:28]))
+	return byteStr
+}
+
+// ReadIdxFileHeader reads the header of an index file. Index files
+// without signature are legacy files with version 0; code lengths
+// and cache ID are unknown for these.
+func ReadIdxFileHeader(f io.ReaderAt) (IdxFileHeader, error) {
+	ihdr := IdxFileHeader{}
+	byteStr := make([]byte, IdxFileHeaderSize)
+	n, err := f.ReadAt(byteStr, 0)
+	if n < len(IdxSignature) || string(byteStr[:len(IdxSignature)]) != IdxSignature {
+		return ihdr, nil
+	}
+	if n < IdxFileHeaderSize {
+		return ihdr, err
+	}
+	if binary.BigEndian.Uint32(byteStr[28:32]) != crc32.ChecksumIEEE(byteStr[:28]) {
+		return ihdr, errors.New("Index file header checksum mismatch")
+	}
+	if byteStr[8] != IdxVersion {
+		return ihdr, fmt.Errorf("Wrong index file version. expected version is %d, got %d", IdxVersion, byteStr[8])
+	}
+	ihdr.Version = byteStr[8]
+	ihdr.AccoCodeLength = byteStr[9]
+	ihdr.RoomRateCodeLength = byteStr[10]
+	ihdr.CacheID = binary.BigEndian.Uint32(byteStr[12:16])
+	ihdr.RecordCount = binary.BigEndian.Uint32(byteStr[16:20])
+	return ihdr, nil
+}
+
+// IsLegacy tells whether the index file has no header.
+func (ihdr *IdxFileHeader) IsLegacy() bool {
+	return ihdr.Version == 0
+}
+
+// Check checks that the index file belongs to the cache file with
+// header fhdr. Legacy index files take the code lengths from fhdr.
+func (ihdr *IdxFileHeader) Check(fhdr *FileHeader) error {
+	if ihdr.IsLegacy() {
+		ihdr.AccoCodeLength = fhdr.AccoCodeLength
+		ihdr.RoomRateCodeLength = fhdr.RoomRateCodeLength
+		return nil
+	}
+	if ihdr.AccoCodeLength != fhdr.AccoCodeLength || ihdr.RoomRateCodeLength != fhdr.RoomRateCodeLength {
+		return errors.New("Code lengths of index file and cache file differ")
+	}
+	if ihdr.CacheID != CacheID(fhdr) {
+		return errors.New("Index file belongs to another cache file")
+	}
+	return nil
+}
+
+// HeaderSize returns the size of the index file header.
+func (ihdr *IdxFileHeader) HeaderSize() int64 {
+	if ihdr.IsLegacy() {
+		return 0
+	}
+	return IdxFileHeaderSize
+}
+
+// RecordSize returns the size of one index record.
+func (ihdr *IdxFileHeader) RecordSize() int64 {
+	recordSize := int64(ihdr.AccoCodeLength) + int64(ihdr.RoomRateCodeLength) + FixIdxRecSize
+	if !ihdr.IsLegacy() {
+		recordSize += IdxRecTrailerSize
+	}
+	return recordSize
+}
+
+// RecordPos returns the position of record i in the index file.
+func (ihdr *IdxFileHeader) RecordPos(i int64) int64 {
+	return ihdr.HeaderSize() + i*ihdr.RecordSize()
+}
+
+// CountRecords returns the number of complete records in an index
+// file of size bytes and whether there are bytes left over.
+func (ihdr *IdxFileHeader) CountRecords(size int64) (int64, bool) {
+	if size < ihdr.HeaderSize() {
+		return 0, true
+	}
+	return (size - ihdr.HeaderSize()) / ihdr.RecordSize(), (size-ihdr.HeaderSize())%ihdr.RecordSize() != 0
+}
+
+// RecordToByteStr creates an index record as byte string. Legacy
+// index files cannot contain tombstones.
+func (ihdr *IdxFileHeader) RecordToByteStr(rec IdxRecord) ([]byte, error) {
+	offset := int(ihdr.AccoCodeLength) + int(ihdr.RoomRateCodeLength)
+	byteStr := make([]byte, ihdr.RecordSize())
+	copy(byteStr[:ihdr.AccoCodeLength], rec.Entry.AccoCode)
+	copy(byteStr[ihdr.AccoCodeLength:offset], rec.Entry.RoomRateCode)
+	copy(byteStr[offset:], *rec.Entry.RoomOccIdx.ToByteStr())
+	if ihdr.IsLegacy() {
+		if rec.Tombstone {
+			return nil, errors.New("Legacy index files cannot contain tombstones")
+		}
+		return byteStr, nil
+	}
+	recType := offset + FixIdxRecSize
+	byteStr[recType] = IdxRecordEntry
+	if rec.Tombstone {
+		byteStr[recType] = IdxRecordTombstone
+	}
+	binary.BigEndian.PutUint32(byteStr[recType+1:], crc32.ChecksumIEEE(byteStr[:recType+1]))
+	return byteStr, nil
+}
+
+// RecordFromByteStr parses an index record and checks its checksum.
+func (ihdr *IdxFileHeader) RecordFromByteStr(byteStr []byte) (IdxRecord, error) {
+	rec := IdxRecord{}
+	if int64(len(byteStr)) < ihdr.RecordSize() {
+		return rec, errors.New("Index record is incomplete")
+	}
+	if !ihdr.IsLegacy() {
+		recType := int(ihdr.AccoCodeLength) + int(ihdr.RoomRateCodeLength) + FixIdxRecSize
+		if binary.BigEndian.Uint32(byteStr[recType+1:recType+5]) != crc32.ChecksumIEEE(byteStr[:recType+1]) {
+			return rec, errors.New("Index record checksum mismatch")
+		}
+		switch byteStr[recType] {
+		case IdxRecordEntry:
+		case IdxRecordTombstone:
+			rec.Tombstone = true
+		default:
+			return rec, fmt.Errorf("Unknown index record type %d", byteStr[recType])
+		}
+	}
+	rec.Entry = IdxEntryFromIdxRecord(byteStr, ihdr.AccoCodeLength, ihdr.RoomRateCodeLength)
+	return rec, nil
+}
+
+// AppendIdxRecord appends a record to the index file of the cache file
+// with header fhdr and updates the record count in the index file
+// header. A new index file is created if it does not exist yet.
+func AppendIdxRecord(fhdr *FileHeader, filename string, rec IdxRecord) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	statInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var ihdr IdxFileHeader
+	if statInfo.Size() == 0 {
+		ihdr = NewIdxFileHeader(fhdr)
+	} else {
+		ihdr, err = ReadIdxFileHeader(f)
+		if err != nil {
+			return err
+		}
+	}
+	err = ihdr.Check(fhdr)
+	if err != nil {
+		return err
+	}
+	count, partial := ihdr.CountRecords(statInfo.Size())
+	if partial && statInfo.Size() > 0 {
+		return errors.New("Index file ends with an incomplete record")
+	}
+	byteStr, err := ihdr.RecordToByteStr(rec)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(byteStr, ihdr.RecordPos(count))
+	if err != nil {
+		return err
+	}
+	if ihdr.IsLegacy() {
+		return nil
+	}
+	ihdr.RecordCount = uint32(count + 1)
+	_, err = f.WriteAt(ihdr.ToByteStr(), 0)
+	return err
+}
@@ -0,0 +1,145 @@
+package ratecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newIdxTestEntry(roomRateCode string, index uint32) IdxEntry {
+	roomOccIdx := RoomOccIdx{Idx: index}
+	roomOccIdx.AddOccItem(18, 100, 2)
+	return IdxEntry{AccoCode: "ALC123", RoomRateCode: roomRateCode, RoomOccIdx: roomOccIdx}
+}
+
+func TestIdxFileHeader(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	ihdr := NewIdxFileHeader(fhdr)
+	ihdr.RecordCount = 3
+	byteStr := ihdr.ToByteStr()
+	if len(byteStr) != IdxFileHeaderSize {
+		t.Errorf("Value: %v, expected: %v", len(byteStr), IdxFileHeaderSize)
+	}
+	dir, err := ioutil.TempDir("", "idxfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.idx")
+	ioutil.WriteFile(filename, byteStr, 0644)
+	f, _ := os.Open(filename)
+	ihdr2, err := ReadIdxFileHeader(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ihdr2 != ihdr {
+		t.Errorf("Value: %v, expected: %v", ihdr2, ihdr)
+	}
+	fhdr.RateBlockCount = 10
+	if ihdr2.Check(fhdr) != nil {
+		t.Error("Rate block count must not change the cache ID")
+	}
+	fhdr2, _ := NewFileHeader("TEST", time.Date(2022, time.November, 26, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	if ihdr2.Check(fhdr2) == nil {
+		t.Error("Expected error for index file of another cache file")
+	}
+	byteStr[17]++
+	ioutil.WriteFile(filename, byteStr, 0644)
+	f, _ = os.Open(filename)
+	_, err = ReadIdxFileHeader(f)
+	f.Close()
+	if err == nil {
+		t.Error("Expected checksum error for modified header")
+	}
+}
+
+func TestIdxRecordChecksum(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	ihdr := NewIdxFileHeader(fhdr)
+	byteStr, err := ihdr.RecordToByteStr(IdxRecord{Entry: newIdxTestEntry("DBLSTDBRBAR", 4), Tombstone: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(byteStr)) != 32+64+FixIdxRecSize+IdxRecTrailerSize {
+		t.Errorf("Value: %v, expected: %v", len(byteStr), 32+64+FixIdxRecSize+IdxRecTrailerSize)
+	}
+	rec, err := ihdr.RecordFromByteStr(byteStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Tombstone || rec.Entry.RoomRateCode != "DBLSTDBRBAR" || rec.Entry.RoomOccIdx.Idx != 4 {
+		t.Errorf("Unexpected record %v", rec)
+	}
+	byteStr[40] = 'X'
+	_, err = ihdr.RecordFromByteStr(byteStr)
+	if err == nil {
+		t.Error("Expected checksum error for modified record")
+	}
+}
+
+func TestLoadTombstone(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	dir, err := ioutil.TempDir("", "idxfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.idx")
+	AppendIdxRecord(fhdr, filename, IdxRecord{Entry: newIdxTestEntry("DBLSTDBRBAR", 0)})
+	AppendIdxRecord(fhdr, filename, IdxRecord{Entry: newIdxTestEntry("SGLSTDBRBAR", 1)})
+	AppendIdxRecord(fhdr, filename, IdxRecord{Entry: newIdxTestEntry("DBLSTDBRBAR", 0), Tombstone: true})
+	idx := NewCacheIndex()
+	err = idx.Load(fhdr, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.GetEntryCount() != 1 || idx.GetRecordCount() != 3 {
+		t.Errorf("Value: %v/%v, expected: 1/3", idx.GetEntryCount(), idx.GetRecordCount())
+	}
+	if len(idx.Select("ALC123", "DBLSTDBRBAR", "")) > 0 {
+		t.Error("Entry removed by tombstone is still in the index")
+	}
+	f, _ := os.Open(filename)
+	ihdr, _ := ReadIdxFileHeader(f)
+	f.Close()
+	if ihdr.RecordCount != 3 {
+		t.Errorf("Value: %v, expected: 3", ihdr.RecordCount)
+	}
+}
+
+func TestLoadLegacy(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	dir, err := ioutil.TempDir("", "idxfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.idx")
+	legacy := IdxFileHeader{AccoCodeLength: 32, RoomRateCodeLength: 64}
+	var buf []byte
+	for i, roomRateCode := range []string{"DBLSTDBRBAR", "SGLSTDBRBAR"} {
+		byteStr, _ := legacy.RecordToByteStr(IdxRecord{Entry: newIdxTestEntry(roomRateCode, uint32(i))})
+		buf = append(buf, byteStr...)
+	}
+	ioutil.WriteFile(filename, buf, 0644)
+	idx := NewCacheIndex()
+	err = idx.Load(fhdr, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.IsLegacyFile() || idx.GetEntryCount() != 2 {
+		t.Errorf("Expected 2 entries from legacy index file, got %v", idx.GetEntryCount())
+	}
+	err = AppendIdxRecord(fhdr, filename, IdxRecord{Entry: newIdxTestEntry("TWNSTDBRBAR", 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx = NewCacheIndex()
+	idx.Load(fhdr, filename)
+	if idx.GetEntryCount() != 3 {
+		t.Errorf("Value: %v, expected: 3", idx.GetEntryCount())
+	}
+}
@@ -0,0 +1,254 @@
+package ratecache
+
+import (
+	"sort"
+	"sync"
+)
+
+// occupancy is one distinct occupancy of the occupancy dictionary.
+type occupancy struct {
+	items []OccupancyItem
+	total uint8
+}
+
+// occupancyDictKey returns the dictionary key of an occupancy.
+func occupancyDictKey(items []OccupancyItem) string {
+	key := make([]byte, 0, 3*len(items))
+	for _, item := range items {
+		key = append(key, item.MinAge, item.MaxAge, item.Count)
+	}
+	return string(key)
+}
+
+// compactEntry is one entry of a shard. Codes and occupancy are ids of
+// the dictionaries of the shard, so entries contain no pointers and the
+// garbage collector does not need to scan them.
+type compactEntry struct {
+	acco uint32
+	room uint32
+	occ  uint32
+	idx  uint32
+}
+
+// idxShard contains the entries of the accommodations of one shard of
+// the cache index in a flat slice, protected by a mutex. Entries are
+// sorted by the ids of accommodation and room rate code, entries of the
+// same room rate are in the order they were added. Every code and
+// every occupancy is stored once in the dictionaries of the shard,
+// which only grow.
+type idxShard struct {
+	entries []compactEntry
+	codes   []string
+	codeIds map[string]uint32
+	occs    []occupancy
+	occIds  map[string]uint32
+	// accoCount is the number of distinct accommodations in entries
+	accoCount int
+	sync.RWMutex
+}
+
+// intern returns the id of code and adds it to the dictionary if
+// necessary. The caller must hold the write lock.
+func (shard *idxShard) intern(code string) uint32 {
+	if id, ok := shard.codeIds[code]; ok {
+		return id
+	}
+	if shard.codeIds == nil {
+		shard.codeIds = make(map[string]uint32)
+	}
+	id := uint32(len(shard.codes))
+	shard.codeIds[code] = id
+	shard.codes = append(shard.codes, code)
+	return id
+}
+
+// internOccupancy returns the id of the occupancy of roomOccIdx and
+// adds it to the dictionary if necessary. The caller must hold the
+// write lock.
+func (shard *idxShard) internOccupancy(roomOccIdx RoomOccIdx) uint32 {
+	key := occupancyDictKey(roomOccIdx.Occupancy)
+	if id, ok := shard.occIds[key]; ok {
+		return id
+	}
+	if shard.occIds == nil {
+		shard.occIds = make(map[string]uint32)
+	}
+	items := make([]OccupancyItem, len(roomOccIdx.Occupancy))
+	copy(items, roomOccIdx.Occupancy)
+	id := uint32(len(shard.occs))
+	shard.occIds[key] = id
+	shard.occs = append(shard.occs, occupancy{items: items, total: roomOccIdx.Total})
+	return id
+}
+
+// newEntry returns the compact entry for an index entry, adding codes
+// and occupancy to the dictionaries. The caller must hold the write lock.
+func (shard *idxShard) newEntry(accoCode string, roomRateCode string, roomOccIdx RoomOccIdx) compactEntry {
+	return compactEntry{
+		acco: shard.intern(accoCode),
+		room: shard.intern(roomRateCode),
+		occ:  shard.internOccupancy(roomOccIdx),
+		idx:  roomOccIdx.Idx,
+	}
+}
+
+// roomOccIdx returns the RoomOccIdx of entry. The occupancy items are
+// shared with the dictionary and must not be changed.
+func (shard *idxShard) roomOccIdx(entry compactEntry) RoomOccIdx {
+	items := shard.occs[entry.occ].items
+	return RoomOccIdx{Occupancy: items[:len(items):len(items)], Total: shard.occs[entry.occ].total, Idx: entry.idx}
+}
+
+// accoRange returns the range of entries of accoCode.
+func (shard *idxShard) accoRange(accoCode string) (int, int) {
+	acco, ok := shard.codeIds[accoCode]
+	if !ok {
+		return 0, 0
+	}
+	entries := shard.entries
+	lo := sort.Search(len(entries), func(i int) bool { return entries[i].acco >= acco })
+	hi := lo + sort.Search(len(entries)-lo, func(i int) bool { return entries[lo+i].acco > acco })
+	return lo, hi
+}
+
+// roomRange returns the range of entries of roomRateCode within the
+// range lo to hi of one accommodation.
+func (shard *idxShard) roomRange(lo int, hi int, roomRateCode string) (int, int) {
+	room, ok := shard.codeIds[roomRateCode]
+	if !ok {
+		return lo, lo
+	}
+	return shard.roomIdRange(lo, hi, room)
+}
+
+func (shard *idxShard) roomIdRange(lo int, hi int, room uint32) (int, int) {
+	entries := shard.entries[lo:hi]
+	first := sort.Search(len(entries), func(i int) bool { return entries[i].room >= room })
+	last := first + sort.Search(len(entries)-first, func(i int) bool { return entries[first+i].room > room })
+	return lo + first, lo + last
+}
+
+// less tells whether entry a is sorted before entry b.
+func (a compactEntry) less(b compactEntry) bool {
+	if a.acco != b.acco {
+		return a.acco < b.acco
+	}
+	return a.room < b.room
+}
+
+// insert adds entry after the existing entries of its room rate.
+func (shard *idxShard) insert(entry compactEntry) {
+	entries := shard.entries
+	pos := sort.Search(len(entries), func(i int) bool { return entry.less(entries[i]) })
+	if (pos == 0 || entries[pos-1].acco != entry.acco) && (pos == len(entries) || entries[pos].acco != entry.acco) {
+		shard.accoCount++
+	}
+	shard.entries = append(shard.entries, compactEntry{})
+	copy(shard.entries[pos+1:], shard.entries[pos:])
+	shard.entries[pos] = entry
+}
+
+// remove removes the entry at pos.
+func (shard *idxShard) remove(pos int) {
+	acco := shard.entries[pos].acco
+	shard.entries = append(shard.entries[:pos], shard.entries[pos+1:]...)
+	if (pos == 0 || shard.entries[pos-1].acco != acco) && (pos == len(shard.entries) || shard.entries[pos].acco != acco) {
+		shard.accoCount--
+	}
+}
+
+// sortEntries restores the order of entries after unsorted appends
+// and counts the accommodations again.
+func (shard *idxShard) sortEntries() {
+	entries := shard.entries
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+	shard.accoCount = 0
+	for i := range entries {
+		if i == 0 || entries[i].acco != entries[i-1].acco {
+			shard.accoCount++
+		}
+	}
+}
+
+// bulkLoader adds entries to an index whose shards are all locked,
+// without keeping the shards sorted on every add. This is much faster
+// when loading big index files. done sorts the shards and releases
+// the locks.
+type bulkLoader struct {
+	idx *CacheIndex
+}
+
+func (idx *CacheIndex) beginBulk() *bulkLoader {
+	for i := range idx.shards {
+		idx.shards[i].Lock()
+	}
+	return &bulkLoader{idx: idx}
+}
+
+func (loader *bulkLoader) add(entry IdxEntry) {
+	shard := loader.idx.shard(entry.AccoCode)
+	shard.entries = append(shard.entries, shard.newEntry(entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx))
+}
+
+// remove removes the first entry of the rate block index added for
+// the room rate, like RemoveRoomOccIdx. It returns false if there is
+// no such entry.
+func (loader *bulkLoader) remove(accoCode string, roomRateCode string, index uint32) bool {
+	shard := loader.idx.shard(accoCode)
+	acco, ok := shard.codeIds[accoCode]
+	if !ok {
+		return false
+	}
+	room, ok := shard.codeIds[roomRateCode]
+	if !ok {
+		return false
+	}
+	for i, entry := range shard.entries {
+		if entry.acco == acco && entry.room == room && entry.idx == index {
+			shard.entries = append(shard.entries[:i], shard.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (loader *bulkLoader) done() {
+	for i := range loader.idx.shards {
+		loader.idx.shards[i].sortEntries()
+		loader.idx.shards[i].Unlock()
+	}
+}
+
+// IndexMemoryStats is an estimate of the memory used by a CacheIndex.
+type IndexMemoryStats struct {
+	Entries     int   `json:"entries"`
+	Codes       int   `json:"codes"`
+	Occupancies int   `json:"occupancies"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// mapEntryOverhead is the estimated size of one entry of the maps of
+// the dictionaries in addition to key and value.
+const mapEntryOverhead = 16
+
+// MemoryStats returns an estimate of the memory used by the index.
+func (idx *CacheIndex) MemoryStats() IndexMemoryStats {
+	stats := IndexMemoryStats{}
+	for i := range idx.shards {
+		shard := &idx.shards[i]
+		shard.RLock()
+		stats.Entries += len(shard.entries)
+		stats.Codes += len(shard.codes)
+		stats.Occupancies += len(shard.occs)
+		stats.Bytes += int64(cap(shard.entries)) * 16
+		for _, code := range shard.codes {
+			// string in the slice and as map key sharing the bytes, id
+			stats.Bytes += int64(len(code)) + 2*16 + 4 + mapEntryOverhead
+		}
+		for _, occ := range shard.occs {
+			stats.Bytes += int64(2*3*len(occ.items)) + 32 + 16 + 4 + mapEntryOverhead
+		}
+		shard.RUnlock()
+	}
+	return stats
+}
@@ -0,0 +1,301 @@
+package ratecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JournalSignature is the signature string for journal files
+const JournalSignature = "LOSJRNAL"
+
+// JournalHeaderSize is the size of the journal file header, i.e.
+// signature and journal id. The first record starts right after it.
+const JournalHeaderSize = 24
+
+// JournalRecHdrSize is the size of the record header: record
+// length (4), type (1), index (4) and position (8).
+const JournalRecHdrSize = 17
+
+// Journal record types
+const (
+	// JournalInit creates a new cache file. Data is the file header,
+	// Index the number of empty blocks initially allocated.
+	JournalInit = 1
+	// JournalBlock adds a rate block. Data is the rate block header,
+	// Index the index of the new block.
+	JournalBlock = 2
+	// JournalCells writes the cells in Data at position Pos.
+	JournalCells = 3
+	// JournalTags applies the list of TagUpdate in Data, encoded as json.
+	JournalTags = 4
+	// JournalRemove removes the rate block Index from the index.
+	JournalRemove = 5
+)
+
+// JournalRecord is one change of a cache file. Offset is the position
+// of the record in the journal and is only set when reading records.
+type JournalRecord struct {
+	Offset int64  `json:"offset"`
+	Type   uint8  `json:"type"`
+	Index  uint32 `json:"index"`
+	Pos    int64  `json:"pos"`
+	Data   []byte `json:"data"`
+}
+
+// ToByteStr returns the record as written to the journal file.
+func (rec *JournalRecord) ToByteStr() []byte {
+	buf := make([]byte, JournalRecHdrSize+len(rec.Data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)))
+	buf[4] = rec.Type
+	binary.BigEndian.PutUint32(buf[5:9], rec.Index)
+	binary.BigEndian.PutUint64(buf[9:17], uint64(rec.Pos))
+	copy(buf[JournalRecHdrSize:], rec.Data)
+	return buf
+}
+
+// ErrJournalChanged is returned by Journal.Read if the journal was
+// created anew since the reader got its journal id.
+var ErrJournalChanged = errors.New("Journal has changed")
+
+// ErrJournalBroken is returned by Journal.Read after a record could not
+// be appended. The journal no longer matches the cache file until it
+// is reset.
+var ErrJournalBroken = errors.New("Journal is broken")
+
+// Journal is an append-only file with all changes of a cache file in
+// the order they were made. Replaying the journal from the first record
+// rebuilds the cache file. Records are addressed by their offset in the
+// journal file, so readers can resume where they stopped. The ID changes
+// whenever the journal is created anew.
+type Journal struct {
+	id      string
+	f       *os.File
+	size    int64
+	offsets []int64
+	broken  bool
+	changed chan struct{}
+	mu      sync.Mutex
+	// resetting is held for writing by Reset and for reading by Read,
+	// so no records are read while the file is truncated.
+	resetting sync.RWMutex
+}
+
+// newJournalID returns a journal id based on the current time.
+func newJournalID() string {
+	return fmt.Sprintf("%016x", time.Now().UnixNano())
+}
+
+// OpenJournal opens a journal file or creates a new one if it does not
+// exist. An incomplete record at the end of the file, e.g. after a crash,
+// is removed.
+func OpenJournal(filename string) (*Journal, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := Journal{f: f, changed: make(chan struct{})}
+	statInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if statInfo.Size() == 0 {
+		err = j.writeHeader(newJournalID())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &j, nil
+	}
+	buf := make([]byte, JournalHeaderSize)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil || string(buf[:8]) != JournalSignature {
+		f.Close()
+		return nil, errors.New("File is not a journal file")
+	}
+	j.id = string(buf[8:])
+	// find the end of the last complete record
+	j.size = JournalHeaderSize
+	lenBuf := make([]byte, 4)
+	for j.size+JournalRecHdrSize <= statInfo.Size() {
+		f.ReadAt(lenBuf, j.size)
+		recLen := int64(binary.BigEndian.Uint32(lenBuf))
+		if recLen < JournalRecHdrSize || j.size+recLen > statInfo.Size() {
+			break
+		}
+		j.offsets = append(j.offsets, j.size)
+		j.size += recLen
+	}
+	if j.size != statInfo.Size() {
+		err = f.Truncate(j.size)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &j, nil
+}
+
+// writeHeader truncates the journal file and writes the header with id.
+func (j *Journal) writeHeader(id string) error {
+	err := j.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, JournalHeaderSize)
+	copy(buf, JournalSignature)
+	copy(buf[8:], id)
+	_, err = j.f.WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	j.id = id
+	j.size = JournalHeaderSize
+	j.offsets = nil
+	j.broken = false
+	return nil
+}
+
+// ID returns the id of the journal.
+func (j *Journal) ID() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.id
+}
+
+// Size returns the size of the journal, which is the
+// offset of the next record.
+func (j *Journal) Size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.size
+}
+
+// Append appends a record to the journal and wakes up all readers
+// waiting for new records. If the record cannot be written, the journal
+// is broken until it is reset.
+func (j *Journal) Append(rec JournalRecord) error {
+	buf := rec.ToByteStr()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.broken {
+		return ErrJournalBroken
+	}
+	_, err := j.f.WriteAt(buf, j.size)
+	if err != nil {
+		j.broken = true
+		return err
+	}
+	j.offsets = append(j.offsets, j.size)
+	j.size += int64(len(buf))
+	j.wakeUp()
+	return nil
+}
+
+// wakeUp wakes up all readers waiting for changes. The caller holds mu.
+func (j *Journal) wakeUp() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Reset removes all records and gives the journal a new id, so that
+// readers start again from the beginning.
+func (j *Journal) Reset() error {
+	j.resetting.Lock()
+	defer j.resetting.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.writeHeader(newJournalID())
+	if err != nil {
+		j.broken = true
+		return err
+	}
+	j.wakeUp()
+	return nil
+}
+
+// Wait blocks until there are records after offset or the
+// timeout has passed. It returns true if there are records.
+func (j *Journal) Wait(offset int64, timeout time.Duration) bool {
+	j.mu.Lock()
+	size := j.size
+	changed := j.changed
+	j.mu.Unlock()
+	if size > offset {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Read returns the records starting at offset and the offset of the
+// next record. Reading stops after maxBytes, but at least one record
+// is returned if there is one. The offset must be the start of a record
+// or the end of the journal. If id is set, ErrJournalChanged is returned
+// if it is not the id of the journal.
+func (j *Journal) Read(id string, offset int64, maxBytes int) ([]JournalRecord, int64, error) {
+	var records []JournalRecord
+	if offset < JournalHeaderSize {
+		offset = JournalHeaderSize
+	}
+	j.resetting.RLock()
+	defer j.resetting.RUnlock()
+	j.mu.Lock()
+	size, broken := j.size, j.broken
+	changed := len(id) > 0 && id != j.id
+	i := sort.Search(len(j.offsets), func(i int) bool { return j.offsets[i] >= offset })
+	aligned := offset == size || (i < len(j.offsets) && j.offsets[i] == offset)
+	j.mu.Unlock()
+	if changed {
+		return records, offset, ErrJournalChanged
+	}
+	if broken {
+		return records, offset, ErrJournalBroken
+	}
+	if offset > size {
+		return records, offset, errors.New("Offset beyond end of journal")
+	}
+	if !aligned {
+		return records, offset, errors.New("Offset is not the start of a record")
+	}
+	read := 0
+	hdrBuf := make([]byte, JournalRecHdrSize)
+	for offset < size && (read == 0 || read < maxBytes) {
+		_, err := j.f.ReadAt(hdrBuf, offset)
+		if err != nil {
+			return records, offset, err
+		}
+		recLen := int(binary.BigEndian.Uint32(hdrBuf[0:4]))
+		if recLen < JournalRecHdrSize || offset+int64(recLen) > size {
+			return records, offset, errors.New("Invalid record length. Journal may be corrupt")
+		}
+		rec := JournalRecord{Offset: offset, Type: hdrBuf[4]}
+		rec.Index = binary.BigEndian.Uint32(hdrBuf[5:9])
+		rec.Pos = int64(binary.BigEndian.Uint64(hdrBuf[9:17]))
+		rec.Data = make([]byte, recLen-JournalRecHdrSize)
+		_, err = j.f.ReadAt(rec.Data, offset+JournalRecHdrSize)
+		if err != nil {
+			return records, offset, err
+		}
+		records = append(records, rec)
+		offset += int64(recLen)
+		read += recLen
+	}
+	return records, offset, nil
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,84 @@
+package ratecache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.journal")
+	j, err := OpenJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Size() != JournalHeaderSize {
+		t.Errorf("Expected empty journal, size is %d", j.Size())
+	}
+	if j.Wait(JournalHeaderSize, 10*time.Millisecond) {
+		t.Error("Wait on empty journal should time out")
+	}
+	j.Append(JournalRecord{Type: JournalBlock, Index: 3, Data: []byte("header")})
+	j.Append(JournalRecord{Type: JournalCells, Pos: 1234, Data: []byte{1, 2, 3, 4}})
+	records, next, err := j.Read("", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Index != 3 || string(records[0].Data) != "header" {
+		t.Errorf("Unexpected first record %v", records)
+	}
+	id := j.ID()
+	records, next, err = j.Read(id, next, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Pos != 1234 || !bytes.Equal(records[0].Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("Unexpected second record %v", records)
+	}
+	if next != j.Size() {
+		t.Errorf("Expected next offset %d, got %d", j.Size(), next)
+	}
+	// offsets inside of a record and unknown ids are rejected
+	_, _, err = j.Read("", next-2, 1024)
+	if err == nil {
+		t.Error("Expected error for offset inside of a record")
+	}
+	_, _, err = j.Read("0000000000000000", next, 1024)
+	if err != ErrJournalChanged {
+		t.Errorf("Expected ErrJournalChanged, got %v", err)
+	}
+	size := j.Size()
+	j.Close()
+
+	// an incomplete record at the end is removed on open
+	f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 0, 100, JournalCells})
+	f.Close()
+	j, err = OpenJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if j.ID() != id {
+		t.Errorf("Expected journal id %v, got %v", id, j.ID())
+	}
+	if j.Size() != size {
+		t.Errorf("Expected size %d after reopen, got %d", size, j.Size())
+	}
+	// a reset removes all records and changes the id
+	err = j.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID() == id || j.Size() != JournalHeaderSize {
+		t.Errorf("Expected new empty journal, got %v %d", j.ID(), j.Size())
+	}
+}
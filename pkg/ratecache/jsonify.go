@@ -3,7 +3,6 @@ package ratecache
 import (
 	"encoding/json"
 	"fmt"
-	"math"
 	"strings"
 	"time"
 )
@@ -49,24 +48,55 @@ func (ages *Ages) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// DateRangeRate represents a rate
-// that is valid for various checkin dates.
-type DateRangeRate struct {
+// DateRange represents a range of check-in
+// dates for one length of stay.
+type DateRange struct {
 	FirstCheckIn JSONDate `json:"firstCheckIn"`
 	LastCheckIn  JSONDate `json:"lastCheckIn"`
 	LengthOfStay uint8    `json:"lengthOfStay"`
-	Rate         float32  `json:"rate"`
+}
+
+// DateRangeRate represents a rate
+// that is valid for various checkin dates.
+// The rate is either given as decimal number (JSON number or string)
+// in Rate or as integer in minor units of the currency in RateMinorUnits.
+type DateRangeRate struct {
+	FirstCheckIn   JSONDate `json:"firstCheckIn"`
+	LastCheckIn    JSONDate `json:"lastCheckIn"`
+	LengthOfStay   uint8    `json:"lengthOfStay"`
+	Rate           Decimal  `json:"rate"`
+	RateMinorUnits *uint32  `json:"rateMinorUnits,omitempty"`
+}
+
+// GetRate returns the rate in minor units as stored in the cache. Rates
+// with more than DecimalPlaces decimal places are rounded. The second
+// return value is false if the rate is negative or does not fit into
+// rateMask, i.e. the GetRateMask of the file header.
+func (drr DateRangeRate) GetRate(DecimalPlaces uint8, rateMask uint32) (uint32, bool) {
+	if drr.RateMinorUnits != nil {
+		return *drr.RateMinorUnits, *drr.RateMinorUnits <= rateMask
+	}
+	rate, err := drr.Rate.MinorUnits(DecimalPlaces)
+	if err != nil || rate < 0 || rate > int64(rateMask) {
+		return 0, false
+	}
+	return uint32(rate), true
 }
 
 // ExplodeRate returns the exploded rates as a uint32 slice and the offset
 // for the first rate in the room rate block. Check-in dates that are beyond
 // the valid scope of the cache, i.e. the configured check-in dates in the
-// future, will be cut off.
-func (drr DateRangeRate) ExplodeRate(cacheDate time.Time, hdrSize int, days uint16, DecimalPlaces uint8) (int, []uint32) {
+// future, will be cut off. Nothing is returned for length of stay 0 and
+// for rates that do not fit into rateMask.
+func (drr DateRangeRate) ExplodeRate(cacheDate time.Time, hdrSize int, days uint16, DecimalPlaces uint8, rateMask uint32) (int, []uint32) {
 	lastCheckIn := time.Time(drr.LastCheckIn)
 	firstCheckIn := time.Time(drr.FirstCheckIn)
-	maxCheckIn := cacheDate.AddDate(0, 0, int(days))
+	maxCheckIn := cacheDate.AddDate(0, 0, int(days)-1)
 	var rates []uint32
+	rate, ok := drr.GetRate(DecimalPlaces, rateMask)
+	if drr.LengthOfStay == 0 || !ok || lastCheckIn.Before(firstCheckIn) {
+		return 0, rates
+	}
 	if firstCheckIn.Before(cacheDate) {
 		firstCheckIn = cacheDate
 	}
@@ -82,7 +112,7 @@ func (drr DateRangeRate) ExplodeRate(cacheDate time.Time, hdrSize int, days uint
 	length := int(lastCheckIn.Sub(firstCheckIn).Hours()/24 + 1)
 	rates = make([]uint32, length)
 	for i := 0; i < length; i++ {
-		rates[i] = uint32(drr.Rate * float32(math.Pow10(int(DecimalPlaces))))
+		rates[i] = rate
 	}
 	losBlockOffset := int(hdrSize) + (int(drr.LengthOfStay-1) * int(days) * 4)
 	dayOffset := int(firstCheckIn.Sub(cacheDate).Hours()/24) * 4
@@ -108,7 +138,10 @@ func (dra *DateRangeAvail) ExplodeAvail(cacheDate time.Time, hdrSize int, days u
 	lastCheckIn := time.Time(dra.LastCheckIn)
 	firstCheckIn := time.Time(dra.FirstCheckIn)
 	var avails []uint8
-	maxCheckIn := cacheDate.AddDate(0, 0, int(days))
+	maxCheckIn := cacheDate.AddDate(0, 0, int(days)-1)
+	if dra.LengthOfStay == 0 || lastCheckIn.Before(firstCheckIn) {
+		return 0, avails
+	}
 	// handle checkIn dates outside of cache scope
 	if firstCheckIn.Before(cacheDate) {
 		firstCheckIn = cacheDate
@@ -139,7 +172,7 @@ func (dra *DateRangeAvail) ExplodeAvail(cacheDate time.Time, hdrSize int, days u
 type DateRate struct {
 	CheckIn      JSONDate `json:"checkIn"`
 	LengthOfStay uint8    `json:"lengthOfStay"`
-	Rate         float32  `json:"rate"`
+	Rate         Decimal  `json:"rate"`
 }
 
 // RoomRates represents partially or completely the
@@ -150,6 +183,25 @@ type RoomRates struct {
 	Occupancy      []OccupancyItem
 	Rates          []DateRangeRate  `json:"rates"`
 	Availabilities []DateRangeAvail `json:"availabilities"`
+	// Closed contains ranges of cells that are closed for sale. They are
+	// closed on import like with /close, rate and availability are kept.
+	Closed []DateRange `json:"closed,omitempty"`
+	// Tags replace the tags of the room rate and AccoTags the tags of
+	// the accommodation if set, see TagUpdate
+	Tags     map[string]string `json:"tags"`
+	AccoTags map[string]string `json:"accommodationTags"`
+}
+
+// TagUpdates returns the tag updates contained in the room rates.
+func (roomRates *RoomRates) TagUpdates() []TagUpdate {
+	var updates []TagUpdate
+	if roomRates.AccoTags != nil {
+		updates = append(updates, TagUpdate{AccoCode: roomRates.AccoCode, Tags: roomRates.AccoTags})
+	}
+	if roomRates.Tags != nil {
+		updates = append(updates, TagUpdate{AccoCode: roomRates.AccoCode, RoomRateCode: roomRates.RoomRateCode, Tags: roomRates.Tags})
+	}
+	return updates
 }
 
 func (roomRates *RoomRates) Validate() []string {
@@ -163,11 +215,14 @@ func (roomRates *RoomRates) Validate() []string {
 	if len(roomRates.Occupancy) == 0 {
 		msg = append(msg, "No Occupancy Specified")
 	}
+	for _, update := range roomRates.TagUpdates() {
+		msg = append(msg, update.Validate()...)
+	}
 	return msg
 }
 
 // AddRate adds a DateRangeRate to RoomRates.Rates.
-func (roomRates *RoomRates) AddRate(FirstCheckIn time.Time, LastCheckIn time.Time, LengthOfStay uint8, Rate float32) error {
+func (roomRates *RoomRates) AddRate(FirstCheckIn time.Time, LastCheckIn time.Time, LengthOfStay uint8, Rate Decimal) error {
 	drr := DateRangeRate{FirstCheckIn: JSONDate(FirstCheckIn), LastCheckIn: JSONDate(LastCheckIn), LengthOfStay: LengthOfStay, Rate: Rate}
 	roomRates.Rates = append(roomRates.Rates, drr)
 	return nil
@@ -180,6 +235,48 @@ func (roomRates *RoomRates) AddAvail(FirstCheckIn time.Time, LastCheckIn time.Ti
 	return nil
 }
 
+// RangeOperation selects the cells of one or more rate blocks for a
+// range of check-in dates, e.g. to close or clear them without sending
+// rate data. Blocks are selected either by accommodation code, by
+// accommodation and room rate code or by a room rate code prefix, which
+// may be combined with an accommodation code.
+// If no length of stay is given, all lengths of stay are selected.
+type RangeOperation struct {
+	AccoCode           string   `json:"accommodationCode"`
+	RoomRateCode       string   `json:"roomRateCode"`
+	RoomRateCodePrefix string   `json:"roomRateCodePrefix"`
+	FirstCheckIn       JSONDate `json:"firstCheckIn"`
+	LastCheckIn        JSONDate `json:"lastCheckIn"`
+	LengthsOfStay      []uint8  `json:"lengthsOfStay"`
+}
+
+// Validate checks the operation for valid entries and returns a list
+// of validation messages. maxLos is the maximum length of stay of the cache.
+func (op *RangeOperation) Validate(maxLos uint8) []string {
+	var msg []string
+	if len(op.AccoCode) == 0 && len(op.RoomRateCodePrefix) == 0 {
+		msg = append(msg, "Either accommodationCode or roomRateCodePrefix is required")
+	}
+	if len(op.RoomRateCode) > 0 && len(op.AccoCode) == 0 {
+		msg = append(msg, "roomRateCode requires accommodationCode")
+	}
+	if len(op.RoomRateCode) > 0 && len(op.RoomRateCodePrefix) > 0 {
+		msg = append(msg, "roomRateCode and roomRateCodePrefix cannot be combined")
+	}
+	if time.Time(op.FirstCheckIn).IsZero() || time.Time(op.LastCheckIn).IsZero() {
+		msg = append(msg, "firstCheckIn and lastCheckIn are required")
+	}
+	if time.Time(op.FirstCheckIn).After(time.Time(op.LastCheckIn)) {
+		msg = append(msg, "firstCheckIn cannot be after lastCheckIn")
+	}
+	for _, los := range op.LengthsOfStay {
+		if los == 0 || los > maxLos {
+			msg = append(msg, fmt.Sprintf("Invalid lengthOfStay %d", los))
+		}
+	}
+	return msg
+}
+
 //////////////////////////////////
 // Request and Response formats //
 //////////////////////////////////
@@ -189,8 +286,19 @@ func (roomRates *RoomRates) AddAvail(FirstCheckIn time.Time, LastCheckIn time.Ti
 type AccoRoomRate struct {
 	AccoCode      string   `json:"accoCode"`
 	RoomRateCodes []string `json:"roomRateCodes"`
+	// RoomRateCodePattern selects the room rates matching the pattern
+	// instead of RoomRateCodes, see MatchCode
+	RoomRateCodePattern string `json:"roomRateCodePattern"`
 }
 
+// Values of SearchRq.OccupancySelection. If several occupancies of a room
+// rate match the guests, either the first one or the cheapest available
+// one is returned.
+const (
+	OccupancySelectionFirst    = "first"
+	OccupancySelectionCheapest = "cheapest"
+)
+
 // SearchRq transports a set of search parameters.
 type SearchRq struct {
 	CheckIn         JSONDate       `json:"checkIn"`
@@ -201,6 +309,21 @@ type SearchRq struct {
 	MaxLengthOfStay uint8          `json:"maxLengthOfStay"`
 	Occupancy       Ages           `json:"occupancy"`
 	Accommodations  []AccoRoomRate `json:"accommodations"`
+	// OccupancySelection is empty or one of the OccupancySelection constants
+	OccupancySelection string `json:"occupancySelection"`
+	// Rooms are the guests of every room of a multi-room search,
+	// which is used instead of Occupancy
+	Rooms []Ages `json:"rooms"`
+	// Occupancies are alternative groups of guests which are searched
+	// at once instead of Occupancy
+	Occupancies []Ages `json:"occupancies"`
+	// Filters restrict the room rates by the fields of their codes,
+	// see CodeSchema
+	Filters []CodeFilter `json:"filters"`
+	// TagFilters restrict the room rates by their tags, see TagStore
+	TagFilters []TagFilter `json:"tagFilters"`
+	// IncludeTags adds the tags to the options of the response
+	IncludeTags bool `json:"includeTags"`
 }
 
 // Validate checks the request for valid entries and
@@ -233,28 +356,87 @@ func (searchRq *SearchRq) Validate() ([]string, error) {
 	if len(searchRq.Accommodations) == 0 {
 		msgList = append(msgList, "At least on accommodation is required")
 	}
+	for _, accommodation := range searchRq.Accommodations {
+		if len(accommodation.RoomRateCodes) > 0 && len(accommodation.RoomRateCodePattern) > 0 {
+			msgList = append(msgList, fmt.Sprintf("Either roomRateCodes or roomRateCodePattern can be set for %v", accommodation.AccoCode))
+		}
+	}
+	set := 0
+	for _, n := range []int{len(searchRq.Occupancy), len(searchRq.Rooms), len(searchRq.Occupancies)} {
+		if n > 0 {
+			set++
+		}
+	}
+	if set > 1 {
+		msgList = append(msgList, "Only one of occupancy, rooms and occupancies can be set")
+	}
+	if len(searchRq.Occupancies) > MaxSearchOccupancies {
+		msgList = append(msgList, fmt.Sprintf("At most %d occupancies can be requested", MaxSearchOccupancies))
+	}
+	for i, ages := range searchRq.Occupancies {
+		if len(ages) == 0 {
+			msgList = append(msgList, fmt.Sprintf("Occupancy %d has no guests", i+1))
+		}
+	}
+	if len(searchRq.Rooms) > MaxSearchRooms {
+		msgList = append(msgList, fmt.Sprintf("At most %d rooms can be requested", MaxSearchRooms))
+	}
+	for i, ages := range searchRq.Rooms {
+		if len(ages) == 0 {
+			msgList = append(msgList, fmt.Sprintf("Room %d has no guests", i+1))
+		}
+	}
+	for _, filter := range searchRq.TagFilters {
+		if len(filter.Tag) == 0 || len(filter.Values) == 0 {
+			msgList = append(msgList, "Tag filters require a tag and values")
+		}
+	}
+	switch searchRq.OccupancySelection {
+	case "", OccupancySelectionFirst, OccupancySelectionCheapest:
+	default:
+		msgList = append(msgList, "occupancySelection must be first or cheapest")
+	}
 	return msgList, nil
 }
 
 // SearchRsRoomOption represents one room with
 // the corresponding rate and availability
-// for one specific los and stay
+// for one specific los and stay. Rate is the exact
+// decimal rate, RateMinorUnits the same rate in minor
+// units of the currency.
 type SearchRsRoomOption struct {
-	RoomRateCode string  `json:"roomRateCode"`
-	Rate         float64 `json:"rate"`
-	Availability uint8   `json:"availability"`
+	RoomRateCode   string  `json:"roomRateCode"`
+	Rate           Decimal `json:"rate"`
+	RateMinorUnits uint32  `json:"rateMinorUnits"`
+	Availability   uint8   `json:"availability"`
+	// Fields are the fields of the room rate code if a code schema is set
+	Fields map[string]string `json:"fields,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
 }
 
 //SearchRsAccoOption groups accommodation with different
 // rooms for one specific combination of check-in and los.
 type SearchRsAccoOption struct {
-	AccoCode string `json:"accoCode"`
-	Rooms    []SearchRsRoomOption
+	AccoCode     string `json:"accoCode"`
+	Rooms        []SearchRsRoomOption
+	Combinations []SearchRsCombination `json:"combinations,omitempty"`
+	// Fields are the fields of the accommodation code if a code schema is set
+	Fields map[string]string `json:"fields,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+// SearchRsOccupancy contains the options for one of the
+// occupancies of a search request.
+type SearchRsOccupancy struct {
+	Occupancy Ages                 `json:"occupancy"`
+	Options   []SearchRsAccoOption `json:"options"`
 }
 
-// SearchRs transports a search result.
+// SearchRs transports a search result. If the request contains
+// occupancies, the options are returned per occupancy in Occupancies.
 type SearchRs struct {
 	CheckIn      JSONDate             `json:"checkIn"`
 	LengthOfStay uint8                `json:"lengthOfStay"`
 	Options      []SearchRsAccoOption `json:"options"`
+	Occupancies  []SearchRsOccupancy  `json:"occupancies,omitempty"`
 }
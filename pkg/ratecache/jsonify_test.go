@@ -10,7 +10,7 @@ import (
 func TestTypeDateRangeValue(t *testing.T) {
 	firstCheckIn := time.Date(2022, time.November, 15, 0, 0, 0, 0, time.UTC)
 	lastCheckIn := time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC)
-	testDateRangeRate := DateRangeRate{JSONDate(firstCheckIn), JSONDate(lastCheckIn), 3, 250.00}
+	testDateRangeRate := DateRangeRate{FirstCheckIn: JSONDate(firstCheckIn), LastCheckIn: JSONDate(lastCheckIn), LengthOfStay: 3, Rate: NewDecimal(25000, 2)}
 	marshalled, _ := json.Marshal(testDateRangeRate)
 	newTestDateRangeRate := DateRangeRate{}
 	json.Unmarshal(marshalled, &newTestDateRangeRate)
@@ -29,9 +29,9 @@ func TestExplodeRate(t *testing.T) {
 		FirstCheckIn: JSONDate(firstCheckIn),
 		LastCheckIn:  JSONDate(lastCheckIn),
 		LengthOfStay: 3,
-		Rate:         250.00,
+		Rate:         NewDecimal(25000, 2),
 	}
-	offset, b := dateRangeRate.ExplodeRate(cacheDate, headerSize, days, 2)
+	offset, b := dateRangeRate.ExplodeRate(cacheDate, headerSize, days, 2, RateMask)
 	if offset != 294 {
 		t.Errorf("Value %d, expected value 294", offset)
 	}
@@ -43,15 +43,28 @@ func TestExplodeRate(t *testing.T) {
 	dateRangeRate.FirstCheckIn = JSONDate(firstCheckIn)
 	dateRangeRate.LastCheckIn = JSONDate(lastCheckIn)
 	dateRangeRate.LengthOfStay = 1
-	offset, b = dateRangeRate.ExplodeRate(cacheDate, headerSize, days, 2)
+	offset, b = dateRangeRate.ExplodeRate(cacheDate, headerSize, days, 2, RateMask)
 	if offset != 146 {
 		t.Errorf("Value %d, expected value: 24", offset)
 	}
-	/* need to check this
 	if len(b) != 6 {
 		t.Errorf("Value %d, expected: 6", len(b))
 	}
-	*/
+	dateRangeRate.LengthOfStay = 0
+	_, b = dateRangeRate.ExplodeRate(cacheDate, headerSize, days, 2, RateMask)
+	if len(b) != 0 {
+		t.Errorf("Value %d, expected: 0", len(b))
+	}
+	dateRangeRate.LengthOfStay = 1
+	dateRangeRate.Rate = NewDecimal(2000000, 0)
+	_, b = dateRangeRate.ExplodeRate(cacheDate, headerSize, days, 2, RateMask)
+	if len(b) != 0 {
+		t.Errorf("Value %d, expected: 0", len(b))
+	}
+	_, b = dateRangeRate.ExplodeRate(cacheDate, headerSize, days, 2, RateMaskV8)
+	if len(b) != 6 || b[0] != 200000000 {
+		t.Errorf("Value %v, expected: 6 rates 200000000", b)
+	}
 }
 
 /*
@@ -85,3 +98,32 @@ func TestAges(t *testing.T) {
 	json.Unmarshal(jsonStr, &newAges)
 	fmt.Println(newAges)
 }
+
+func TestGetRate(t *testing.T) {
+	var dateRangeRate DateRangeRate
+	json.Unmarshal([]byte(`{"rate":31.02}`), &dateRangeRate)
+	rate, ok := dateRangeRate.GetRate(2, RateMask)
+	if rate != 3102 || !ok {
+		t.Errorf("Value: %v, expected: 3102", rate)
+	}
+	json.Unmarshal([]byte(`{"rateMinorUnits":3101}`), &dateRangeRate)
+	rate, ok = dateRangeRate.GetRate(2, RateMask)
+	if rate != 3101 || !ok {
+		t.Errorf("Value: %v, expected: 3101", rate)
+	}
+
+	// format version 8 has one more bit for the rate
+	dateRangeRate = DateRangeRate{}
+	json.Unmarshal([]byte(`{"rate":2000000}`), &dateRangeRate)
+	if _, ok = dateRangeRate.GetRate(2, RateMask); ok {
+		t.Errorf("Expected 2000000.00 to exceed RateMask")
+	}
+	rate, ok = dateRangeRate.GetRate(2, RateMaskV8)
+	if rate != 200000000 || !ok {
+		t.Errorf("Value: %v, expected: 200000000", rate)
+	}
+	json.Unmarshal([]byte(`{"rate":3000000}`), &dateRangeRate)
+	if _, ok = dateRangeRate.GetRate(2, RateMaskV8); ok {
+		t.Errorf("Expected 3000000.00 to exceed RateMaskV8")
+	}
+}
@@ -0,0 +1,94 @@
+package ratecache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned if a file is locked by another process.
+var ErrLocked = errors.New("File is locked by another process")
+
+// FileLock is an advisory lock on a file. It is released when
+// Unlock is called or the process ends.
+type FileLock struct {
+	f *os.File
+}
+
+// LockInfo is written to lock files of writers, so that
+// operators can see which process holds the lock.
+type LockInfo struct {
+	Pid   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+func (info LockInfo) String() string {
+	return fmt.Sprintf("pid %d on host %v since %v", info.Pid, info.Host, info.Since.Format(time.RFC3339))
+}
+
+// LockWriter takes an exclusive lock on the lock file filename and
+// records the current process in it. If another process holds the lock,
+// the error names that process.
+func LockWriter(filename string) (*FileLock, error) {
+	lock, err := LockFile(filename, true)
+	if err == ErrLocked {
+		var info LockInfo
+		buf, _ := ioutil.ReadFile(filename)
+		if json.Unmarshal(buf, &info) == nil && info.Pid > 0 {
+			return nil, fmt.Errorf("%v is locked by %v", filename, info)
+		}
+		return nil, fmt.Errorf("%v is locked by another process", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	buf, _ := json.Marshal(LockInfo{Pid: os.Getpid(), Host: host, Since: time.Now().UTC()})
+	err = lock.f.Truncate(0)
+	if err == nil {
+		_, err = lock.f.WriteAt(buf, 0)
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Unlock releases the lock.
+func (lock *FileLock) Unlock() error {
+	if lock == nil || lock.f == nil {
+		return nil
+	}
+	err := unlockFile(lock.f)
+	lock.f.Close()
+	lock.f = nil
+	return err
+}
+
+// LockFile takes an exclusive or a shared lock on filename without
+// waiting. For an exclusive lock the file is created if it does not exist,
+// a shared lock only needs read access. ErrLocked is returned if the lock
+// is held by another process.
+func LockFile(filename string, exclusive bool) (*FileLock, error) {
+	var f *os.File
+	var err error
+	if exclusive {
+		f, err = os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	} else {
+		f, err = os.Open(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f, exclusive)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
@@ -0,0 +1,63 @@
+// +build !windows
+
+package ratecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.lock")
+	lock, err := LockWriter(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockWriter(filename)
+	if err == nil || !strings.Contains(err.Error(), "pid") {
+		t.Errorf("Expected error naming the lock owner, got %v", err)
+	}
+	lock.Unlock()
+	lock, err = LockWriter(filename)
+	if err != nil {
+		t.Errorf("Expected lock after unlock, got %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestLockFileShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.bin")
+	ioutil.WriteFile(filename, []byte("data"), 0644)
+	lock1, err := LockFile(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock2, err := LockFile(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockFile(filename, true)
+	if err != ErrLocked {
+		t.Errorf("Value: %v, expected: %v", err, ErrLocked)
+	}
+	lock1.Unlock()
+	lock2.Unlock()
+	lock, err := LockFile(filename, true)
+	if err != nil {
+		t.Errorf("Expected exclusive lock, got %v", err)
+	}
+	lock.Unlock()
+}
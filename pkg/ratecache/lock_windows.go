@@ -0,0 +1,15 @@
+// +build windows
+
+package ratecache
+
+import "os"
+
+// Advisory locks are not supported on windows, locking always succeeds.
+
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
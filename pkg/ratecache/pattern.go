@@ -0,0 +1,31 @@
+package ratecache
+
+// MatchCode tells whether code matches pattern. In pattern '*' matches
+// any sequence of characters, also an empty one, and '?' matches any
+// single character. All other characters only match themselves, so
+// "DBL*HB*" matches all double rooms with half board.
+func MatchCode(pattern string, code string) bool {
+	p, c := 0, 0
+	// position of the last '*' in pattern and of code when it was reached
+	star, starCode := -1, 0
+	for c < len(code) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == code[c]):
+			p++
+			c++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starCode = p, c
+			p++
+		case star >= 0:
+			// let the last '*' match one more character
+			starCode++
+			p, c = star+1, starCode
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,31 @@
+package ratecache
+
+import (
+	"testing"
+)
+
+func TestMatchCode(t *testing.T) {
+	tests := []struct {
+		pattern string
+		code    string
+		match   bool
+	}{
+		{"DBL*HB*", "DBLSTDHB123", true},
+		{"DBL*HB*", "DBLHB", true},
+		{"DBL*HB*", "DBLSTDBB123", false},
+		{"DBL*HB*", "SGLSTDHB123", false},
+		{"*", "", true},
+		{"", "DBL", false},
+		{"DBL", "DBL", true},
+		{"DBL", "DBLX", false},
+		{"D?L*", "DBLSTD", true},
+		{"D?L*", "DL", false},
+		{"*A*B", "XAXAXB", true},
+		{"*A*B", "XAXBX", false},
+	}
+	for _, test := range tests {
+		if MatchCode(test.pattern, test.code) != test.match {
+			t.Errorf("MatchCode(%q, %q): expected %v", test.pattern, test.code, test.match)
+		}
+	}
+}
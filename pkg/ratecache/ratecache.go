@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
@@ -29,7 +30,8 @@ func StrToTime(s string) (time.Time, error) {
 
 // PackRate packs rate and availability into a single uint32
 // and returns the value as a 4 byte string (big endian)
-// that can be written to the rate cache.
+// that can be written to the rate cache. Rates above RateMask
+// must be rejected by the caller.
 func PackRate(rate uint32, avail uint8) []byte {
 	r := (rate & RateMask) | (uint32(avail) << 28)
 	buf := make([]byte, 4)
@@ -38,11 +40,75 @@ func PackRate(rate uint32, avail uint8) []byte {
 }
 
 // UnpackRate takes a 4 byte string, unpacks values for rate
-// and availability and returns them separately.
+// and availability and returns them separately. Closed cells
+// are returned with rate 0, which means closed for sale.
 func UnpackRate(buf []byte) (uint32, uint8) {
+	rate, avail, closed := UnpackCell(buf)
+	if closed {
+		rate = 0
+	}
+	return rate, avail
+}
+
+// UnpackCell works like UnpackRate but returns the stored
+// rate of closed cells together with the closed flag.
+func UnpackCell(buf []byte) (uint32, uint8, bool) {
 	r := binary.BigEndian.Uint32(buf)
 	rate := r & RateMask
 	avail := uint8(r >> 28)
+	return rate, avail, r&ClosedFlag != 0
+}
+
+// HasClosedFlag tells whether cells of the rate file can be closed.
+// Format version 8 uses all 28 lower bits for the rate.
+func (fhdr *FileHeader) HasClosedFlag() bool {
+	return fhdr.Version >= 9
+}
+
+// GetClosedFlag returns ClosedFlag or 0 if the format version has
+// no closed flag.
+func (fhdr *FileHeader) GetClosedFlag() uint32 {
+	if fhdr.HasClosedFlag() {
+		return ClosedFlag
+	}
+	return 0
+}
+
+// UnpackCell works like the function UnpackCell but also reads
+// cells of format version 8.
+func (fhdr *FileHeader) UnpackCell(buf []byte) (uint32, uint8, bool) {
+	if fhdr.HasClosedFlag() {
+		return UnpackCell(buf)
+	}
+	r := binary.BigEndian.Uint32(buf)
+	return r & RateMaskV8, uint8(r >> 28), false
+}
+
+// GetRateMask returns the mask of the rate bits of a cell,
+// RateMaskV8 for format version 8.
+func (fhdr *FileHeader) GetRateMask() uint32 {
+	if fhdr.HasClosedFlag() {
+		return RateMask
+	}
+	return RateMaskV8
+}
+
+// PackRate works like the function PackRate but also writes
+// cells of format version 8.
+func (fhdr *FileHeader) PackRate(rate uint32, avail uint8) []byte {
+	r := (rate & fhdr.GetRateMask()) | (uint32(avail) << 28)
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, r)
+	return buf
+}
+
+// UnpackRate works like the function UnpackRate but also reads
+// cells of format version 8.
+func (fhdr *FileHeader) UnpackRate(buf []byte) (uint32, uint8) {
+	rate, avail, closed := fhdr.UnpackCell(buf)
+	if closed {
+		rate = 0
+	}
 	return rate, avail
 }
 
@@ -107,10 +173,10 @@ func FileHeaderFromByteStr(byteStr []byte) (*FileHeader, error) {
 	if string(byteStr[:8]) != Signature {
 		return nil, errors.New("byteStr is not in rate cache format")
 	}
-	if int(byteStr[16]) != Version {
-		return nil, fmt.Errorf("Wrong version. expected version is %d, got %d", Version, int(byteStr[16]))
+	if int(byteStr[16]) < MinVersion || int(byteStr[16]) > Version {
+		return nil, fmt.Errorf("Wrong version. expected version %d to %d, got %d", MinVersion, Version, int(byteStr[16]))
 	}
-	fhdr := FileHeader{Signature: Signature, Version: Version}
+	fhdr := FileHeader{Signature: Signature, Version: byteStr[16]}
 	fhdr.Supplier = string(bytes.Trim(byteStr[8:16], "\x00"))
 	//fmt.Println(string(byteStr[17:25]))
 	t, err := StrToTime(string(byteStr[17:25]))
@@ -127,9 +193,32 @@ func FileHeaderFromByteStr(byteStr []byte) (*FileHeader, error) {
 	return &fhdr, nil
 }
 
+// ReadFileHeader reads and parses the file header at the start of r.
+func ReadFileHeader(r io.ReaderAt) (*FileHeader, error) {
+	buf := make([]byte, FileHeaderSize)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read file header: %v", err)
+	}
+	return FileHeaderFromByteStr(buf)
+}
+
+// CheckSize returns an error if size bytes of cache data do not
+// contain all RateBlockCount rate blocks.
+func (fhdr *FileHeader) CheckSize(size int64) error {
+	required := fhdr.GetRateBlockStart(fhdr.RateBlockCount)
+	if size < required {
+		return fmt.Errorf("%d bytes do not cover %d rate blocks, %d bytes required", size, fhdr.RateBlockCount, required)
+	}
+	return nil
+}
+
 // GetBlockHeaderSize calculates the rate block header size.
 func (fhdr *FileHeader) GetBlockHeaderSize() int {
 	blockHeaderSize := int(fhdr.AccoCodeLength) + int(fhdr.RoomRateCodeLength) + int(FixBlockHeaderSize)
+	if fhdr.HasSeqCounter() {
+		blockHeaderSize += SeqCounterSize
+	}
 	return blockHeaderSize
 }
 
@@ -160,14 +249,64 @@ func (fhdr *FileHeader) GetRatePos(idx uint32, date time.Time, los uint8) (int64
 	return rateBlockStart + losStart, nil
 }
 
+// ClipCheckIns returns the offset in days of the first check-in date
+// and the number of check-in dates of a date range within the scope of
+// the cache. Check-in dates before StartDate or beyond Days are cut off.
+// The count is 0 if no check-in date is left.
+func (fhdr *FileHeader) ClipCheckIns(firstCheckIn time.Time, lastCheckIn time.Time) (int, int) {
+	first := int(firstCheckIn.Sub(fhdr.StartDate).Hours() / 24)
+	last := int(lastCheckIn.Sub(fhdr.StartDate).Hours() / 24)
+	if first < 0 {
+		first = 0
+	}
+	if last >= int(fhdr.Days) {
+		last = int(fhdr.Days) - 1
+	}
+	if last < first {
+		return 0, 0
+	}
+	return first, last - first + 1
+}
+
+// GetTruncated returns the parts of a range of check-in dates that
+// are outside the scope of the cache and are cut off on import.
+func (fhdr *FileHeader) GetTruncated(firstCheckIn time.Time, lastCheckIn time.Time, los uint8) []DateRange {
+	var truncated []DateRange
+	lastDate := fhdr.StartDate.AddDate(0, 0, int(fhdr.Days)-1)
+	if firstCheckIn.Before(fhdr.StartDate) {
+		last := fhdr.StartDate.AddDate(0, 0, -1)
+		if lastCheckIn.Before(last) {
+			last = lastCheckIn
+		}
+		truncated = append(truncated, DateRange{FirstCheckIn: JSONDate(firstCheckIn), LastCheckIn: JSONDate(last), LengthOfStay: los})
+	}
+	if lastCheckIn.After(lastDate) {
+		first := lastDate.AddDate(0, 0, 1)
+		if firstCheckIn.After(first) {
+			first = firstCheckIn
+		}
+		truncated = append(truncated, DateRange{FirstCheckIn: JSONDate(first), LastCheckIn: JSONDate(lastCheckIn), LengthOfStay: los})
+	}
+	return truncated
+}
+
+// GetLosOffset returns the offset of the first cell of a length
+// of stay inside of a rate block.
+func (fhdr *FileHeader) GetLosOffset(los uint8) int64 {
+	return int64(fhdr.GetBlockHeaderSize()) + int64(los-1)*int64(fhdr.Days)*4
+}
+
 // SetRateInfo writes one rate/avail to rate cache.
 func (fhdr *FileHeader) SetRateInfo(f *os.File, idx uint32, date time.Time, los uint8, rate uint32, avail uint8) error {
-	val := PackRate(rate, avail)
+	if rate > fhdr.GetRateMask() {
+		return fmt.Errorf("Rate %d exceeds the maximum rate %d", rate, fhdr.GetRateMask())
+	}
+	val := fhdr.PackRate(rate, avail)
 	ratePos, err := fhdr.GetRatePos(idx, date, los)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteAt(val, ratePos)
+	err = fhdr.WriteCellsAt(f, idx, val, ratePos)
 	f.Sync()
 	return err
 }
@@ -180,18 +319,23 @@ func (fhdr *FileHeader) GetRateInfo(f *os.File, idx uint32, date time.Time, los
 	}
 	buf := make([]byte, 4)
 	f.ReadAt(buf, ratePos)
-	rate, avail := UnpackRate(buf)
+	rate, avail := fhdr.UnpackRate(buf)
 	return rate, avail, nil
 }
 
+// GetRateInfoFromMap gets one rate/avail from the mapped rate cache. If
+// the writer keeps updating the rate block, ErrConcurrentWrite is returned.
 func (fhdr *FileHeader) GetRateInfoFromMap(m mmap.ReaderAt, idx uint32, date time.Time, los uint8) (uint32, uint8, error) {
 	ratePos, err := fhdr.GetRatePos(idx, date, los)
 	if err != nil {
 		return 0, 0, err
 	}
 	buf := make([]byte, 4)
-	m.ReadAt(buf, ratePos)
-	rate, avail := UnpackRate(buf)
+	err = fhdr.ReadCellsAt(&m, idx, buf, ratePos)
+	if err != nil {
+		return 0, 0, err
+	}
+	rate, avail := fhdr.UnpackRate(buf)
 	return rate, avail, nil
 }
 
@@ -234,14 +378,13 @@ func NewRateBlockHeader(accoCode string, roomRateCode string) (*RateBlockHeader,
 
 // RateBlockHeaderFromByteStr creates a rate block header object from byte string.
 func RateBlockHeaderFromByteStr(byteStr []byte, AccoCodeLength uint8, RoomRateCodeLength uint8) (*RateBlockHeader, error) {
-	if int(AccoCodeLength)+int(RoomRateCodeLength) > len(byteStr) {
+	offset := int(AccoCodeLength) + int(RoomRateCodeLength)
+	if offset+FixBlockHeaderSize > len(byteStr) {
 		return nil, errors.New("byteStr is not long enough or accoCodeLength/roomRateCodeLength are wrong")
 	}
 	rbhdr := RateBlockHeader{}
-	bytes.Trim(byteStr[8:16], "\x00")
 	rbhdr.accoCode = string(bytes.Trim(byteStr[:AccoCodeLength], "\x00"))
-	rbhdr.roomRateCode = string(bytes.Trim(byteStr[AccoCodeLength:RoomRateCodeLength], "\x00"))
-	offset := int(AccoCodeLength + RoomRateCodeLength)
+	rbhdr.roomRateCode = string(bytes.Trim(byteStr[AccoCodeLength:offset], "\x00"))
 	for i := 0; i < 24; i += 3 {
 		item := byteStr[offset+i : offset+i+3]
 		if item[2] > 0 {
@@ -266,15 +409,11 @@ func (rbhdr *RateBlockHeader) AddOccupancyItem(MinAge uint8, MaxAge uint8, Count
 }
 
 // ToByteStr creates a rate block header as byte string from object.
+// Codes that are longer than the configured code lengths are cut off.
 func (rbhdr *RateBlockHeader) ToByteStr(AccoCodeLength uint8, RoomRateCodeLength uint8) []byte {
-	byteStr := []byte(rbhdr.accoCode)
-	for i := uint8(len(rbhdr.accoCode)); i < AccoCodeLength; i++ {
-		byteStr = append(byteStr, byte(0))
-	}
-	byteStr = append(byteStr, rbhdr.roomRateCode...)
-	for i := uint8(len(rbhdr.roomRateCode)); i < RoomRateCodeLength; i++ {
-		byteStr = append(byteStr, byte(0))
-	}
+	byteStr := make([]byte, int(AccoCodeLength)+int(RoomRateCodeLength))
+	copy(byteStr[:AccoCodeLength], rbhdr.accoCode)
+	copy(byteStr[AccoCodeLength:], rbhdr.roomRateCode)
 	for _, v := range rbhdr.occupancy {
 		byteStr = append(byteStr, *v.ToByteStr()...)
 	}
@@ -286,7 +425,7 @@ func (rbhdr *RateBlockHeader) ToByteStr(AccoCodeLength uint8, RoomRateCodeLength
 // CreateRateBlock creates an empty rate block for padding.
 func CreateRateBlock(fhdr *FileHeader, rbhdr *RateBlockHeader) []byte {
 	byteStr := rbhdr.ToByteStr(fhdr.AccoCodeLength, fhdr.RoomRateCodeLength)
-	bsLength := 4 * int(fhdr.MaxLos) * int(fhdr.Days)
+	bsLength := fhdr.GetRateBlockSize() - len(byteStr)
 	for i := 0; i < bsLength; i++ {
 		byteStr = append(byteStr, byte(0))
 	}
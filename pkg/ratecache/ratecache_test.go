@@ -43,8 +43,8 @@ func TestFileHeaderToByteStr(t *testing.T) {
 
 func TestGetBlockHeaderSize(t *testing.T) {
 	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
-	if fhdr.GetBlockHeaderSize() != 120 {
-		t.Errorf("Value: %v, expected: 120", fhdr.GetBlockHeaderSize())
+	if fhdr.GetBlockHeaderSize() != 124 {
+		t.Errorf("Value: %v, expected: 124", fhdr.GetBlockHeaderSize())
 	}
 }
 
@@ -116,7 +116,7 @@ func TestCreateRateBlock(t *testing.T) {
 	rbhdr.AddOccupancyItem(14, 17, 1)
 	rbhdr.AddOccupancyItem(18, 100, 2)
 	byteStr := CreateRateBlock(fhdr, rbhdr)
-	expectedLen := 32 + 64 + 24 + 14*400*4
+	expectedLen := 32 + 64 + 24 + 4 + 14*400*4
 	if len(byteStr) != expectedLen {
 		t.Errorf("Value: %v, expected: %v", len(byteStr), expectedLen)
 	}
@@ -173,8 +173,8 @@ func TestGetRateBlockStart(t *testing.T) {
 	if fhdr.GetRateBlockStart(0) != FileHeaderSize {
 		t.Errorf("Value: %v, expected: %v", fhdr.GetRateBlockStart(0), FileHeaderSize)
 	}
-	if fhdr.GetRateBlockStart(1) != 22557 {
-		t.Errorf("Value: %v, expected: %v", fhdr.GetRateBlockStart(1), 22557)
+	if fhdr.GetRateBlockStart(1) != 22561 {
+		t.Errorf("Value: %v, expected: %v", fhdr.GetRateBlockStart(1), 22561)
 	}
 }
 
@@ -187,6 +187,12 @@ func TestPackRate(t *testing.T) {
 	if avail != 12 {
 		t.Errorf("Value: %v, expected: %v", avail, 12)
 	}
+	// version 8 has 28 bits for the rate
+	fhdr := FileHeader{Version: 8}
+	rate, avail = fhdr.UnpackRate(fhdr.PackRate(RateMask+1000, 3))
+	if rate != RateMask+1000 || avail != 3 {
+		t.Errorf("Value: %v %v, expected: %v 3", rate, avail, RateMask+1000)
+	}
 }
 
 /*
@@ -249,3 +255,56 @@ func TestSetGetRateInfo(t *testing.T) {
 		t.Errorf("Value: %v, expected: %v", avail, 15)
 	}
 }
+
+func TestUnpackCell(t *testing.T) {
+	buf := PackRate(45000, 12)
+	buf[0] |= byte(ClosedFlag >> 24)
+	rate, avail, closed := UnpackCell(buf)
+	if rate != 45000 || avail != 12 || closed != true {
+		t.Errorf("Value: %v %v %v, expected: 45000 12 true", rate, avail, closed)
+	}
+	rate, _ = UnpackRate(buf)
+	if rate != 0 {
+		t.Errorf("Value: %v, expected: 0", rate)
+	}
+	// version 8 uses the bit of the closed flag for the rate
+	fhdr := FileHeader{Version: 8}
+	rate, avail, closed = fhdr.UnpackCell(buf)
+	if rate != 45000|ClosedFlag || avail != 12 || closed {
+		t.Errorf("Value: %v %v %v, expected: %v 12 false", rate, avail, closed, 45000|ClosedFlag)
+	}
+}
+
+func TestClipCheckIns(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 1, 0, 0, 0, 0, time.UTC), "EUR", 14, 30, 32, 64)
+	offset, count := fhdr.ClipCheckIns(time.Date(2022, time.October, 25, 0, 0, 0, 0, time.UTC), time.Date(2022, time.November, 3, 0, 0, 0, 0, time.UTC))
+	if offset != 0 || count != 3 {
+		t.Errorf("Value: %v %v, expected: 0 3", offset, count)
+	}
+	offset, count = fhdr.ClipCheckIns(time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), time.Date(2022, time.December, 10, 0, 0, 0, 0, time.UTC))
+	if offset != 24 || count != 6 {
+		t.Errorf("Value: %v %v, expected: 24 6", offset, count)
+	}
+	_, count = fhdr.ClipCheckIns(time.Date(2022, time.December, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.December, 10, 0, 0, 0, 0, time.UTC))
+	if count != 0 {
+		t.Errorf("Value: %v, expected: 0", count)
+	}
+}
+
+func TestGetTruncated(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 1, 0, 0, 0, 0, time.UTC), "EUR", 14, 30, 32, 64)
+	truncated := fhdr.GetTruncated(time.Date(2022, time.October, 25, 0, 0, 0, 0, time.UTC), time.Date(2022, time.December, 3, 0, 0, 0, 0, time.UTC), 2)
+	if len(truncated) != 2 {
+		t.Fatalf("Value: %v, expected: 2", len(truncated))
+	}
+	if time.Time(truncated[0].LastCheckIn) != time.Date(2022, time.October, 31, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("Value: %v, expected: 2022-10-31", time.Time(truncated[0].LastCheckIn))
+	}
+	if time.Time(truncated[1].FirstCheckIn) != time.Date(2022, time.December, 1, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("Value: %v, expected: 2022-12-01", time.Time(truncated[1].FirstCheckIn))
+	}
+	truncated = fhdr.GetTruncated(time.Date(2022, time.November, 2, 0, 0, 0, 0, time.UTC), time.Date(2022, time.November, 3, 0, 0, 0, 0, time.UTC), 2)
+	if len(truncated) != 0 {
+		t.Errorf("Value: %v, expected: 0", len(truncated))
+	}
+}
@@ -0,0 +1,129 @@
+package ratecache
+
+import (
+	"fmt"
+	"os"
+)
+
+// IndexDiff lists the differences between an index file and the index
+// rebuilt from the rate block headers of the cache file.
+type IndexDiff struct {
+	// LoadError is the reason why the index file could not be loaded
+	LoadError error
+	// Missing are the entries of rate blocks the index file does not contain
+	Missing []IdxEntry
+	// Extra are the entries of the index file without matching rate block
+	Extra []IdxEntry
+}
+
+// IsEmpty tells whether the index file was loaded and
+// matches the rebuilt index.
+func (diff *IndexDiff) IsEmpty() bool {
+	return diff.LoadError == nil && len(diff.Missing) == 0 && len(diff.Extra) == 0
+}
+
+func (diff *IndexDiff) String() string {
+	if diff.LoadError != nil {
+		return fmt.Sprintf("index file cannot be loaded: %v", diff.LoadError)
+	}
+	return fmt.Sprintf("%d entries missing in index file, %d entries without rate block", len(diff.Missing), len(diff.Extra))
+}
+
+// entryKeys returns the entries of idx by combination of codes,
+// occupancy and rate block index.
+func entryKeys(idx *CacheIndex) map[string]IdxEntry {
+	keys := make(map[string]IdxEntry)
+	for _, entry := range idx.Select("", "", "") {
+		key := fmt.Sprintf("%v#%d", occupancyKey(entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx.Occupancy), entry.RoomOccIdx.Idx)
+		keys[key] = entry
+	}
+	return keys
+}
+
+// CompareIndex compares an index loaded from an index file with
+// the index rebuilt from the cache file.
+func CompareIndex(rebuilt *CacheIndex, loaded *CacheIndex) IndexDiff {
+	diff := IndexDiff{}
+	rebuiltKeys := entryKeys(rebuilt)
+	loadedKeys := entryKeys(loaded)
+	for key, entry := range rebuiltKeys {
+		if _, ok := loadedKeys[key]; !ok {
+			diff.Missing = append(diff.Missing, entry)
+		}
+	}
+	for key, entry := range loadedKeys {
+		if _, ok := rebuiltKeys[key]; !ok {
+			diff.Extra = append(diff.Extra, entry)
+		}
+	}
+	return diff
+}
+
+// ReindexResult is the result of RebuildIndex.
+type ReindexResult struct {
+	Header  *FileHeader
+	Rebuilt *CacheIndex
+	// Loaded is the index loaded from the index file, nil if loading failed
+	Loaded *CacheIndex
+	Diff   IndexDiff
+}
+
+// Index returns the loaded index if it matches the rebuilt index
+// and the rebuilt index otherwise.
+func (result *ReindexResult) Index() *CacheIndex {
+	if result.Diff.IsEmpty() {
+		return result.Loaded
+	}
+	return result.Rebuilt
+}
+
+// RebuildIndex rebuilds the index from the rate block headers of the
+// cache file and compares it with the index file. Rate blocks that were
+// removed by tombstone records of the index file stay removed in the
+// rebuilt index. If the index file cannot be loaded, all rate blocks
+// are part of the rebuilt index.
+func RebuildIndex(cacheFilename string, idxFilename string) (*ReindexResult, error) {
+	result := &ReindexResult{}
+	f, err := os.Open(cacheFilename)
+	if err != nil {
+		return result, err
+	}
+	buf := make([]byte, FileHeaderSize)
+	_, err = f.ReadAt(buf, 0)
+	f.Close()
+	if err != nil {
+		return result, err
+	}
+	result.Header, err = FileHeaderFromByteStr(buf)
+	if err != nil {
+		return result, err
+	}
+	loaded := NewCacheIndex()
+	result.Diff.LoadError = loaded.Load(result.Header, idxFilename)
+	var removed []uint32
+	if result.Diff.LoadError == nil {
+		result.Loaded = loaded
+		removed = loaded.RemovedBlocks()
+	}
+	result.Rebuilt = NewCacheIndex()
+	err = result.Rebuilt.LoadFromCache(cacheFilename, removed)
+	if err != nil {
+		return result, err
+	}
+	if result.Loaded != nil {
+		result.Diff = CompareIndex(result.Rebuilt, loaded)
+	}
+	return result, nil
+}
+
+// WriteIndexFile saves idx to a temporary file which then replaces
+// filename, so that readers never see a partly written index file.
+func WriteIndexFile(idx *CacheIndex, fhdr *FileHeader, filename string) error {
+	tmpFilename := filename + ".tmp"
+	err := idx.Save(fhdr, tmpFilename)
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
@@ -0,0 +1,96 @@
+package ratecache
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRebuildIndex(t *testing.T) {
+	dir, cacheFilename, idxFilename := newCheckTestCache(t)
+	defer os.RemoveAll(dir)
+	result, err := RebuildIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rebuilt.GetEntryCount() != 3 {
+		t.Errorf("Value: %v, expected: 3", result.Rebuilt.GetEntryCount())
+	}
+	if len(result.Diff.Missing) != 1 || result.Diff.Missing[0].RoomRateCode != "TWNSTDBRBAR" || len(result.Diff.Extra) != 0 {
+		t.Errorf("Unexpected diff %v", result.Diff)
+	}
+	if result.Index() != result.Rebuilt {
+		t.Error("Expected rebuilt index for differing index file")
+	}
+	err = WriteIndexFile(result.Rebuilt, result.Header, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = RebuildIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Diff.IsEmpty() || result.Index() != result.Loaded {
+		t.Errorf("Expected no differences after writing rebuilt index, got %v", &result.Diff)
+	}
+	os.Remove(idxFilename)
+	result, err = RebuildIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Diff.LoadError == nil {
+		t.Error("Expected load error for missing index file")
+	}
+}
+
+func TestRebuildIndexTombstone(t *testing.T) {
+	dir, cacheFilename, idxFilename := newCheckTestCache(t)
+	defer os.RemoveAll(dir)
+	result, err := RebuildIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteIndexFile(result.Rebuilt, result.Header, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := result.Rebuilt.Select("ALC123", "SGLSTDBRBAR", "")[0]
+	err = AppendIdxRecord(result.Header, idxFilename, IdxRecord{Entry: removed, Tombstone: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = RebuildIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Diff.IsEmpty() {
+		t.Errorf("Expected no differences for removed rate block, got %v", &result.Diff)
+	}
+	if result.Rebuilt.GetEntryCount() != 2 || !result.Rebuilt.IsRemoved(removed.RoomOccIdx.Idx) {
+		t.Errorf("Value: %v entries, expected: 2 without rate block %d", result.Rebuilt.GetEntryCount(), removed.RoomOccIdx.Idx)
+	}
+
+	// the rebuilt index file keeps the tombstone
+	err = WriteIndexFile(result.Rebuilt, result.Header, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = RebuildIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Diff.IsEmpty() || result.Loaded.GetEntryCount() != 2 {
+		t.Errorf("Expected removed rate block to stay removed, got %v", &result.Diff)
+	}
+	_, err = RepairIndex(cacheFilename, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := NewCacheIndex()
+	err = idx.Load(result.Header, idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.GetEntryCount() != 2 {
+		t.Errorf("Value: %v, expected: 2", idx.GetEntryCount())
+	}
+}
@@ -0,0 +1,126 @@
+package ratecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrConcurrentWrite is returned if cells could not be read consistently
+// because the writer kept updating the rate block.
+var ErrConcurrentWrite = errors.New("Rate block is being written, no consistent read possible")
+
+// seqReadRetries is the number of attempts of a consistent read
+const seqReadRetries = 100
+
+// HasSeqCounter tells whether the rate blocks have a write counter
+// in their header, which is the case from format version 9 on.
+func (fhdr *FileHeader) HasSeqCounter() bool {
+	return fhdr.Version >= 9
+}
+
+// GetSeqCounterPos returns the position of the write counter of a rate block.
+func (fhdr *FileHeader) GetSeqCounterPos(index uint32) int64 {
+	return fhdr.GetRateBlockStart(index) + int64(fhdr.AccoCodeLength) + int64(fhdr.RoomRateCodeLength) + FixBlockHeaderSize
+}
+
+// GetBlockIndex returns the index of the rate block that contains pos.
+func (fhdr *FileHeader) GetBlockIndex(pos int64) uint32 {
+	return uint32((pos - FileHeaderSize) / int64(fhdr.GetRateBlockSize()))
+}
+
+// WriteCellsAt writes cells of rate block index at pos. The write counter
+// of the block is odd while the cells are written and even afterwards, so
+// that readers can detect that they have read a partly written block.
+// Only one writer must write to the file.
+func (fhdr *FileHeader) WriteCellsAt(f *os.File, index uint32, buf []byte, pos int64) error {
+	if !fhdr.HasSeqCounter() {
+		_, err := f.WriteAt(buf, pos)
+		return err
+	}
+	seqPos := fhdr.GetSeqCounterPos(index)
+	seqBuf := make([]byte, 4)
+	_, err := f.ReadAt(seqBuf, seqPos)
+	if err != nil {
+		return err
+	}
+	// an odd counter is left over if the writer was interrupted
+	seq := binary.BigEndian.Uint32(seqBuf) | 1
+	binary.BigEndian.PutUint32(seqBuf, seq)
+	_, err = f.WriteAt(seqBuf, seqPos)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(buf, pos)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(seqBuf, seq+1)
+	_, err = f.WriteAt(seqBuf, seqPos)
+	return err
+}
+
+// ReadCellsAt reads cells of rate block index at pos into buf. If the
+// writer updates the block meanwhile, the read is repeated. After
+// seqReadRetries attempts ErrConcurrentWrite is returned.
+func (fhdr *FileHeader) ReadCellsAt(r io.ReaderAt, index uint32, buf []byte, pos int64) error {
+	if !fhdr.HasSeqCounter() {
+		_, err := r.ReadAt(buf, pos)
+		return err
+	}
+	seqPos := fhdr.GetSeqCounterPos(index)
+	seqBuf := make([]byte, 4)
+	for i := 0; i < seqReadRetries; i++ {
+		if i > 0 {
+			time.Sleep(10 * time.Microsecond)
+		}
+		_, err := r.ReadAt(seqBuf, seqPos)
+		if err != nil {
+			return err
+		}
+		seq := binary.BigEndian.Uint32(seqBuf)
+		if seq%2 == 1 {
+			continue
+		}
+		_, err = r.ReadAt(buf, pos)
+		if err != nil {
+			return err
+		}
+		_, err = r.ReadAt(seqBuf, seqPos)
+		if err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(seqBuf) == seq {
+			return nil
+		}
+	}
+	return ErrConcurrentWrite
+}
+
+// ResetSeqCounters makes the odd write counters of an interrupted writer
+// even again. It must be called before the writer starts writing.
+func (fhdr *FileHeader) ResetSeqCounters(f *os.File) error {
+	if !fhdr.HasSeqCounter() {
+		return nil
+	}
+	seqBuf := make([]byte, 4)
+	for i := uint32(0); i < fhdr.RateBlockCount; i++ {
+		seqPos := fhdr.GetSeqCounterPos(i)
+		_, err := f.ReadAt(seqBuf, seqPos)
+		if err != nil {
+			return err
+		}
+		seq := binary.BigEndian.Uint32(seqBuf)
+		if seq%2 == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint32(seqBuf, seq+1)
+		_, err = f.WriteAt(seqBuf, seqPos)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
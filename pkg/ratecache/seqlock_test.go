@@ -0,0 +1,96 @@
+package ratecache
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newSeqTestFile(t *testing.T, fhdr *FileHeader) (*os.File, string) {
+	dir, err := ioutil.TempDir("", "seqlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename, err := InitRateFile(fhdr, dir, "seq.bin", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, filename), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbhdr, _ := NewRateBlockHeader("ALC123", "DBLSTDBRBAR")
+	rbhdr.AddOccupancyItem(18, 100, 2)
+	AddRateBlockToFile(f, CreateRateBlock(fhdr, rbhdr))
+	fhdr.RateBlockCount = 1
+	return f, dir
+}
+
+func TestWriteReadCells(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	f, dir := newSeqTestFile(t, fhdr)
+	defer os.RemoveAll(dir)
+	defer f.Close()
+	checkIn := time.Date(2022, time.December, 10, 0, 0, 0, 0, time.UTC)
+	err := fhdr.SetRateInfo(f, 0, checkIn, 2, 25500, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqBuf := make([]byte, 4)
+	f.ReadAt(seqBuf, fhdr.GetSeqCounterPos(0))
+	if binary.BigEndian.Uint32(seqBuf) != 2 {
+		t.Errorf("Value: %v, expected: 2", binary.BigEndian.Uint32(seqBuf))
+	}
+	pos, _ := fhdr.GetRatePos(0, checkIn, 2)
+	buf := make([]byte, 4)
+	err = fhdr.ReadCellsAt(f, 0, buf, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, avail := UnpackRate(buf)
+	if rate != 25500 || avail != 4 {
+		t.Errorf("Value: %v/%v, expected: 25500/4", rate, avail)
+	}
+}
+
+func TestReadCellsAtConcurrentWrite(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	f, dir := newSeqTestFile(t, fhdr)
+	defer os.RemoveAll(dir)
+	defer f.Close()
+	// a write in progress leaves the counter odd
+	seqBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(seqBuf, 3)
+	f.WriteAt(seqBuf, fhdr.GetSeqCounterPos(0))
+	buf := make([]byte, 4)
+	err := fhdr.ReadCellsAt(f, 0, buf, fhdr.GetRateBlockStart(0)+int64(fhdr.GetBlockHeaderSize()))
+	if err != ErrConcurrentWrite {
+		t.Errorf("Expected ErrConcurrentWrite, got %v", err)
+	}
+	err = fhdr.ResetSeqCounters(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fhdr.ReadCellsAt(f, 0, buf, fhdr.GetRateBlockStart(0)+int64(fhdr.GetBlockHeaderSize()))
+	if err != nil {
+		t.Errorf("Expected consistent read after reset, got %v", err)
+	}
+}
+
+func TestVersion8WithoutSeqCounter(t *testing.T) {
+	fhdr, _ := NewFileHeader("TEST", time.Date(2022, time.November, 25, 0, 0, 0, 0, time.UTC), "EUR", 14, 400, 32, 64)
+	fhdr.Version = 8
+	fhdr2, err := FileHeaderFromByteStr(fhdr.ToByteStr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fhdr2.Version != 8 || fhdr2.HasSeqCounter() {
+		t.Errorf("Version 8 header must not have a write counter")
+	}
+	if fhdr2.GetBlockHeaderSize() != 120 {
+		t.Errorf("Value: %v, expected: 120", fhdr2.GetBlockHeaderSize())
+	}
+}
@@ -0,0 +1,267 @@
+package ratecache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// TagUpdate sets the tags of an accommodation or, if RoomRateCode is
+// set, of one of its room rates. The tags replace all tags set before,
+// empty Tags remove them.
+type TagUpdate struct {
+	AccoCode     string            `json:"accoCode"`
+	RoomRateCode string            `json:"roomRateCode,omitempty"`
+	Tags         map[string]string `json:"tags"`
+}
+
+// Validate returns a message for every invalid entry of the update.
+func (update *TagUpdate) Validate() []string {
+	var msgList []string
+	if len(update.AccoCode) == 0 {
+		msgList = append(msgList, "Missing accoCode")
+	}
+	for key := range update.Tags {
+		if len(key) == 0 {
+			msgList = append(msgList, fmt.Sprintf("Empty tag name for %v %v", update.AccoCode, update.RoomRateCode))
+		}
+	}
+	return msgList
+}
+
+// TagFilter restricts a search to the room rates with tag Tag set to
+// one of Values. Tags of a room rate take precedence over tags of the
+// accommodation.
+type TagFilter struct {
+	Tag    string   `json:"tag"`
+	Values []string `json:"values"`
+}
+
+// accoTags contains the tags of an accommodation and of its room rates.
+type accoTags struct {
+	tags      map[string]string
+	roomRates map[string]map[string]string
+}
+
+// TagStore contains key/value tags per accommodation and room rate. It
+// is safe for concurrent use. Tag maps are replaced but never changed,
+// so the maps returned by the store can be used without lock.
+type TagStore struct {
+	accommodations map[string]*accoTags
+	mu             sync.RWMutex
+}
+
+// NewTagStore returns an empty tag store.
+func NewTagStore() *TagStore {
+	return &TagStore{accommodations: make(map[string]*accoTags)}
+}
+
+// Apply applies update to the store.
+func (store *TagStore) Apply(update TagUpdate) {
+	var tags map[string]string
+	if len(update.Tags) > 0 {
+		tags = make(map[string]string, len(update.Tags))
+		for key, value := range update.Tags {
+			tags[key] = value
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	acco := store.accommodations[update.AccoCode]
+	if acco == nil {
+		if tags == nil {
+			return
+		}
+		acco = &accoTags{}
+		store.accommodations[update.AccoCode] = acco
+	}
+	if len(update.RoomRateCode) == 0 {
+		acco.tags = tags
+	} else if tags != nil {
+		if acco.roomRates == nil {
+			acco.roomRates = make(map[string]map[string]string)
+		}
+		acco.roomRates[update.RoomRateCode] = tags
+	} else {
+		delete(acco.roomRates, update.RoomRateCode)
+	}
+	if acco.tags == nil && len(acco.roomRates) == 0 {
+		delete(store.accommodations, update.AccoCode)
+	}
+}
+
+// AccoTags returns the tags of an accommodation. The map must not be changed.
+func (store *TagStore) AccoTags(accoCode string) map[string]string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if acco := store.accommodations[accoCode]; acco != nil {
+		return acco.tags
+	}
+	return nil
+}
+
+// RoomRateTags returns the tags of a room rate. The map must not be changed.
+func (store *TagStore) RoomRateTags(accoCode string, roomRateCode string) map[string]string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if acco := store.accommodations[accoCode]; acco != nil {
+		return acco.roomRates[roomRateCode]
+	}
+	return nil
+}
+
+// Matches tells whether the room rate matches all filters.
+func (store *TagStore) Matches(accoCode string, roomRateCode string, filters []TagFilter) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	var accoTags, roomTags map[string]string
+	store.mu.RLock()
+	if acco := store.accommodations[accoCode]; acco != nil {
+		accoTags, roomTags = acco.tags, acco.roomRates[roomRateCode]
+	}
+	store.mu.RUnlock()
+	for _, filter := range filters {
+		value, ok := roomTags[filter.Tag]
+		if !ok {
+			value, ok = accoTags[filter.Tag]
+		}
+		if !ok {
+			return false
+		}
+		match := false
+		for _, v := range filter.Values {
+			if v == value {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// Updates returns the updates that create the current content of the
+// store, ordered by codes. If accoCode is set only the updates of this
+// accommodation are returned.
+func (store *TagStore) Updates(accoCode string) []TagUpdate {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var accoCodes []string
+	if len(accoCode) > 0 {
+		if store.accommodations[accoCode] != nil {
+			accoCodes = append(accoCodes, accoCode)
+		}
+	} else {
+		for code := range store.accommodations {
+			accoCodes = append(accoCodes, code)
+		}
+		sort.Strings(accoCodes)
+	}
+	updates := make([]TagUpdate, 0)
+	for _, code := range accoCodes {
+		acco := store.accommodations[code]
+		if acco.tags != nil {
+			updates = append(updates, TagUpdate{AccoCode: code, Tags: acco.tags})
+		}
+		var roomRateCodes []string
+		for roomRateCode := range acco.roomRates {
+			roomRateCodes = append(roomRateCodes, roomRateCode)
+		}
+		sort.Strings(roomRateCodes)
+		for _, roomRateCode := range roomRateCodes {
+			updates = append(updates, TagUpdate{AccoCode: code, RoomRateCode: roomRateCode, Tags: acco.roomRates[roomRateCode]})
+		}
+	}
+	return updates
+}
+
+// ReadTagFile applies the updates of the tag file, starting at offset,
+// to the store. The tag file contains one TagUpdate as json per line.
+// It returns the offset after the last complete line, an incomplete
+// last line is left for the next call. A missing file is not an error.
+func (store *TagStore) ReadTagFile(filename string, offset int64) (int64, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return offset, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var update TagUpdate
+		err = json.Unmarshal(line, &update)
+		if err != nil {
+			return offset, fmt.Errorf("Tag file %v at %d: %v", filename, offset-int64(len(line)), err)
+		}
+		store.Apply(update)
+	}
+}
+
+// AppendTagFile appends updates to the tag file.
+func AppendTagFile(filename string, updates []TagUpdate) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, update := range updates {
+		err := enc.Encode(update)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteTagFile replaces the tag file with the content of store, so
+// that updates overwritten later are dropped. Readers never see a
+// partly written file.
+func WriteTagFile(filename string, store *TagStore) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, update := range store.Updates("") {
+		err := enc.Encode(update)
+		if err != nil {
+			return err
+		}
+	}
+	tmpFilename := filename + ".tmp"
+	err := ioutil.WriteFile(tmpFilename, buf.Bytes(), 0644)
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
@@ -0,0 +1,88 @@
+package ratecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTagStore(t *testing.T) {
+	store := NewTagStore()
+	store.Apply(TagUpdate{AccoCode: "PMI00001", Tags: map[string]string{"channel": "B2C"}})
+	store.Apply(TagUpdate{AccoCode: "PMI00001", RoomRateCode: "DBLSTDHB01", Tags: map[string]string{"refundable": "yes"}})
+	store.Apply(TagUpdate{AccoCode: "PMI00001", RoomRateCode: "DBLSTDNR01", Tags: map[string]string{"refundable": "no", "channel": "B2B"}})
+	tests := []struct {
+		roomRateCode string
+		filters      []TagFilter
+		match        bool
+	}{
+		{"DBLSTDHB01", nil, true},
+		{"DBLSTDHB01", []TagFilter{{Tag: "refundable", Values: []string{"yes"}}}, true},
+		{"DBLSTDHB01", []TagFilter{{Tag: "refundable", Values: []string{"no"}}}, false},
+		{"DBLSTDHB01", []TagFilter{{Tag: "channel", Values: []string{"B2C"}}, {Tag: "refundable", Values: []string{"yes"}}}, true},
+		{"DBLSTDNR01", []TagFilter{{Tag: "channel", Values: []string{"B2C"}}}, false},
+		{"SGLSTDHB01", []TagFilter{{Tag: "channel", Values: []string{"B2B", "B2C"}}}, true},
+		{"SGLSTDHB01", []TagFilter{{Tag: "refundable", Values: []string{"yes"}}}, false},
+	}
+	for _, test := range tests {
+		if store.Matches("PMI00001", test.roomRateCode, test.filters) != test.match {
+			t.Errorf("Matches(%v, %v): expected %v", test.roomRateCode, test.filters, test.match)
+		}
+	}
+	store.Apply(TagUpdate{AccoCode: "PMI00001", RoomRateCode: "DBLSTDNR01"})
+	if store.RoomRateTags("PMI00001", "DBLSTDNR01") != nil {
+		t.Error("Expected tags to be removed")
+	}
+	if updates := store.Updates("PMI00001"); len(updates) != 2 {
+		t.Errorf("Unexpected updates %v", updates)
+	}
+}
+
+func TestTagFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.bin.tags")
+	store := NewTagStore()
+	offset, err := store.ReadTagFile(filename, 0)
+	if err != nil || offset != 0 {
+		t.Fatalf("Unexpected result for missing file: %d %v", offset, err)
+	}
+	err = AppendTagFile(filename, []TagUpdate{
+		{AccoCode: "PMI00001", Tags: map[string]string{"channel": "B2C"}},
+		{AccoCode: "PMI00001", RoomRateCode: "DBLSTDHB01", Tags: map[string]string{"refundable": "yes"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err = store.ReadTagFile(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AppendTagFile(filename, []TagUpdate{{AccoCode: "PMI00001", RoomRateCode: "DBLSTDHB01", Tags: map[string]string{"refundable": "no"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.ReadTagFile(filename, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.RoomRateTags("PMI00001", "DBLSTDHB01")["refundable"] != "no" || store.AccoTags("PMI00001")["channel"] != "B2C" {
+		t.Errorf("Unexpected tags %v", store.Updates(""))
+	}
+	err = WriteTagFile(filename, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewTagStore()
+	_, err = loaded.ReadTagFile(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates := loaded.Updates(""); len(updates) != 2 || updates[1].Tags["refundable"] != "no" {
+		t.Errorf("Unexpected updates after rewrite %v", updates)
+	}
+}
@@ -2,9 +2,12 @@ package wssearch
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
 )
 
 type Settings struct {
@@ -13,8 +16,31 @@ type Settings struct {
 	IndexDir      string `json:"indexDir"`
 	CacheFilename string `json:"cacheFilename"`
 	DecimalPlaces uint8  `json:"decimalPlaces"`
+	WriterUrl     string `json:"writerUrl"`
+	Replica       bool   `json:"replica"`
+	FollowIndex   bool   `json:"followIndex"`
+	RecoverIndex  bool   `json:"recoverIndex"`
+	// MaxRoomCombinations limits the combinations per accommodation
+	// of a multi-room search
+	MaxRoomCombinations int `json:"maxRoomCombinations"`
+	// CodeSchema optionally defines the fields of the codes, which can
+	// be used as filters of searches
+	CodeSchema *ratecache.CodeSchema `json:"codeSchema,omitempty"`
+	// MaxReplicaLag is the maximum time in seconds since the last
+	// successful request of the change stream for a ready replica
+	MaxReplicaLag int `json:"maxReplicaLag"`
+	// MaxIndexLag is the maximum number of rate blocks of the writer
+	// missing in the index for a ready instance with writerUrl
+	MaxIndexLag int `json:"maxIndexLag"`
 }
 
+// Defaults used if the settings are not set.
+const (
+	DefaultMaxRoomCombinations = 10
+	DefaultMaxReplicaLag       = 90
+	DefaultMaxIndexLag         = 100
+)
+
 func LoadSettings(filename string) (Settings, error) {
 	s := Settings{}
 	f, err := os.Open(filename)
@@ -26,6 +52,12 @@ func LoadSettings(filename string) (Settings, error) {
 	if err != nil {
 		return s, err
 	}
+	if s.CodeSchema != nil {
+		err = s.CodeSchema.Compile()
+		if err != nil {
+			return s, fmt.Errorf("codeSchema: %v", err)
+		}
+	}
 	return s, nil
 }
 
@@ -34,11 +66,12 @@ func LoadSettings(filename string) (Settings, error) {
 // from the cache header file.
 func CreateInitialSettings(filename string) error {
 	s := Settings{
-		Port:          2507,
-		CacheDir:      "/mnt/ratecache",
-		IndexDir:      "/opt/ratecache",
-		CacheFilename: "demo.bin",
-		DecimalPlaces: 2,
+		Port:                2507,
+		CacheDir:            "/mnt/ratecache",
+		IndexDir:            "/opt/ratecache",
+		CacheFilename:       "demo.bin",
+		DecimalPlaces:       2,
+		MaxRoomCombinations: DefaultMaxRoomCombinations,
 	}
 	jstr, err := json.MarshalIndent(s, "", "\t")
 	if err != nil {
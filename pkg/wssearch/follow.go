@@ -0,0 +1,137 @@
+package wssearch
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// IndexFollower adds the records wswrite appends to the index file to the
+// index of a search service on the same host, so that no notifications
+// are required. If the index file is truncated or replaced, e.g. after
+// wswrite -clean, cache and index are reloaded.
+type IndexFollower struct {
+	context  *HandlerContext
+	filename string
+	// records is the number of records read so far
+	records  int64
+	fileInfo os.FileInfo
+	Interval time.Duration
+}
+
+// NewIndexFollower creates a follower that starts after the
+// records already loaded into the index of context.
+func NewIndexFollower(context *HandlerContext) *IndexFollower {
+	follower := IndexFollower{
+		context:  context,
+		filename: filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx"),
+		Interval: time.Second,
+	}
+	follower.reset()
+	return &follower
+}
+
+// reset continues after the records loaded into the index.
+func (follower *IndexFollower) reset() {
+	follower.context.mu.RLock()
+	follower.records = follower.context.Idx.GetRecordCount()
+	follower.context.mu.RUnlock()
+	follower.fileInfo, _ = os.Stat(follower.filename)
+}
+
+// Follow checks the index file and the tag file for new records forever.
+func (follower *IndexFollower) Follow() {
+	for {
+		_, err := follower.Poll()
+		if err != nil {
+			log.Println(err)
+		}
+		err = follower.context.PollTags()
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(follower.Interval)
+	}
+}
+
+// reload loads cache and index again and starts over.
+func (follower *IndexFollower) reload() error {
+	log.Printf("Index file %v was truncated or replaced, reloading", follower.filename)
+	err := follower.context.Reload()
+	if err != nil {
+		return err
+	}
+	follower.reset()
+	return nil
+}
+
+// Poll reads the records appended since the last call and applies them
+// to the index. It returns the number of new records.
+func (follower *IndexFollower) Poll() (int, error) {
+	fileInfo, err := os.Stat(follower.filename)
+	if err != nil {
+		return 0, err
+	}
+	if follower.fileInfo != nil && !os.SameFile(fileInfo, follower.fileInfo) {
+		return 0, follower.reload()
+	}
+	f, err := os.Open(follower.filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	ihdr, err := ratecache.ReadIdxFileHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	follower.context.mu.RLock()
+	fhdr := *follower.context.Fhdr
+	follower.context.mu.RUnlock()
+	err = ihdr.Check(&fhdr)
+	if err != nil {
+		return 0, err
+	}
+	total, _ := ihdr.CountRecords(fileInfo.Size())
+	if total < follower.records {
+		return 0, follower.reload()
+	}
+	follower.fileInfo = fileInfo
+	count := total - follower.records
+	if count == 0 {
+		return 0, nil
+	}
+	recordSize := ihdr.RecordSize()
+	buf := make([]byte, count*recordSize)
+	_, err = f.ReadAt(buf, ihdr.RecordPos(follower.records))
+	if err != nil {
+		return 0, err
+	}
+	var entries []ratecache.IdxEntry
+	for i := int64(0); i < count; i++ {
+		rec, err := ihdr.RecordFromByteStr(buf[i*recordSize : (i+1)*recordSize])
+		if err != nil {
+			return 0, fmt.Errorf("Index record %d: %v", follower.records+i, err)
+		}
+		if !rec.Tombstone {
+			entries = append(entries, rec.Entry)
+			continue
+		}
+		// entries added before must not be removed after the tombstone
+		_, err = follower.context.AddIdxEntries(entries)
+		if err != nil {
+			return 0, err
+		}
+		entries = nil
+		follower.context.RemoveIdxEntry(rec.Entry)
+	}
+	_, err = follower.context.AddIdxEntries(entries)
+	if err != nil {
+		return 0, err
+	}
+	follower.records = total
+	return int(count), nil
+}
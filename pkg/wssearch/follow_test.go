@@ -0,0 +1,69 @@
+package wssearch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexFollower(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	context, cleanup := newSearchContext(t, writer, Settings{FollowIndex: true})
+	defer cleanup()
+	follower := NewIndexFollower(context)
+	count, err := follower.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Value: %d, expected no new records", count)
+	}
+
+	// records appended by the writer are added to the index
+	writer.importRoom(t, "ALC001", "DBLSTBB", "41.00", doubleRoom)
+	writer.importRoom(t, "ALC002", "DBLSTHB", "50.00", doubleRoom)
+	count, err = follower.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Value: %d, expected 2", count)
+	}
+	found := find(context, searchRq(writer, "ALC001", "ALC002"))
+	if len(found["ALC001"]) != 2 || len(found["ALC002"]) != 1 {
+		t.Errorf("Unexpected room rates %v", found)
+	}
+
+	// a replaced index file is loaded again together with the cache
+	idxFilename := filepath.Join(writer.dir, "test.bin.idx")
+	buf, err := ioutil.ReadFile(idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(idxFilename+".tmp", buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(idxFilename+".tmp", idxFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := context.View()
+	_, err = follower.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	view.Release()
+	reloaded := context.View()
+	reloaded.Release()
+	if reloaded.Idx == view.Idx {
+		t.Error("Expected index to be reloaded")
+	}
+	found = find(context, searchRq(writer, "ALC001", "ALC002"))
+	if len(found["ALC001"]) != 2 || len(found["ALC002"]) != 1 {
+		t.Errorf("Unexpected room rates after reload %v", found)
+	}
+}
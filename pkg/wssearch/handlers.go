@@ -1,11 +1,15 @@
 package wssearch
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/exp/mmap"
 
@@ -18,6 +22,37 @@ type HandlerContext struct {
 	Map      *mmap.ReaderAt
 	Idx      *ratecache.CacheIndex
 	Fhdr     *ratecache.FileHeader
+	// Tags contains the tags of accommodations and room rates
+	Tags    *ratecache.TagStore
+	Metrics *Metrics
+	// mu protects Map, Idx, Fhdr, Tags and users, which are replaced
+	// on reload or when the cache file has grown.
+	mu sync.RWMutex
+	// users counts the views of Map that are not released yet
+	users *sync.WaitGroup
+	// lock is the shared lock on the mapped cache file
+	lock *ratecache.FileLock
+	// reloading serializes reloads
+	reloading sync.Mutex
+	// synced is the time of the last successful request of the
+	// change stream of a replica, protected by mu
+	synced time.Time
+	// tagOffset and tagFileInfo describe the part of the tag
+	// file read so far, tagsMu serializes reading the tag file
+	tagOffset   int64
+	tagFileInfo os.FileInfo
+	tagsMu      sync.Mutex
+}
+
+// NewHandlerContext creates a new handler context for a
+// cache loaded with LoadCache.
+func NewHandlerContext(settings Settings, mp *mmap.ReaderAt, idx *ratecache.CacheIndex, fhdr *ratecache.FileHeader, lock *ratecache.FileLock) *HandlerContext {
+	context := &HandlerContext{Settings: settings, Map: mp, Idx: idx, Fhdr: fhdr, Tags: ratecache.NewTagStore(), users: &sync.WaitGroup{}, lock: lock}
+	context.Metrics = NewMetrics(context)
+	if settings.CodeSchema != nil {
+		settings.CodeSchema.AddIndex(idx)
+	}
+	return context
 }
 
 func (context *HandlerContext) FindHandler(w http.ResponseWriter, r *http.Request) {
@@ -37,35 +72,75 @@ func (context *HandlerContext) FindHandler(w http.ResponseWriter, r *http.Reques
 		log.Println(err)
 		http.Error(w, "Bad Request", 400)
 	}
+	if len(searchRq.Filters) > 0 {
+		if context.Settings.CodeSchema == nil {
+			validationMsgs = append(validationMsgs, "Filters require a code schema")
+		} else {
+			validationMsgs = append(validationMsgs, context.Settings.CodeSchema.ValidateFilters(searchRq.Filters)...)
+		}
+	}
 	if len(validationMsgs) > 0 {
+		context.Metrics.ValidationFailures.Inc("/find")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(validationMsgs)
 		return
 	}
-	idxResult := context.Idx.Find(&searchRq)
-	//fmt.Println(idxResult)
-	searchRs := context.Find(idxResult, searchRq)
+	view := context.View()
+	if len(searchRq.Filters) > 0 || len(searchRq.TagFilters) > 0 {
+		context.filterRoomRates(view, &searchRq)
+	}
+	searchRs := ratecache.SearchRs{CheckIn: searchRq.CheckIn, LengthOfStay: searchRq.LengthOfStay}
+	if len(searchRq.Accommodations) == 0 {
+		// no room rate matches the filters, an empty Find would
+		// search all room rates
+	} else if len(searchRq.Rooms) > 0 {
+		searchRs = context.FindRooms(view, searchRq)
+	} else if len(searchRq.Occupancies) > 0 {
+		searchRs = context.FindOccupancies(view, searchRq)
+	} else {
+		idxResult := view.Idx.Find(&searchRq)
+		//fmt.Println(idxResult)
+		searchRs = context.Find(view, idxResult, searchRq)
+	}
+	view.Release()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(searchRs)
 }
 
+// filterRoomRates restricts the room rates of searchRq to the ones
+// matching its code and tag filters.
+func (context *HandlerContext) filterRoomRates(view CacheView, searchRq *ratecache.SearchRq) {
+	schema, filters, tagFilters := context.Settings.CodeSchema, searchRq.Filters, searchRq.TagFilters
+	ratecache.FilterRoomRates(searchRq, view.Idx, func(accoCode string, roomRateCode string) bool {
+		if len(filters) > 0 && !schema.Matches(accoCode, roomRateCode, filters) {
+			return false
+		}
+		return view.Tags.Matches(accoCode, roomRateCode, tagFilters)
+	})
+}
+
 // AccoListHandler provides an ordered list of all accommodation codes
+// or of the codes starting with the query parameter prefix
 func (context *HandlerContext) AccoListHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		{
 			http.Error(w, "Method Not Allowed", 405)
 		}
 	}
-	codeList := context.Idx.GetAccoList()
+	view := context.View()
+	codeList := view.Idx.GetAccoListByPrefix(r.URL.Query().Get("prefix"))
+	view.Release()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(codeList)
 }
 
 // RoomListHandler provides all room rate codes and the
-// corresponding occupancies for one accommodation
+// corresponding occupancies for one accommodation. The room rate
+// codes can be restricted with the query parameters prefix and
+// pattern, see ratecache.MatchCode.
 func (context *HandlerContext) RoomListHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		{
@@ -74,27 +149,120 @@ func (context *HandlerContext) RoomListHandler(w http.ResponseWriter, r *http.Re
 	}
 	accoCode := strings.TrimPrefix(r.URL.Path, "/list/rooms/")
 	accoCode = strings.Trim(accoCode, "/")
-	rooms := context.Idx.GetAccommodation(accoCode)
+	prefix := r.URL.Query().Get("prefix")
+	pattern := r.URL.Query().Get("pattern")
+	view := context.View()
+	rooms := view.Idx.GetAccommodation(accoCode)
+	view.Release()
+	for code := range rooms {
+		if !strings.HasPrefix(code, prefix) || (len(pattern) > 0 && !ratecache.MatchCode(pattern, code)) {
+			delete(rooms, code)
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(rooms)
 }
 
-// adds an index entry to the index based on the json data
-// received in the body
+// ExportHandler exports rates and availabilities in import format,
+// see wswrite.ServeExport.
+func (context *HandlerContext) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	view := context.View()
+	defer view.Release()
+	wswrite.ServeExport(w, r, view.Map, view.Fhdr, view.Idx, context.Settings.DecimalPlaces)
+}
+
+// ReloadInfo is returned as response to a reload.
+type ReloadInfo struct {
+	AccommodationCount int     `json:"accommodationCount"`
+	RateBlockCount     uint32  `json:"rateBlockCount"`
+	ExecutionTime      float64 `json:"executionTime"`
+}
+
+// ReloadHandler loads cache file and index again without interrupting
+// searches, see Reload. Replicas manage their cache themselves and
+// cannot be reloaded.
+func (context *HandlerContext) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	if context.Settings.Replica {
+		http.Error(w, "Reload is not available in replica mode", 409)
+		return
+	}
+	execStart := time.Now()
+	err := context.Reload()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	view := context.View()
+	info := ReloadInfo{AccommodationCount: view.Idx.GetAccoCount(), RateBlockCount: view.Fhdr.RateBlockCount}
+	view.Release()
+	info.ExecutionTime = time.Since(execStart).Seconds()
+	log.Printf("Cache reloaded in %.3fs", info.ExecutionTime)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// VersionHandler provides basic information on the loaded cache
+// and the memory used, in the same format as the one of wswrite.
+func (context *HandlerContext) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	view := context.View()
+	versionInfo := wswrite.VersionInfo{Release: ratecache.Release,
+		FormatVersion:      view.Fhdr.Version,
+		CacheDate:          view.Fhdr.StartDate,
+		AccommodationCount: view.Idx.GetAccoCount(),
+		RateBlockCount:     view.Fhdr.RateBlockCount,
+		RateCount:          uint64(view.Fhdr.Days) * uint64(view.Fhdr.MaxLos) * uint64(view.Fhdr.RateBlockCount),
+		Memory:             wswrite.NewMemoryInfo(view.Idx),
+	}
+	view.Release()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(versionInfo)
+}
+
+// adds index entries to the index based on the json data
+// received in the body, either a single entry or an array
+// of entries; entries with Removed set are removed from the index
 func (context *HandlerContext) AddIndexHandler(w http.ResponseWriter, r *http.Request) {
-	var msg wswrite.NewIdxNotification
+	var msgs []wswrite.NewIdxNotification
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", 405)
+		return
 	}
 	rqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Bad Request", 400)
+		return
 	}
 	defer r.Body.Close()
-	json.Unmarshal(rqBody, &msg)
-	context.Idx.AddRoomOccIdx(msg.AccoCode, msg.RoomRateCode, msg.RoomOccIdx)
+	rqBody = bytes.TrimSpace(rqBody)
+	if len(rqBody) > 0 && rqBody[0] == '[' {
+		err = json.Unmarshal(rqBody, &msgs)
+	} else {
+		msgs = make([]wswrite.NewIdxNotification, 1)
+		err = json.Unmarshal(rqBody, &msgs[0])
+	}
+	if err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	_, err = context.ApplyIdxNotifications(msgs)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 }
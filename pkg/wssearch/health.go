@@ -0,0 +1,102 @@
+package wssearch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
+)
+
+// HealthzHandler tells that the service is running. It does not check
+// the cache, see ReadyzHandler.
+func (context *HandlerContext) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	wswrite.WriteHealthy(w)
+}
+
+// ReadyzHandler checks that the file header of the mapped cache file can
+// be read, the index is loaded and the mapping contains all rate blocks.
+// A replica must have received the change stream within MaxReplicaLag
+// seconds; an instance with writerUrl must not miss more than MaxIndexLag
+// rate blocks of the writer.
+func (context *HandlerContext) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	info := wswrite.NewReadyInfo()
+	view := context.View()
+	if view.Map == nil || view.Fhdr == nil {
+		info.Add("header", errors.New("Cache is not loaded"), "")
+	} else {
+		_, err := ratecache.ReadFileHeader(view.Map)
+		info.Add("header", err, "")
+		info.Add("mapping", view.Fhdr.CheckSize(int64(view.Map.Len())), fmt.Sprintf("%d rate blocks", view.Fhdr.RateBlockCount))
+	}
+	entryCount := 0
+	var nextIndex uint32
+	if view.Idx == nil {
+		info.Add("index", errors.New("Index is not loaded"), "")
+	} else {
+		entryCount = view.Idx.GetEntryCount()
+		nextIndex = view.Idx.GetNextIndex()
+		info.Add("index", nil, fmt.Sprintf("%d entries", entryCount))
+	}
+	view.Release()
+	if context.Settings.Replica {
+		info.Add("replica", context.checkReplicaLag(), "")
+	} else if len(context.Settings.WriterUrl) > 0 {
+		message, err := context.checkIndexLag(nextIndex)
+		info.Add("indexLag", err, message)
+	}
+	info.Write(w)
+}
+
+// checkReplicaLag returns an error if the last successful request of
+// the change stream is older than MaxReplicaLag seconds.
+func (context *HandlerContext) checkReplicaLag() error {
+	maxLag := time.Duration(context.Settings.MaxReplicaLag) * time.Second
+	if maxLag <= 0 {
+		maxLag = DefaultMaxReplicaLag * time.Second
+	}
+	context.mu.RLock()
+	synced := context.synced
+	context.mu.RUnlock()
+	if synced.IsZero() {
+		return errors.New("Change stream not received yet")
+	}
+	if lag := time.Since(synced); lag > maxLag {
+		return fmt.Errorf("Change stream last received %v ago", lag.Round(time.Second))
+	}
+	return nil
+}
+
+// checkIndexLag compares the index following the highest rate block in
+// the index with the number of rate blocks of the writer, like
+// CatchUpIndex, so removed rate blocks do not count as lag. If the writer
+// cannot be reached, the lag is unknown, which is only reported in the
+// message.
+func (context *HandlerContext) checkIndexLag(nextIndex uint32) (string, error) {
+	maxLag := context.Settings.MaxIndexLag
+	if maxLag <= 0 {
+		maxLag = DefaultMaxIndexLag
+	}
+	client := http.Client{Timeout: 2 * time.Second}
+	rsp, err := client.Get(context.Settings.WriterUrl + "/version")
+	if err != nil {
+		return "Writer not reachable, lag unknown", nil
+	}
+	defer rsp.Body.Close()
+	var versionInfo wswrite.VersionInfo
+	if rsp.StatusCode != http.StatusOK || json.NewDecoder(rsp.Body).Decode(&versionInfo) != nil {
+		return "Invalid version response of writer, lag unknown", nil
+	}
+	lag := int(versionInfo.RateBlockCount) - int(nextIndex)
+	if lag > maxLag {
+		return "", fmt.Errorf("%d rate blocks of the writer are missing in the index", lag)
+	}
+	return fmt.Sprintf("%d rate blocks behind the writer", lag), nil
+}
@@ -0,0 +1,49 @@
+package wssearch
+
+import (
+	"github.com/navegotel/openratecache/pkg/metrics"
+)
+
+// Metrics contains the metrics of the search service, which are
+// returned by the /metrics endpoint.
+type Metrics struct {
+	Registry *metrics.Registry
+	HTTP     *metrics.HTTPMetrics
+	// ValidationFailures counts rejected requests by handler
+	ValidationFailures *metrics.Counter
+}
+
+// NewMetrics creates the metrics of the search service of context.
+// Index and mapping sizes are those of the currently loaded cache.
+func NewMetrics(context *HandlerContext) *Metrics {
+	registry := metrics.NewRegistry("openratecache")
+	m := Metrics{
+		Registry:           registry,
+		HTTP:               metrics.NewHTTPMetrics(registry),
+		ValidationFailures: registry.NewCounter("validation_failures_total", "Number of requests rejected by validation.", "handler"),
+	}
+	registry.NewGaugeFunc("index_accommodations", "Number of accommodations in the index.", func() float64 {
+		return context.viewMetric(func(view CacheView) float64 { return float64(view.Idx.GetAccoCount()) })
+	})
+	registry.NewGaugeFunc("index_entries", "Number of rate blocks in the index.", func() float64 {
+		return context.viewMetric(func(view CacheView) float64 { return float64(view.Idx.GetEntryCount()) })
+	})
+	registry.NewGaugeFunc("rate_blocks", "Number of rate blocks in the cache file.", func() float64 {
+		return context.viewMetric(func(view CacheView) float64 { return float64(view.Fhdr.RateBlockCount) })
+	})
+	registry.NewGaugeFunc("mmap_bytes", "Size of the mapping of the cache file.", func() float64 {
+		return context.viewMetric(func(view CacheView) float64 { return float64(view.Map.Len()) })
+	})
+	return &m
+}
+
+// viewMetric returns f of the current view, or 0 as long as no cache
+// is loaded.
+func (context *HandlerContext) viewMetric(f func(view CacheView) float64) float64 {
+	view := context.View()
+	defer view.Release()
+	if view.Map == nil || view.Idx == nil || view.Fhdr == nil {
+		return 0
+	}
+	return f(view)
+}
@@ -0,0 +1,85 @@
+package wssearch
+
+import (
+	"sync"
+
+	"golang.org/x/exp/mmap"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// CacheView is a consistent view of the mapped cache file, the index and
+// the file header. The mapping stays open until the view is released, even
+// if the cache is reloaded in the meantime.
+type CacheView struct {
+	Map   *mmap.ReaderAt
+	Idx   *ratecache.CacheIndex
+	Fhdr  *ratecache.FileHeader
+	Tags  *ratecache.TagStore
+	users *sync.WaitGroup
+}
+
+// View returns a view of the currently loaded cache. Release
+// it as soon as it is not used anymore.
+func (context *HandlerContext) View() CacheView {
+	context.mu.RLock()
+	defer context.mu.RUnlock()
+	view := CacheView{Map: context.Map, Idx: context.Idx, Fhdr: context.Fhdr, Tags: context.Tags, users: context.users}
+	if view.users != nil {
+		view.users.Add(1)
+	}
+	return view
+}
+
+// Release releases the view.
+func (view CacheView) Release() {
+	if view.users != nil {
+		view.users.Done()
+	}
+}
+
+// swap replaces the loaded cache and parses the codes of the new
+// index if a code schema is set. The old mapping is closed and its
+// lock released once all views of it are released.
+func (context *HandlerContext) swap(mp *mmap.ReaderAt, idx *ratecache.CacheIndex, fhdr *ratecache.FileHeader, lock *ratecache.FileLock) {
+	if context.Settings.CodeSchema != nil {
+		context.Settings.CodeSchema.AddIndex(idx)
+	}
+	context.mu.Lock()
+	oldMap, oldUsers, oldLock := context.Map, context.users, context.lock
+	context.Map, context.Idx, context.Fhdr, context.lock = mp, idx, fhdr, lock
+	context.users = &sync.WaitGroup{}
+	context.mu.Unlock()
+	retire(oldMap, oldUsers, oldLock)
+}
+
+// retire closes a mapping in the background as soon as all its users
+// are done. If lock is not nil, it is released afterwards.
+func retire(mp *mmap.ReaderAt, users *sync.WaitGroup, lock *ratecache.FileLock) {
+	if mp == nil {
+		lock.Unlock()
+		return
+	}
+	go func() {
+		if users != nil {
+			users.Wait()
+		}
+		mp.Close()
+		lock.Unlock()
+	}()
+}
+
+// Reload loads the cache file and the index again, e.g. after the cache
+// was created anew, and replaces them. Loading happens while searches
+// continue on the old cache; running searches finish on the old mapping,
+// which is closed afterwards. The tags are loaded again as well.
+func (context *HandlerContext) Reload() error {
+	context.reloading.Lock()
+	defer context.reloading.Unlock()
+	mp, idx, fhdr, lock, err := LoadCache(context.Settings)
+	if err != nil {
+		return err
+	}
+	context.swap(mp, idx, fhdr, lock)
+	return context.LoadTags()
+}
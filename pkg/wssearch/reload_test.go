@@ -0,0 +1,63 @@
+package wssearch
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	context, cleanup := newSearchContext(t, writer, Settings{})
+	defer cleanup()
+	writer.importRoom(t, "ALC001", "DBLSTBB", "41.00", doubleRoom)
+	writer.importRoom(t, "ALC002", "DBLSTHB", "50.00", doubleRoom)
+
+	// searches running during the reload finish on the old cache
+	view := context.View()
+	w := httptest.NewRecorder()
+	context.ReloadHandler(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	var info ReloadInfo
+	err := json.NewDecoder(w.Body).Decode(&info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.AccommodationCount != 2 || info.RateBlockCount != 3 {
+		t.Errorf("Unexpected reload info %v", info)
+	}
+	rq := searchRq(writer, "ALC001", "ALC002")
+	if rs := context.Find(view, view.Idx.Find(&rq), rq); len(rs.Options) != 1 || len(rs.Options[0].Rooms) != 1 {
+		t.Errorf("Expected old cache to be usable until its view is released, got %v", rs.Options)
+	}
+	view.Release()
+	found := find(context, rq)
+	if len(found["ALC001"]) != 2 || len(found["ALC002"]) != 1 {
+		t.Errorf("Unexpected room rates after reload %v", found)
+	}
+
+	// if loading fails, the loaded cache is kept
+	context.Settings.CacheFilename = "missing.bin"
+	w = httptest.NewRecorder()
+	context.ReloadHandler(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status %d", w.Code)
+	}
+	found = find(context, rq)
+	if len(found["ALC001"]) != 2 || len(found["ALC002"]) != 1 {
+		t.Errorf("Unexpected room rates after failed reload %v", found)
+	}
+
+	// replicas keep their cache up to date themselves
+	context.Settings.Replica = true
+	w = httptest.NewRecorder()
+	context.ReloadHandler(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Unexpected status %d", w.Code)
+	}
+}
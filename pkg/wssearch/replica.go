@@ -0,0 +1,347 @@
+package wssearch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
+)
+
+// ReplicaState is the position of a replica in the change
+// stream of the writer. It is saved after every change set.
+type ReplicaState struct {
+	JournalID string `json:"journalId"`
+	Offset    int64  `json:"offset"`
+}
+
+// Replica keeps a local copy of the cache file and the index up to
+// date with the change stream of a wswrite instance. Searches are
+// served from the local copy.
+type Replica struct {
+	Context   *HandlerContext
+	state     ReplicaState
+	cacheFile *os.File
+	fhdr      *ratecache.FileHeader
+	pending   []ratecache.IdxEntry
+	client    *http.Client
+	lock      *ratecache.FileLock
+	// rebuilding is set while a new copy is built from the beginning of
+	// the change stream. Searches use the old copy until it is complete.
+	rebuilding bool
+}
+
+func (replica *Replica) cachePath() string {
+	return filepath.Join(replica.Context.Settings.CacheDir, replica.Context.Settings.CacheFilename)
+}
+
+func (replica *Replica) idxPath() string {
+	return filepath.Join(replica.Context.Settings.IndexDir, replica.Context.Settings.CacheFilename+".idx")
+}
+
+// newSuffix is appended to the names of cache and index file while
+// a new copy is built.
+const newSuffix = ".new"
+
+// writePaths returns the cache and index file the changes are applied to.
+func (replica *Replica) writePaths() (string, string) {
+	if replica.rebuilding {
+		return replica.cachePath() + newSuffix, replica.idxPath() + newSuffix
+	}
+	return replica.cachePath(), replica.idxPath()
+}
+
+// writeTagPath returns the tag file the tag updates are appended to.
+func (replica *Replica) writeTagPath() string {
+	if replica.rebuilding {
+		return replica.Context.tagFilename() + newSuffix
+	}
+	return replica.Context.tagFilename()
+}
+
+func (replica *Replica) statePath() string {
+	return filepath.Join(replica.Context.Settings.IndexDir, replica.Context.Settings.CacheFilename+".replica")
+}
+
+// NewReplica opens the local copy of the cache and applies all changes
+// from the writer until it is up to date. If there is no local copy yet,
+// the cache is rebuilt from the beginning of the change stream.
+func NewReplica(settings Settings) (*Replica, error) {
+	replica := Replica{Context: &HandlerContext{Settings: settings, Tags: ratecache.NewTagStore()}, client: &http.Client{Timeout: 90 * time.Second}}
+	replica.Context.Metrics = NewMetrics(replica.Context)
+	var err error
+	// the replica is the only writer of its copy
+	replica.lock, err = ratecache.LockWriter(filepath.Join(settings.IndexDir, settings.CacheFilename+".lock"))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(replica.statePath())
+	if err == nil {
+		json.Unmarshal(buf, &replica.state)
+	}
+	_, err = os.Stat(replica.cachePath())
+	if err == nil && len(replica.state.JournalID) > 0 {
+		err = replica.open()
+		if err != nil {
+			log.Printf("Could not open local copy, rebuilding it: %v", err)
+			replica.state = ReplicaState{}
+		}
+	} else {
+		replica.state = ReplicaState{}
+	}
+	for {
+		count, err := replica.Poll(0)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			break
+		}
+	}
+	if replica.Context.Map == nil {
+		return nil, errors.New("No cache received from writer, is the change stream enabled?")
+	}
+	return &replica, nil
+}
+
+// open opens the local copy of the cache for writing and
+// loads it for searching.
+func (replica *Replica) open() error {
+	var err error
+	replica.cacheFile, err = os.OpenFile(replica.cachePath(), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	mp, idx, fhdr, lock, err := LoadCache(replica.Context.Settings)
+	if err != nil {
+		return err
+	}
+	fhdrCopy := *fhdr
+	replica.fhdr = &fhdrCopy
+	replica.Context.swap(mp, idx, fhdr, lock)
+	return replica.Context.LoadTags()
+}
+
+// Follow polls the change stream of the writer forever.
+func (replica *Replica) Follow() {
+	for {
+		_, err := replica.Poll(30)
+		if err != nil {
+			log.Println(err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// Poll requests the next change set from the writer, waiting up to wait
+// seconds for new changes, and applies it to the local copy. It returns
+// the number of applied records.
+func (replica *Replica) Poll(wait int) (int, error) {
+	url := fmt.Sprintf("%v/changes?journalId=%v&offset=%d&wait=%d", replica.Context.Settings.WriterUrl, replica.state.JournalID, replica.state.Offset, wait)
+	rsp, err := replica.client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusConflict {
+		log.Printf("Journal %v of writer has changed, rebuilding cache", replica.state.JournalID)
+		replica.state = ReplicaState{}
+		// nothing is applied to the copy in use any more
+		if replica.cacheFile != nil {
+			replica.cacheFile.Close()
+			replica.cacheFile = nil
+		}
+		return 1, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Change stream request failed: %v", rsp.Status)
+	}
+	var changeSet wswrite.ChangeSet
+	err = json.NewDecoder(rsp.Body).Decode(&changeSet)
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range changeSet.Records {
+		err = replica.apply(rec)
+		if err != nil {
+			return 0, err
+		}
+	}
+	replica.Context.mu.Lock()
+	replica.Context.synced = time.Now()
+	replica.Context.mu.Unlock()
+	if len(changeSet.Records) == 0 {
+		return 0, nil
+	}
+	replica.state = ReplicaState{JournalID: changeSet.JournalID, Offset: changeSet.Next}
+	if replica.rebuilding {
+		if changeSet.Next < changeSet.Head {
+			// the state is only saved once the new copy is complete
+			return len(changeSet.Records), nil
+		}
+		err = replica.finishRebuild()
+	} else {
+		err = replica.refresh()
+	}
+	if err != nil {
+		return 0, err
+	}
+	jsonStr, _ := json.Marshal(replica.state)
+	err = ioutil.WriteFile(replica.statePath(), jsonStr, 0644)
+	return len(changeSet.Records), err
+}
+
+// apply applies one journal record to the local copy of the cache. Records
+// may be applied more than once, e.g. after a crash before the state was
+// saved.
+func (replica *Replica) apply(rec ratecache.JournalRecord) error {
+	switch rec.Type {
+	case ratecache.JournalInit:
+		fhdr, err := ratecache.FileHeaderFromByteStr(rec.Data)
+		if err != nil {
+			return err
+		}
+		// the copy in use stays mapped until the new one is complete
+		if replica.cacheFile != nil {
+			replica.cacheFile.Close()
+		}
+		replica.rebuilding = true
+		replica.pending = nil
+		err = os.Remove(replica.writeTagPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		cachePath, idxPath := replica.writePaths()
+		_, err = ratecache.InitRateFile(fhdr, replica.Context.Settings.CacheDir, filepath.Base(cachePath), int(rec.Index))
+		if err != nil {
+			return err
+		}
+		err = ratecache.NewCacheIndex().Save(fhdr, idxPath)
+		if err != nil {
+			return err
+		}
+		replica.cacheFile, err = os.OpenFile(cachePath, os.O_RDWR, 0644)
+		replica.fhdr = fhdr
+		return err
+	case ratecache.JournalBlock:
+		if replica.cacheFile == nil {
+			return errors.New("Received rate block before cache was initialized")
+		}
+		if rec.Index < replica.fhdr.RateBlockCount {
+			// block has already been applied, its cells may have
+			// changed since
+			return nil
+		}
+		block := make([]byte, replica.fhdr.GetRateBlockSize())
+		copy(block, rec.Data)
+		_, err := replica.cacheFile.WriteAt(block, replica.fhdr.GetRateBlockStart(rec.Index))
+		if err != nil {
+			return err
+		}
+		replica.fhdr.RateBlockCount = rec.Index + 1
+		countBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(countBuf, replica.fhdr.RateBlockCount)
+		_, err = replica.cacheFile.WriteAt(countBuf, 33)
+		if err != nil {
+			return err
+		}
+		entry := ratecache.IdxEntryFromBlockHeader(rec.Data, replica.fhdr.AccoCodeLength, replica.fhdr.RoomRateCodeLength, rec.Index)
+		replica.pending = append(replica.pending, entry)
+		_, idxPath := replica.writePaths()
+		return entry.RoomOccIdx.AppendToIdxFile(*replica.fhdr, idxPath, entry.AccoCode, entry.RoomRateCode)
+	case ratecache.JournalCells:
+		if replica.cacheFile == nil {
+			return errors.New("Received cells before cache was initialized")
+		}
+		return replica.fhdr.WriteCellsAt(replica.cacheFile, replica.fhdr.GetBlockIndex(rec.Pos), rec.Data, rec.Pos)
+	case ratecache.JournalRemove:
+		if replica.cacheFile == nil {
+			return errors.New("Received removal before cache was initialized")
+		}
+		hdrBuf := make([]byte, replica.fhdr.GetBlockHeaderSize())
+		_, err := replica.cacheFile.ReadAt(hdrBuf, replica.fhdr.GetRateBlockStart(rec.Index))
+		if err != nil {
+			return err
+		}
+		entry := ratecache.IdxEntryFromBlockHeader(hdrBuf, replica.fhdr.AccoCodeLength, replica.fhdr.RoomRateCodeLength, rec.Index)
+		_, idxPath := replica.writePaths()
+		err = ratecache.AppendIdxRecord(replica.fhdr, idxPath, ratecache.IdxRecord{Entry: entry, Tombstone: true})
+		if err != nil {
+			return err
+		}
+		for i, pending := range replica.pending {
+			if pending.RoomOccIdx.Idx == rec.Index {
+				replica.pending = append(replica.pending[:i], replica.pending[i+1:]...)
+				break
+			}
+		}
+		if !replica.rebuilding {
+			replica.Context.RemoveIdxEntry(entry)
+		}
+		return nil
+	case ratecache.JournalTags:
+		var updates []ratecache.TagUpdate
+		err := json.Unmarshal(rec.Data, &updates)
+		if err != nil {
+			return err
+		}
+		err = ratecache.AppendTagFile(replica.writeTagPath(), updates)
+		if err != nil || replica.rebuilding {
+			// the tags of a new copy are loaded once it is complete
+			return err
+		}
+		replica.Context.mu.RLock()
+		tags := replica.Context.Tags
+		replica.Context.mu.RUnlock()
+		for _, update := range updates {
+			tags.Apply(update)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown journal record type %d", rec.Type)
+}
+
+// finishRebuild replaces the copy in use with the new copy. Searches
+// still running on the old copy finish on its mapping, see swap.
+func (replica *Replica) finishRebuild() error {
+	replica.cacheFile.Close()
+	replica.cacheFile = nil
+	replica.rebuilding = false
+	replica.pending = nil
+	err := os.Rename(replica.cachePath()+newSuffix, replica.cachePath())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(replica.idxPath()+newSuffix, replica.idxPath())
+	if err != nil {
+		return err
+	}
+	tagPath := replica.Context.tagFilename()
+	err = os.Rename(tagPath+newSuffix, tagPath)
+	if os.IsNotExist(err) {
+		// the new copy has no tags
+		err = os.Remove(tagPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return replica.open()
+}
+
+// refresh makes new rate blocks available for searches.
+func (replica *Replica) refresh() error {
+	_, err := replica.Context.AddIdxEntries(replica.pending)
+	replica.pending = nil
+	return err
+}
@@ -0,0 +1,211 @@
+package wssearch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
+)
+
+// newReplicaSettings returns the settings of a replica of writer in a
+// temporary directory and a function that removes the directory.
+func newReplicaSettings(t *testing.T, writer *testWriter) (Settings, func()) {
+	dir, err := ioutil.TempDir("", "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := Settings{CacheDir: dir, IndexDir: dir, CacheFilename: "test.bin", DecimalPlaces: 2, WriterUrl: writer.server.URL, Replica: true}
+	return settings, func() { os.RemoveAll(dir) }
+}
+
+// pollAll polls until the replica has applied all changes of the writer.
+func pollAll(t *testing.T, replica *Replica) {
+	for {
+		count, err := replica.Poll(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			return
+		}
+	}
+}
+
+func TestReplica(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	settings, cleanup := newReplicaSettings(t, writer)
+	defer cleanup()
+	replica, err := NewReplica(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.lock.Unlock()
+	if found := find(replica.Context, searchRq(writer, "ALC001")); len(found["ALC001"]) != 1 {
+		t.Fatalf("Expected one room rate, got %v", found)
+	}
+
+	// new rate blocks are available after the next poll
+	writer.importRoom(t, "ALC001", "DBLSTBB", "41.00", doubleRoom)
+	count, err := replica.Poll(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Error("Expected changes")
+	}
+	if found := find(replica.Context, searchRq(writer, "ALC001")); len(found["ALC001"]) != 2 {
+		t.Errorf("Expected two room rates, got %v", found)
+	}
+
+	// a rate block that has already been applied is not written again
+	err = replica.apply(ratecache.JournalRecord{Type: ratecache.JournalBlock, Index: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := find(replica.Context, searchRq(writer, "ALC001")); len(found["ALC001"]) != 2 {
+		t.Errorf("Expected two room rates, got %v", found)
+	}
+
+	// after the journal was created anew, the copy is rebuilt while
+	// searches continue on the old copy
+	view := replica.Context.View()
+	err = writer.context.ResetJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.importRoom(t, "ALC002", "DBLSTHB", "50.00", doubleRoom)
+	pollAll(t, replica)
+	rq := searchRq(writer, "ALC001")
+	if len(replica.Context.Find(view, view.Idx.Find(&rq), rq).Options[0].Rooms) != 2 {
+		t.Error("Expected old copy to be usable until its view is released")
+	}
+	view.Release()
+	found := find(replica.Context, searchRq(writer, "ALC001", "ALC002"))
+	if len(found["ALC001"]) != 2 || len(found["ALC002"]) != 1 {
+		t.Errorf("Expected room rates of rebuilt copy, got %v", found)
+	}
+	if _, err = os.Stat(replica.cachePath() + newSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected new copy to be renamed, got %v", err)
+	}
+	if replica.state.JournalID != writer.context.Journal.ID() {
+		t.Errorf("Expected journal %v, got %v", writer.context.Journal.ID(), replica.state.JournalID)
+	}
+}
+
+// postTags sets tags on the writer.
+func (writer *testWriter) postTags(t *testing.T, body string) {
+	rsp, err := http.Post(writer.server.URL+"/tags", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Tag update failed: %v", rsp.Status)
+	}
+}
+
+func TestReplicaTags(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	writer.postTags(t, `[{"accoCode":"ALC001","tags":{"channel":"B2B"}}]`)
+	settings, cleanup := newReplicaSettings(t, writer)
+	defer cleanup()
+	replica, err := NewReplica(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accoTags := func() string {
+		view := replica.Context.View()
+		defer view.Release()
+		return view.Tags.AccoTags("ALC001")["channel"]
+	}
+	if accoTags() != "B2B" {
+		t.Fatalf("Value: %v, expected: B2B", accoTags())
+	}
+
+	// tag updates arrive with the change stream
+	writer.postTags(t, `[{"accoCode":"ALC001","tags":{"channel":"B2C"}}]`)
+	_, err = replica.Poll(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accoTags() != "B2C" {
+		t.Errorf("Value: %v, expected: B2C", accoTags())
+	}
+
+	// the rebuilt copy gets all tags from the new journal
+	err = writer.context.ResetJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.postTags(t, `[{"accoCode":"ALC002","tags":{"channel":"B2B"}}]`)
+	pollAll(t, replica)
+	if accoTags() != "B2C" {
+		t.Errorf("Value: %v, expected: B2C", accoTags())
+	}
+
+	// a restarted replica loads the tags of its copy
+	replica.lock.Unlock()
+	replica, err = NewReplica(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.lock.Unlock()
+	if accoTags() != "B2C" || replica.Context.Tags.AccoTags("ALC002")["channel"] != "B2B" {
+		t.Errorf("Unexpected tags after restart: %v", replica.Context.Tags.Updates(""))
+	}
+}
+
+func TestReplicaRemove(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	writer.importRoom(t, "ALC001", "DBLSTBB", "41.00", doubleRoom)
+	settings, cleanup := newReplicaSettings(t, writer)
+	defer cleanup()
+	replica, err := NewReplica(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := func() []string {
+		return find(replica.Context, searchRq(writer, "ALC001"))["ALC001"]
+	}
+
+	// removals arrive with the change stream
+	_, err = wswrite.Remove(writer.context, []byte(`{"accommodationCode":"ALC001","roomRateCode":"DBLSTBB"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollAll(t, replica)
+	if rooms := found(); len(rooms) != 1 || rooms[0] != "DBLSTHB" {
+		t.Errorf("Value: %v, expected: [DBLSTHB]", rooms)
+	}
+
+	// the rebuilt copy does not contain the removed rate block
+	err = writer.context.ResetJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollAll(t, replica)
+	if rooms := found(); len(rooms) != 1 {
+		t.Errorf("Value: %v, expected: [DBLSTHB]", rooms)
+	}
+
+	// a restarted replica loads the tombstone from its index file
+	replica.lock.Unlock()
+	replica, err = NewReplica(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.lock.Unlock()
+	if rooms := found(); len(rooms) != 1 {
+		t.Errorf("Value: %v, expected: [DBLSTHB]", rooms)
+	}
+}
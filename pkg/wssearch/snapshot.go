@@ -0,0 +1,161 @@
+package wssearch
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
+)
+
+// snapshotStallTimeout is the maximum time without data from the writer
+// while a snapshot is downloaded.
+const snapshotStallTimeout = 60 * time.Second
+
+// stallReader resets timer whenever data is read.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (r stallReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(snapshotStallTimeout)
+	}
+	return n, err
+}
+
+// FetchSnapshot downloads a snapshot from url, e.g. the /snapshot endpoint
+// of wswrite, and verifies it against its manifest. Only then the cache
+// file and the index file in CacheDir and IndexDir are replaced. The tag
+// file is replaced as well, or removed if the snapshot has none, so that
+// no tags of an earlier copy remain. If the
+// snapshot contains a journal position, it is saved as replica state, so
+// that a replica continues with the changes after the snapshot.
+func FetchSnapshot(settings Settings, url string) (wswrite.SnapshotManifest, error) {
+	var manifest wswrite.SnapshotManifest
+	targets := map[string]string{
+		wswrite.SnapshotCacheFile: filepath.Join(settings.CacheDir, settings.CacheFilename),
+		wswrite.SnapshotIndexFile: filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"),
+		wswrite.SnapshotTagFile:   filepath.Join(settings.IndexDir, settings.CacheFilename+".tags"),
+	}
+	received := make(map[string]wswrite.SnapshotFile)
+	lock, err := ratecache.LockWriter(filepath.Join(settings.IndexDir, settings.CacheFilename+".lock"))
+	if err != nil {
+		return manifest, err
+	}
+	defer lock.Unlock()
+	defer func() {
+		for _, target := range targets {
+			os.Remove(target + ".snapshot")
+		}
+	}()
+	// large snapshots take long, so the download is only canceled if
+	// no data is received for snapshotStallTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return manifest, err
+	}
+	client := http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		ResponseHeaderTimeout: snapshotStallTimeout,
+	}}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return manifest, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return manifest, fmt.Errorf("Snapshot request failed: %v", rsp.Status)
+	}
+	timer := time.AfterFunc(snapshotStallTimeout, cancel)
+	defer timer.Stop()
+	tr := tar.NewReader(stallReader{rsp.Body, timer})
+	manifestFound := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+		if hdr.Name == wswrite.SnapshotManifestFile {
+			err = json.NewDecoder(tr).Decode(&manifest)
+			if err != nil {
+				return manifest, err
+			}
+			manifestFound = true
+			continue
+		}
+		target, ok := targets[hdr.Name]
+		if !ok {
+			continue
+		}
+		f, err := os.Create(target + ".snapshot")
+		if err != nil {
+			return manifest, err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(f, hash), tr)
+		f.Close()
+		if err != nil {
+			return manifest, err
+		}
+		received[hdr.Name] = wswrite.SnapshotFile{Name: hdr.Name, Size: size, Sha256: hex.EncodeToString(hash.Sum(nil))}
+	}
+	if !manifestFound {
+		return manifest, errors.New("Snapshot has no manifest")
+	}
+	for name := range targets {
+		// snapshots of older writers have no tag file
+		if _, ok := received[name]; !ok && name != wswrite.SnapshotTagFile {
+			return manifest, fmt.Errorf("Snapshot does not contain %v", name)
+		}
+	}
+	for _, file := range manifest.Files {
+		if received[file.Name] != file {
+			return manifest, fmt.Errorf("Size or checksum of %v does not match manifest", file.Name)
+		}
+	}
+	err = wswrite.CheckSnapshotFiles(manifest, targets[wswrite.SnapshotCacheFile]+".snapshot", targets[wswrite.SnapshotIndexFile]+".snapshot")
+	if err != nil {
+		return manifest, err
+	}
+	for name, target := range targets {
+		if _, ok := received[name]; !ok {
+			err = os.Remove(target)
+			if err != nil && !os.IsNotExist(err) {
+				return manifest, err
+			}
+			continue
+		}
+		err = os.Rename(target+".snapshot", target)
+		if err != nil {
+			return manifest, err
+		}
+	}
+	statePath := filepath.Join(settings.IndexDir, settings.CacheFilename+".replica")
+	if len(manifest.JournalID) == 0 {
+		os.Remove(statePath)
+		return manifest, nil
+	}
+	jsonStr, _ := json.Marshal(ReplicaState{JournalID: manifest.JournalID, Offset: manifest.JournalOffset})
+	return manifest, ioutil.WriteFile(statePath, jsonStr, 0644)
+}
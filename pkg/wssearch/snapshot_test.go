@@ -0,0 +1,50 @@
+package wssearch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchSnapshot(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	writer.postTags(t, `[{"accoCode":"ALC001","tags":{"channel":"B2B"}}]`)
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	settings := Settings{CacheDir: dir, IndexDir: dir, CacheFilename: "test.bin", DecimalPlaces: 2}
+	// tags of an earlier copy are replaced
+	err = ioutil.WriteFile(filepath.Join(dir, "test.bin.tags"), []byte(`{"accoCode":"ALC002","tags":{"channel":"B2C"}}`+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := FetchSnapshot(settings, writer.server.URL+"/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.RateBlockCount != 1 || manifest.JournalID != writer.context.Journal.ID() {
+		t.Errorf("Unexpected manifest %v", manifest)
+	}
+	mp, idx, fhdr, lock, err := LoadCache(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := NewHandlerContext(settings, mp, idx, fhdr, lock)
+	if found := find(context, searchRq(writer, "ALC001")); len(found["ALC001"]) != 1 {
+		t.Errorf("Expected one room rate, got %v", found)
+	}
+	err = context.LoadTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.Tags.AccoTags("ALC001")["channel"] != "B2B" || len(context.Tags.AccoTags("ALC002")) != 0 {
+		t.Errorf("Unexpected tags %v", context.Tags.Updates(""))
+	}
+	mp.Close()
+	lock.Unlock()
+}
@@ -0,0 +1,81 @@
+package wssearch
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+func (context *HandlerContext) tagFilename() string {
+	return filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".tags")
+}
+
+// setTags replaces the tags used by searches.
+func (context *HandlerContext) setTags(tags *ratecache.TagStore) {
+	context.mu.Lock()
+	context.Tags = tags
+	context.mu.Unlock()
+}
+
+// LoadTags loads the tag file written by wswrite from the index
+// directory. A missing tag file results in no tags.
+func (context *HandlerContext) LoadTags() error {
+	context.tagsMu.Lock()
+	defer context.tagsMu.Unlock()
+	return context.loadTags()
+}
+
+func (context *HandlerContext) loadTags() error {
+	tags := ratecache.NewTagStore()
+	fileInfo, _ := os.Stat(context.tagFilename())
+	offset, err := tags.ReadTagFile(context.tagFilename(), 0)
+	if err != nil {
+		return err
+	}
+	context.tagOffset, context.tagFileInfo = offset, fileInfo
+	context.setTags(tags)
+	return nil
+}
+
+// PollTags applies the updates appended to the tag file since it was
+// read last. If the file was replaced or truncated, e.g. because wswrite
+// was started again, it is loaded again.
+func (context *HandlerContext) PollTags() error {
+	context.tagsMu.Lock()
+	defer context.tagsMu.Unlock()
+	fileInfo, err := os.Stat(context.tagFilename())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if context.tagFileInfo == nil || !os.SameFile(fileInfo, context.tagFileInfo) || fileInfo.Size() < context.tagOffset {
+		return context.loadTags()
+	}
+	if fileInfo.Size() == context.tagOffset {
+		return nil
+	}
+	context.mu.RLock()
+	tags := context.Tags
+	context.mu.RUnlock()
+	context.tagOffset, err = tags.ReadTagFile(context.tagFilename(), context.tagOffset)
+	context.tagFileInfo = fileInfo
+	return err
+}
+
+// FollowTags applies the updates wswrite appends to the tag file forever.
+// It is used by instances that do not follow the index file, which
+// polls the tag file as well.
+func (context *HandlerContext) FollowTags(interval time.Duration) {
+	for {
+		err := context.PollTags()
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -1,51 +1,244 @@
 package wssearch
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"math"
+	"net/http"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"golang.org/x/exp/mmap"
 
 	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
 )
 
-func LoadCache(settings Settings) (*mmap.ReaderAt, *ratecache.CacheIndex, *ratecache.FileHeader, error) {
+// LoadCache maps the cache file and loads the index. A shared lock on the
+// cache file is held as long as the returned lock is not released, so that
+// maintenance tools can tell whether the cache is in use.
+func LoadCache(settings Settings) (*mmap.ReaderAt, *ratecache.CacheIndex, *ratecache.FileHeader, *ratecache.FileLock, error) {
 	var mp *mmap.ReaderAt
 	var err error
 	var fhdr *ratecache.FileHeader
 	idx := ratecache.NewCacheIndex()
-	mp, err = mmap.Open(filepath.Join(settings.CacheDir, settings.CacheFilename))
+	cacheFilename := filepath.Join(settings.CacheDir, settings.CacheFilename)
+	lock, err := ratecache.LockFile(cacheFilename, false)
+	if err == ratecache.ErrLocked {
+		return mp, idx, fhdr, nil, fmt.Errorf("%v is locked for maintenance", cacheFilename)
+	}
+	if err != nil {
+		return mp, idx, fhdr, nil, err
+	}
+	mp, err = mmap.Open(cacheFilename)
 	if err != nil {
-		return mp, idx, fhdr, err
+		lock.Unlock()
+		return mp, idx, fhdr, nil, err
 	}
 	hdrBuf := make([]byte, ratecache.FileHeaderSize)
 	mp.ReadAt(hdrBuf, 0)
 	fhdr, err = ratecache.FileHeaderFromByteStr(hdrBuf)
 	if err != nil {
-		return mp, idx, fhdr, err
+		mp.Close()
+		lock.Unlock()
+		return nil, idx, fhdr, nil, err
+	}
+	if settings.RecoverIndex {
+		idx, err = recoverIndex(settings)
+	} else {
+		err = idx.Load(fhdr, filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"))
 	}
-	err = idx.Load(fhdr, filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"))
 	if err != nil {
-		return mp, idx, fhdr, err
+		mp.Close()
+		lock.Unlock()
+		return nil, idx, fhdr, nil, err
 	}
-	return mp, idx, fhdr, err
+	return mp, idx, fhdr, lock, err
 }
 
-func (context HandlerContext) Find(idxResults []ratecache.IdxResult, searchRq ratecache.SearchRq) ratecache.SearchRs {
+// recoverIndex rebuilds the index from the rate block headers of the
+// cache file. If the index file is missing, corrupt or differs from the
+// rebuilt index, the rebuilt index is used. It is only written to the
+// index file if no writer holds the writer lock.
+func recoverIndex(settings Settings) (*ratecache.CacheIndex, error) {
+	idxFilename := filepath.Join(settings.IndexDir, settings.CacheFilename+".idx")
+	result, err := ratecache.RebuildIndex(filepath.Join(settings.CacheDir, settings.CacheFilename), idxFilename)
+	if err != nil {
+		return nil, err
+	}
+	if result.Diff.IsEmpty() {
+		return result.Loaded, nil
+	}
+	log.Printf("Index file %v does not match cache file, %v", idxFilename, &result.Diff)
+	lock, err := ratecache.LockWriter(filepath.Join(settings.IndexDir, settings.CacheFilename+".lock"))
+	if err != nil {
+		log.Printf("Using rebuilt index without writing it: %v", err)
+		return result.Rebuilt, nil
+	}
+	defer lock.Unlock()
+	log.Printf("Writing rebuilt index")
+	return result.Rebuilt, ratecache.WriteIndexFile(result.Rebuilt, result.Header, idxFilename)
+}
+
+// AddIdxEntries adds the entries of new rate blocks to the index and makes
+// the rate blocks available for searches. The cache file is mapped again
+// if the blocks are beyond the current mapping. It returns the number of
+// entries that were not in the index yet.
+func (context *HandlerContext) AddIdxEntries(entries []ratecache.IdxEntry) (int, error) {
+	context.mu.RLock()
+	fhdr := *context.Fhdr
+	mapLen := int64(context.Map.Len())
+	context.mu.RUnlock()
+	for _, entry := range entries {
+		if entry.RoomOccIdx.Idx >= fhdr.RateBlockCount {
+			fhdr.RateBlockCount = entry.RoomOccIdx.Idx + 1
+		}
+	}
+	if context.Settings.CodeSchema != nil {
+		context.Settings.CodeSchema.AddEntries(entries)
+	}
+	var mp *mmap.ReaderAt
+	var err error
+	if fhdr.GetRateBlockStart(fhdr.RateBlockCount) > mapLen {
+		mp, err = mmap.Open(filepath.Join(context.Settings.CacheDir, context.Settings.CacheFilename))
+		if err != nil {
+			return 0, err
+		}
+		if fhdr.GetRateBlockStart(fhdr.RateBlockCount) > int64(mp.Len()) {
+			mp.Close()
+			return 0, errors.New("Index entry points beyond the end of the cache file")
+		}
+	}
+	added := 0
+	context.mu.Lock()
+	oldMap, oldUsers := context.Map, context.users
+	if mp != nil {
+		context.Map = mp
+		context.users = &sync.WaitGroup{}
+	}
+	if fhdr.RateBlockCount > context.Fhdr.RateBlockCount {
+		context.Fhdr = &fhdr
+	}
+	for _, entry := range entries {
+		if context.Idx.AddRoomOccIdxIfNew(entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx) {
+			added++
+		}
+	}
+	context.mu.Unlock()
+	if mp != nil {
+		retire(oldMap, oldUsers, nil)
+	}
+	return added, nil
+}
+
+// RemoveIdxEntry removes the entry of a rate block from the index, so
+// that the rate block is not found any more.
+func (context *HandlerContext) RemoveIdxEntry(entry ratecache.IdxEntry) bool {
+	context.mu.RLock()
+	defer context.mu.RUnlock()
+	return context.Idx.RemoveRoomOccIdx(entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx.Idx)
+}
+
+// ApplyIdxNotifications adds the entries of msgs to the index and then
+// removes the entries of rate blocks with Removed set, which are never
+// added. It returns the number of added entries.
+func (context *HandlerContext) ApplyIdxNotifications(msgs []wswrite.NewIdxNotification) (int, error) {
+	entries := make([]ratecache.IdxEntry, 0, len(msgs))
+	var removed []ratecache.IdxEntry
+	for _, msg := range msgs {
+		entry := ratecache.IdxEntry{AccoCode: msg.AccoCode, RoomRateCode: msg.RoomRateCode, RoomOccIdx: msg.RoomOccIdx}
+		if msg.Removed {
+			removed = append(removed, entry)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	added, err := context.AddIdxEntries(entries)
+	if err != nil {
+		return added, err
+	}
+	for _, entry := range removed {
+		context.RemoveIdxEntry(entry)
+	}
+	return added, nil
+}
+
+// CatchUpIndex requests the index entries of all rate blocks after the
+// highest rate block in the index from the writer and adds them to the
+// index, except those of removed rate blocks. Entries are requested in
+// pages of wswrite.MaxIndexEntries. It returns the number of added
+// entries.
+func CatchUpIndex(context *HandlerContext) (int, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	from := context.Idx.GetNextIndex()
+	added := 0
+	for {
+		indexEntries, err := fetchIndexEntries(&client, context.Settings.WriterUrl, from)
+		if err != nil {
+			return added, err
+		}
+		count, err := context.ApplyIdxNotifications(indexEntries.Entries)
+		added += count
+		if err != nil {
+			return added, err
+		}
+		if indexEntries.Next >= indexEntries.RateBlockCount || indexEntries.Next <= from {
+			return added, nil
+		}
+		from = indexEntries.Next
+	}
+}
+
+// fetchIndexEntries requests one page of index entries from the writer.
+func fetchIndexEntries(client *http.Client, writerUrl string, from uint32) (wswrite.IndexEntries, error) {
+	var indexEntries wswrite.IndexEntries
+	rsp, err := client.Get(fmt.Sprintf("%v/indexentries?from=%d&limit=%d", writerUrl, from, wswrite.MaxIndexEntries))
+	if err != nil {
+		return indexEntries, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return indexEntries, fmt.Errorf("Index entries request failed: %v", rsp.Status)
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&indexEntries)
+	return indexEntries, err
+}
+
+// Find reads rates and availabilities of the rate blocks in idxResults
+// from the cache file of view. Of several matching occupancies of a
+// room rate the cheapest available one is returned.
+func (context *HandlerContext) Find(view CacheView, idxResults []ratecache.IdxResult, searchRq ratecache.SearchRq) ratecache.SearchRs {
 	searchRs := ratecache.SearchRs{CheckIn: searchRq.CheckIn, LengthOfStay: searchRq.LengthOfStay}
 	for _, idxResult := range idxResults {
 		accoOption := ratecache.SearchRsAccoOption{AccoCode: idxResult.AccoCode}
+		if context.Settings.CodeSchema != nil {
+			accoOption.Fields = context.Settings.CodeSchema.AccoCode.Parse(idxResult.AccoCode)
+		}
+		if searchRq.IncludeTags {
+			accoOption.Tags = view.Tags.AccoTags(idxResult.AccoCode)
+		}
 		for _, room := range idxResult.Rooms {
 			roomOption := ratecache.SearchRsRoomOption{RoomRateCode: room.RoomRateCode}
-			rate, avail, err := context.Fhdr.GetRateInfoFromMap(*context.Map, room.Index, time.Time(searchRq.CheckIn), searchRq.LengthOfStay)
-			if err != nil {
-				log.Print(err)
+			if context.Settings.CodeSchema != nil {
+				roomOption.Fields = context.Settings.CodeSchema.RoomRateCode.Parse(room.RoomRateCode)
+			}
+			if searchRq.IncludeTags {
+				roomOption.Tags = view.Tags.RoomRateTags(idxResult.AccoCode, room.RoomRateCode)
 			}
-			if avail > 0 && rate > 0 {
-				roomOption.Rate = float64(rate) / math.Pow10(int(context.Settings.DecimalPlaces))
-				roomOption.Availability = avail
+			for _, index := range append([]uint32{room.Index}, room.Alternatives...) {
+				rate, avail, err := view.Fhdr.GetRateInfoFromMap(*view.Map, index, time.Time(searchRq.CheckIn), searchRq.LengthOfStay)
+				if err != nil {
+					log.Print(err)
+				}
+				if avail > 0 && rate > 0 && (roomOption.Availability == 0 || rate < roomOption.RateMinorUnits) {
+					roomOption.Rate = ratecache.NewDecimal(int64(rate), context.Settings.DecimalPlaces)
+					roomOption.RateMinorUnits = rate
+					roomOption.Availability = avail
+				}
+			}
+			if roomOption.Availability > 0 {
 				accoOption.Rooms = append(accoOption.Rooms, roomOption)
 			}
 		}
@@ -53,3 +246,46 @@ func (context HandlerContext) Find(idxResults []ratecache.IdxResult, searchRq ra
 	}
 	return searchRs
 }
+
+// FindOccupancies searches all occupancies of the request in one pass
+// over the index and returns the options per occupancy.
+func (context *HandlerContext) FindOccupancies(view CacheView, searchRq ratecache.SearchRq) ratecache.SearchRs {
+	searchRs := ratecache.SearchRs{CheckIn: searchRq.CheckIn, LengthOfStay: searchRq.LengthOfStay}
+	idxResults := view.Idx.FindOccupancies(&searchRq, searchRq.Occupancies)
+	for i, ages := range searchRq.Occupancies {
+		occupancyRs := context.Find(view, idxResults[i], searchRq)
+		searchRs.Occupancies = append(searchRs.Occupancies, ratecache.SearchRsOccupancy{Occupancy: ages, Options: occupancyRs.Options})
+	}
+	return searchRs
+}
+
+// FindRooms searches the room options of every room of a multi-room
+// search and returns the cheapest combinations per accommodation.
+func (context *HandlerContext) FindRooms(view CacheView, searchRq ratecache.SearchRq) ratecache.SearchRs {
+	searchRs := ratecache.SearchRs{CheckIn: searchRq.CheckIn, LengthOfStay: searchRq.LengthOfStay}
+	options := make(map[string][][]ratecache.SearchRsRoomOption)
+	for i, ages := range searchRq.Rooms {
+		roomRq := searchRq
+		roomRq.Occupancy = ages
+		roomRq.Rooms = nil
+		roomRs := context.Find(view, view.Idx.Find(&roomRq), roomRq)
+		for _, accoOption := range roomRs.Options {
+			if options[accoOption.AccoCode] == nil {
+				options[accoOption.AccoCode] = make([][]ratecache.SearchRsRoomOption, len(searchRq.Rooms))
+			}
+			options[accoOption.AccoCode][i] = accoOption.Rooms
+		}
+	}
+	limit := context.Settings.MaxRoomCombinations
+	if limit <= 0 {
+		limit = DefaultMaxRoomCombinations
+	}
+	for _, accommodation := range searchRq.Accommodations {
+		combinations := ratecache.CombineRooms(searchRq.Rooms, options[accommodation.AccoCode], context.Settings.DecimalPlaces, limit)
+		if len(combinations) > 0 {
+			searchRs.Options = append(searchRs.Options, ratecache.SearchRsAccoOption{AccoCode: accommodation.AccoCode, Combinations: combinations})
+			delete(options, accommodation.AccoCode)
+		}
+	}
+	return searchRs
+}
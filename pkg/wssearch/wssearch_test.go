@@ -0,0 +1,226 @@
+package wssearch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+	"github.com/navegotel/openratecache/pkg/wswrite"
+)
+
+// testWriter is a wswrite instance with change stream in a temporary
+// directory, served by a test server.
+type testWriter struct {
+	context *wswrite.HandlerContext
+	server  *httptest.Server
+	dir     string
+	lock    *ratecache.FileLock
+}
+
+func newTestWriter(t *testing.T) *testWriter {
+	dir, err := ioutil.TempDir("", "wssearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := wswrite.Settings{CacheDir: dir, IndexDir: dir, CacheFilename: "test.bin", Supplier: "TEST", Currency: "EUR",
+		DecimalPlaces: 2, MaxLos: 3, Days: 30, AccoCodeLength: 12, RoomRateCodeLength: 12, InitialRateBlockCapacity: 2, ChangeStream: true}
+	f, idx, lock, err := wswrite.LoadOrCreateCache(settings, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context, err := wswrite.NewHandlerContext(settings, f, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context.Journal, err = wswrite.OpenJournal(settings, f, context.Idx, context.Tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", context.VersionHandler)
+	mux.HandleFunc("/changes", context.ChangesHandler)
+	mux.HandleFunc("/indexentries", context.IndexEntriesHandler)
+	mux.HandleFunc("/tags", context.TagsHandler)
+	mux.HandleFunc("/snapshot", context.SnapshotHandler)
+	return &testWriter{context: context, server: httptest.NewServer(mux), dir: dir, lock: lock}
+}
+
+func (writer *testWriter) close() {
+	writer.server.Close()
+	writer.context.Journal.Close()
+	writer.context.CacheFile.Close()
+	writer.lock.Unlock()
+	os.RemoveAll(writer.dir)
+}
+
+// importRoom imports rate and availability 5 for a double room and the
+// first ten check-in dates.
+func (writer *testWriter) importRoom(t *testing.T, accoCode string, roomRateCode string, rate string, occupancy string) {
+	startDate := writer.context.Fhdr.StartDate
+	data := []byte(`{"accommodationCode":"` + accoCode + `","roomRateCode":"` + roomRateCode + `",
+		"Occupancy":` + occupancy + `,
+		"rates":[{"firstCheckIn":"` + startDate.Format("2006-01-02") + `","lastCheckIn":"` + startDate.AddDate(0, 0, 9).Format("2006-01-02") + `","lengthOfStay":1,"rate":` + rate + `}],
+		"availabilities":[{"firstCheckIn":"` + startDate.Format("2006-01-02") + `","lastCheckIn":"` + startDate.AddDate(0, 0, 9).Format("2006-01-02") + `","lengthOfStay":1,"available":5}]}`)
+	info, err := wswrite.ImportAriData(writer.context, data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Errors) > 0 || info.Report.Rejected {
+		t.Fatalf("Import failed: %v %v", info.Errors, info.Report)
+	}
+}
+
+const doubleRoom = `[{"minAge":18,"maxAge":100,"count":2}]`
+
+// searchRq returns a search for two adults on the second day of the cache.
+func searchRq(writer *testWriter, accoCodes ...string) ratecache.SearchRq {
+	rq := ratecache.SearchRq{CheckIn: ratecache.JSONDate(writer.context.Fhdr.StartDate.AddDate(0, 0, 1)), LengthOfStay: 1, Occupancy: ratecache.Ages{30, 30}}
+	for _, accoCode := range accoCodes {
+		rq.Accommodations = append(rq.Accommodations, ratecache.AccoRoomRate{AccoCode: accoCode})
+	}
+	return rq
+}
+
+// find searches with a view of context and returns the
+// found room rate codes per accommodation.
+func find(context *HandlerContext, rq ratecache.SearchRq) map[string][]string {
+	view := context.View()
+	defer view.Release()
+	found := make(map[string][]string)
+	for _, accoOption := range context.Find(view, view.Idx.Find(&rq), rq).Options {
+		for _, room := range accoOption.Rooms {
+			found[accoOption.AccoCode] = append(found[accoOption.AccoCode], room.RoomRateCode)
+		}
+	}
+	return found
+}
+
+// newSearchContext loads the cache of the writer into a search context.
+// The returned function closes the cache and releases its lock.
+func newSearchContext(t *testing.T, writer *testWriter, settings Settings) (*HandlerContext, func()) {
+	settings.CacheDir, settings.IndexDir, settings.CacheFilename = writer.dir, writer.dir, "test.bin"
+	settings.DecimalPlaces = 2
+	mp, idx, fhdr, lock, err := LoadCache(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := NewHandlerContext(settings, mp, idx, fhdr, lock)
+	return context, func() {
+		context.Map.Close()
+		context.lock.Unlock()
+	}
+}
+
+// waitFor polls cond until it is true or a second has passed.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestCatchUpIndex(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	context, cleanup := newSearchContext(t, writer, Settings{WriterUrl: writer.server.URL})
+	defer cleanup()
+	writer.importRoom(t, "ALC001", "DBLSTBB", "41.00", doubleRoom)
+	// rate blocks removed before the catch-up are not added
+	writer.importRoom(t, "ALC003", "DBLSTHB", "60.00", doubleRoom)
+	_, err := wswrite.Remove(writer.context, []byte(`{"accommodationCode":"ALC003"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := CatchUpIndex(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Value: %d, expected 1", count)
+	}
+	if found := find(context, searchRq(writer, "ALC003")); len(found["ALC003"]) != 0 {
+		t.Errorf("Unexpected room rates %v", found)
+	}
+
+	// the writer returns pages of the requested size
+	writer.importRoom(t, "ALC002", "DBLSTHB", "50.00", doubleRoom)
+	rsp, err := http.Get(writer.server.URL + "/indexentries?from=1&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexEntries wswrite.IndexEntries
+	err = json.NewDecoder(rsp.Body).Decode(&indexEntries)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexEntries.RateBlockCount != 4 || indexEntries.Next != 2 || len(indexEntries.Entries) != 1 || indexEntries.Entries[0].RoomRateCode != "DBLSTBB" {
+		t.Errorf("Unexpected index entries %v", indexEntries)
+	}
+
+	// entries removed from the index are not requested again
+	context.RemoveIdxEntry(ratecache.IdxEntry{AccoCode: "ALC001", RoomRateCode: "DBLSTHB", RoomOccIdx: ratecache.RoomOccIdx{Idx: 0}})
+	count, err = CatchUpIndex(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Value: %d, expected 1", count)
+	}
+	found := find(context, searchRq(writer, "ALC001", "ALC002"))
+	if len(found["ALC001"]) != 1 || found["ALC001"][0] != "DBLSTBB" || len(found["ALC002"]) != 1 {
+		t.Errorf("Unexpected room rates %v", found)
+	}
+
+	// removed rate blocks do not count as index lag
+	message, err := context.checkIndexLag(context.Idx.GetNextIndex())
+	if err != nil || message != "0 rate blocks behind the writer" {
+		t.Errorf("Value: %v %v, expected: 0 rate blocks behind the writer", message, err)
+	}
+}
+
+func TestAddIndexHandler(t *testing.T) {
+	writer := newTestWriter(t)
+	defer writer.close()
+	writer.importRoom(t, "ALC001", "DBLSTHB", "31.02", doubleRoom)
+	context, cleanup := newSearchContext(t, writer, Settings{})
+	defer cleanup()
+	writer.importRoom(t, "ALC001", "DBLSTBB", "41.00", doubleRoom)
+	writer.importRoom(t, "ALC002", "DBLSTHB", "50.00", doubleRoom)
+	entry := func(accoCode string, roomRateCode string, index string) string {
+		return `{"AccoCode":"` + accoCode + `","RoomRateCode":"` + roomRateCode + `","RoomOccIdx":{"Occupancy":` + doubleRoom + `,"Total":2,"Idx":` + index + `}}`
+	}
+	for _, body := range []string{entry("ALC001", "DBLSTBB", "1"), "[" + entry("ALC002", "DBLSTHB", "2") + "]"} {
+		w := httptest.NewRecorder()
+		context.AddIndexHandler(w, httptest.NewRequest(http.MethodPost, "/addindex", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Errorf("Unexpected status %d for %v", w.Code, body)
+		}
+	}
+	found := find(context, searchRq(writer, "ALC001", "ALC002"))
+	if len(found["ALC001"]) != 2 || len(found["ALC002"]) != 1 {
+		t.Errorf("Unexpected room rates %v", found)
+	}
+
+	// entries of removed rate blocks are removed from the index
+	removed := strings.Replace(entry("ALC001", "DBLSTHB", "0"), "}}", `},"Removed":true}`, 1)
+	w := httptest.NewRecorder()
+	context.AddIndexHandler(w, httptest.NewRequest(http.MethodPost, "/addindex", strings.NewReader("["+removed+"]")))
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d for %v", w.Code, removed)
+	}
+	found = find(context, searchRq(writer, "ALC001"))
+	if len(found["ALC001"]) != 1 || found["ALC001"][0] != "DBLSTBB" {
+		t.Errorf("Unexpected room rates %v", found)
+	}
+}
@@ -23,8 +23,16 @@ type Settings struct {
 	InitialRateBlockCapacity int      `json:"initialRateBlockCapacity"`
 	AddIndexUrls             []string `json:"addIndexUrls"`
 	Notify                   bool     `json:"notify"`
+	StrictImport             bool     `json:"strictImport"`
+	ChangeStream             bool     `json:"changeStream"`
+	RecoverIndex             bool     `json:"recoverIndex"`
+	MaxJournalSize           int64    `json:"maxJournalSize"`
 }
 
+// DefaultMaxJournalSize is the size in MB of the changes the journal keeps
+// before it is compacted if MaxJournalSize is not set.
+const DefaultMaxJournalSize = 1024
+
 // LoadSettings loads settings for ws write from a json file.
 func LoadSettings(filename string) (Settings, error) {
 	s := Settings{}
@@ -55,6 +63,7 @@ func CreateInitialSettings(filename string) error {
 		AccoCodeLength:           32,
 		RoomRateCodeLength:       32,
 		InitialRateBlockCapacity: 40000,
+		MaxJournalSize:           DefaultMaxJournalSize,
 	}
 	jstr, err := json.MarshalIndent(s, "", "\t")
 	if err != nil {
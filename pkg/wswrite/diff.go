@@ -0,0 +1,103 @@
+package wswrite
+
+import (
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// BlockInfo identifies a rate block by accommodation, room rate
+// and occupancy.
+type BlockInfo struct {
+	AccoCode     string                    `json:"accommodationCode"`
+	RoomRateCode string                    `json:"roomRateCode"`
+	Occupancy    []ratecache.OccupancyItem `json:"occupancy"`
+}
+
+// RateChange is a range of check-in dates for which a
+// dry-run import would change the rate.
+type RateChange struct {
+	ratecache.DateRange
+	OldRate ratecache.Decimal `json:"oldRate"`
+	NewRate ratecache.Decimal `json:"newRate"`
+}
+
+// AvailChange is a range of check-in dates for which a
+// dry-run import would change the availability.
+type AvailChange struct {
+	ratecache.DateRange
+	OldAvailable uint8 `json:"oldAvailable"`
+	NewAvailable uint8 `json:"newAvailable"`
+}
+
+// ClosedChange is a range of check-in dates that a
+// dry-run import would close or open.
+type ClosedChange struct {
+	ratecache.DateRange
+	OldClosed bool `json:"oldClosed"`
+	NewClosed bool `json:"newClosed"`
+}
+
+// ImportDiff contains the changes a dry-run import would
+// apply to the cache.
+type ImportDiff struct {
+	NewBlocks               []BlockInfo           `json:"newBlocks"`
+	Rates                   []RateChange          `json:"rates"`
+	Availabilities          []AvailChange         `json:"availabilities"`
+	Closed                  []ClosedChange        `json:"closed"`
+	TruncatedRates          []ratecache.DateRange `json:"truncatedRates"`
+	TruncatedAvailabilities []ratecache.DateRange `json:"truncatedAvailabilities"`
+}
+
+// diffCells compares the cells of a rate block before and after
+// the import and adds the changes grouped into ranges of check-in
+// dates per length of stay to diff.
+func diffCells(context *HandlerContext, diff *ImportDiff, oldCells []byte, cells []byte) {
+	days := int(context.Fhdr.Days)
+	places := context.Settings.DecimalPlaces
+	for l := 0; l < int(context.Fhdr.MaxLos); l++ {
+		var rateChange *RateChange
+		var availChange *AvailChange
+		var closedChange *ClosedChange
+		for d := 0; d < days; d++ {
+			pos := (l*days + d) * 4
+			oldRate, oldAvail, oldClosed := context.Fhdr.UnpackCell(oldCells[pos : pos+4])
+			newRate, newAvail, newClosed := context.Fhdr.UnpackCell(cells[pos : pos+4])
+			checkIn := ratecache.JSONDate(context.Fhdr.StartDate.AddDate(0, 0, d))
+			if oldRate == newRate {
+				rateChange = nil
+			} else if rateChange != nil && rateChange.OldRate.Units == int64(oldRate) && rateChange.NewRate.Units == int64(newRate) {
+				rateChange.LastCheckIn = checkIn
+			} else {
+				diff.Rates = append(diff.Rates, RateChange{
+					DateRange: ratecache.DateRange{FirstCheckIn: checkIn, LastCheckIn: checkIn, LengthOfStay: uint8(l + 1)},
+					OldRate:   ratecache.NewDecimal(int64(oldRate), places),
+					NewRate:   ratecache.NewDecimal(int64(newRate), places),
+				})
+				rateChange = &diff.Rates[len(diff.Rates)-1]
+			}
+			if oldAvail == newAvail {
+				availChange = nil
+			} else if availChange != nil && availChange.OldAvailable == oldAvail && availChange.NewAvailable == newAvail {
+				availChange.LastCheckIn = checkIn
+			} else {
+				diff.Availabilities = append(diff.Availabilities, AvailChange{
+					DateRange:    ratecache.DateRange{FirstCheckIn: checkIn, LastCheckIn: checkIn, LengthOfStay: uint8(l + 1)},
+					OldAvailable: oldAvail,
+					NewAvailable: newAvail,
+				})
+				availChange = &diff.Availabilities[len(diff.Availabilities)-1]
+			}
+			if oldClosed == newClosed {
+				closedChange = nil
+			} else if closedChange != nil && closedChange.NewClosed == newClosed {
+				closedChange.LastCheckIn = checkIn
+			} else {
+				diff.Closed = append(diff.Closed, ClosedChange{
+					DateRange: ratecache.DateRange{FirstCheckIn: checkIn, LastCheckIn: checkIn, LengthOfStay: uint8(l + 1)},
+					OldClosed: oldClosed,
+					NewClosed: newClosed,
+				})
+				closedChange = &diff.Closed[len(diff.Closed)-1]
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package wswrite
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDiffClosed(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	_, err := ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstCheckIn := context.Fhdr.StartDate.AddDate(0, 0, 3).Format("2006-01-02")
+	lastCheckIn := context.Fhdr.StartDate.AddDate(0, 0, 4).Format("2006-01-02")
+	data := bytes.Replace(testImportData(context, "31.02", "5"), []byte(`"rates":`),
+		[]byte(`"closed":[{"firstCheckIn":"`+firstCheckIn+`","lastCheckIn":"`+lastCheckIn+`","lengthOfStay":1}],"rates":`), 1)
+	importInfo, err := ImportAriData(context, data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := importInfo.Diff
+	if len(diff.Rates) != 0 || len(diff.Availabilities) != 0 {
+		t.Errorf("Value: %v, expected no rate and availability changes", diff)
+	}
+	if len(diff.Closed) != 1 {
+		t.Fatalf("Value: %v, expected: 1 closed range", diff.Closed)
+	}
+	change := diff.Closed[0]
+	if change.OldClosed || !change.NewClosed || time.Time(change.FirstCheckIn).Format("2006-01-02") != firstCheckIn || time.Time(change.LastCheckIn).Format("2006-01-02") != lastCheckIn {
+		t.Errorf("Unexpected closed change %v", change)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	importInfo, err := ImportAriData(context, testImportData(context, "31.02", "5"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(importInfo.Diff.NewBlocks) != 1 {
+		t.Errorf("Value: %v, expected: 1", len(importInfo.Diff.NewBlocks))
+	}
+	if context.Idx.GetAccoCount() != 0 {
+		t.Error("Dry run must not add index entries")
+	}
+	_, err = ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.Metrics.NewBlocks.Value() != 1 || context.Metrics.ImportedCells.Value("rate") != 4 {
+		t.Errorf("Unexpected metrics: %v new blocks, %v rates", context.Metrics.NewBlocks.Value(), context.Metrics.ImportedCells.Value("rate"))
+	}
+	importInfo, _ = ImportAriData(context, testImportData(context, "31.02", "6"), true)
+	if len(importInfo.Diff.NewBlocks) != 0 || len(importInfo.Diff.Rates) != 0 {
+		t.Errorf("Value: %v, expected no new blocks and no rate changes", importInfo.Diff)
+	}
+	if len(importInfo.Diff.Availabilities) != 1 {
+		t.Fatalf("Value: %v, expected: 1", len(importInfo.Diff.Availabilities))
+	}
+	change := importInfo.Diff.Availabilities[0]
+	if change.OldAvailable != 5 || change.NewAvailable != 6 {
+		t.Errorf("Value: %v, expected: 5 -> 6", change)
+	}
+}
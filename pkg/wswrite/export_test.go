@@ -0,0 +1,69 @@
+package wswrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+func TestExport(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	entries := context.Idx.Select("ALC001", "", "")
+	if len(entries) != 1 {
+		t.Fatalf("Value: %v, expected: 1", len(entries))
+	}
+	roomRates, err := ratecache.ExportRoomRates(context.CacheFile, context.Fhdr, entries[0], context.Settings.DecimalPlaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roomRates.Rates) != 1 || len(roomRates.Availabilities) != 1 {
+		t.Fatalf("Value: %v, expected one rate and one availability", roomRates)
+	}
+	if roomRates.Rates[0].Rate != ratecache.NewDecimal(3102, 2) {
+		t.Errorf("Value: %v, expected: 31.02", roomRates.Rates[0].Rate)
+	}
+	if time.Time(roomRates.Rates[0].LastCheckIn) != context.Fhdr.StartDate.AddDate(0, 0, 5) {
+		t.Errorf("Value: %v, expected: %v", time.Time(roomRates.Rates[0].LastCheckIn), context.Fhdr.StartDate.AddDate(0, 0, 5))
+	}
+	var buf bytes.Buffer
+	ratecache.WriteExport(&buf, context.CacheFile, context.Fhdr, entries, context.Settings.DecimalPlaces, true)
+	importInfo, _ := ImportAriData(context, bytes.TrimSpace(buf.Bytes()), true)
+	if len(importInfo.Diff.Rates) != 0 || len(importInfo.Diff.Availabilities) != 0 {
+		t.Errorf("Re-import of export should not change anything: %v", importInfo.Diff)
+	}
+	// closed cells keep their rate and are listed as closed
+	rangeOp := []byte(`{"accommodationCode":"ALC001","firstCheckIn":"` + context.Fhdr.StartDate.AddDate(0, 0, 3).Format("2006-01-02") +
+		`","lastCheckIn":"` + context.Fhdr.StartDate.AddDate(0, 0, 4).Format("2006-01-02") + `","lengthsOfStay":[1]}`)
+	ApplyRangeOperation(context, OpClose, rangeOp)
+	roomRates, _ = ratecache.ExportRoomRates(context.CacheFile, context.Fhdr, entries[0], context.Settings.DecimalPlaces)
+	if len(roomRates.Rates) != 1 || len(roomRates.Closed) != 1 {
+		t.Fatalf("Value: %v, expected one rate and one closed range", roomRates)
+	}
+	if time.Time(roomRates.Closed[0].FirstCheckIn) != context.Fhdr.StartDate.AddDate(0, 0, 3) {
+		t.Errorf("Value: %v, expected: %v", time.Time(roomRates.Closed[0].FirstCheckIn), context.Fhdr.StartDate.AddDate(0, 0, 3))
+	}
+	ApplyRangeOperation(context, OpOpen, rangeOp)
+	jsonStr, _ := json.Marshal(roomRates)
+	importInfo, _ = ImportAriData(context, jsonStr, false)
+	if importInfo.Report.HasIssues() {
+		t.Errorf("Unexpected report: %v", importInfo.Report)
+	}
+	rate, _, closed := context.Fhdr.UnpackCell(readCell(t, context, entries[0].RoomOccIdx.Idx, 4))
+	if rate != 3102 || !closed {
+		t.Errorf("Value: %v %v, expected: 3102 true", rate, closed)
+	}
+}
+
+func readCell(t *testing.T, context *HandlerContext, idx uint32, day int) []byte {
+	buf := make([]byte, 4)
+	_, err := context.CacheFile.ReadAt(buf, context.Fhdr.GetRateBlockStart(idx)+context.Fhdr.GetLosOffset(1)+int64(day*4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
@@ -2,9 +2,14 @@ package wswrite
 
 import (
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/navegotel/openratecache/pkg/ratecache"
@@ -16,16 +21,32 @@ type HandlerContext struct {
 	CacheFile *os.File
 	Idx       *ratecache.CacheIndex
 	Fhdr      *ratecache.FileHeader
+	// Journal records all changes of the cache file for the
+	// change stream. It is nil if the change stream is disabled.
+	Journal *ratecache.Journal
+	// Outbox delivers new index entries to the addIndexUrls.
+	// It is nil if notifications are disabled.
+	Outbox *Outbox
+	// Tags contains the tags of accommodations and room rates
+	Tags    *ratecache.TagStore
+	Metrics *Metrics
+	// mu serializes write operations on the cache file
+	mu sync.Mutex
+	// snapshots are the running snapshots, guarded by mu
+	snapshots map[*snapshotReader]struct{}
 }
 
 type ImportInfo struct {
-	Errors []string `json:"errors"`
-	Stats  Stats    `json:"stats"`
+	Errors []string     `json:"errors"`
+	Stats  Stats        `json:"stats"`
+	Report ImportReport `json:"report"`
+	Diff   *ImportDiff  `json:"diff,omitempty"`
 }
 
 // NewHandlerContext creates a new handler context
 func NewHandlerContext(settings Settings, cacheFile *os.File, idx *ratecache.CacheIndex) (*HandlerContext, error) {
-	context := HandlerContext{Settings: settings, CacheFile: cacheFile, Idx: idx}
+	context := HandlerContext{Settings: settings, CacheFile: cacheFile, Idx: idx, snapshots: make(map[*snapshotReader]struct{})}
+	context.Metrics = NewMetrics(&context)
 	buf := make([]byte, ratecache.FileHeaderSize)
 	cacheFile.Read(buf)
 	fhdr, err := ratecache.FileHeaderFromByteStr(buf)
@@ -33,47 +54,355 @@ func NewHandlerContext(settings Settings, cacheFile *os.File, idx *ratecache.Cac
 		return &context, err
 	}
 	context.Fhdr = fhdr
-	return &context, nil
+	context.Tags, err = LoadTags(settings)
+	if err != nil {
+		return &context, err
+	}
+	return &context, fhdr.ResetSeqCounters(cacheFile)
+}
+
+// RequestError is returned if the body of a request cannot be decoded.
+type RequestError struct {
+	Err error
+}
+
+func (e RequestError) Error() string {
+	return "Invalid request: " + e.Err.Error()
 }
 
-// ImportHandler imports data into the rate cache.
+// writeError responds with 400 to a RequestError and with 500 to
+// any other error, e.g. when the cache file cannot be written.
+func writeError(w http.ResponseWriter, err error) {
+	if _, ok := err.(RequestError); ok {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	log.Println(err)
+	http.Error(w, "Internal Server Error", 500)
+}
+
+// ImportHandler imports data into the rate cache. With query parameter
+// dryRun=true nothing is written and the changes the import would cause
+// are returned instead.
 func (context *HandlerContext) ImportHandler(w http.ResponseWriter, r *http.Request) {
-	var importInfo ImportInfo
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", 405)
+		return
 	}
 	rqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Bad Request", 400)
+		return
 	}
 	defer r.Body.Close()
-	importInfo.Stats, importInfo.Errors, err = ImportAriData(context, rqBody)
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	importInfo, err := ImportAriData(context, rqBody, dryRun)
 	if err != nil {
-		http.Error(w, "Bad Request", 400)
+		writeError(w, err)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	if dryRun {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
 	json.NewEncoder(w).Encode(importInfo)
 
 }
 
+func (context *HandlerContext) rangeOpHandler(w http.ResponseWriter, r *http.Request, op int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	rqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	defer r.Body.Close()
+	rangeOpInfo, err := ApplyRangeOperation(context, op, rqBody)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rangeOpInfo)
+}
+
+// CloseHandler closes rooms for sale for a range of check-in dates.
+func (context *HandlerContext) CloseHandler(w http.ResponseWriter, r *http.Request) {
+	context.rangeOpHandler(w, r, OpClose)
+}
+
+// OpenHandler re-opens closed rooms for a range of check-in dates.
+func (context *HandlerContext) OpenHandler(w http.ResponseWriter, r *http.Request) {
+	context.rangeOpHandler(w, r, OpOpen)
+}
+
+// ClearHandler resets rates and availabilities for a range of
+// check-in dates to unknown.
+func (context *HandlerContext) ClearHandler(w http.ResponseWriter, r *http.Request) {
+	context.rangeOpHandler(w, r, OpClear)
+}
+
+// RemoveHandler removes room rates from the index, see Remove.
+func (context *HandlerContext) RemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	rqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	defer r.Body.Close()
+	removeInfo, err := Remove(context, rqBody)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(removeInfo)
+}
+
+// lockedReader reads from the cache file while holding the
+// write lock, so that no import changes a block while it is read.
+type lockedReader struct {
+	context *HandlerContext
+}
+
+func (r lockedReader) ReadAt(buf []byte, off int64) (int, error) {
+	r.context.mu.Lock()
+	defer r.context.mu.Unlock()
+	return r.context.CacheFile.ReadAt(buf, off)
+}
+
+// ExportHandler exports rates and availabilities in import format,
+// see ServeExport.
+func (context *HandlerContext) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	ServeExport(w, r, lockedReader{context}, context.Fhdr, context.Idx, context.Settings.DecimalPlaces)
+}
+
+// ServeExport exports rates and availabilities in import format for
+// the whole cache, one accommodation (query parameter accommodationCode)
+// or one room rate (accommodationCode and roomRateCode). With format=ndjson
+// one RoomRates object per line is returned instead of a JSON array.
+func ServeExport(w http.ResponseWriter, r *http.Request, reader io.ReaderAt, fhdr *ratecache.FileHeader, idx *ratecache.CacheIndex, DecimalPlaces uint8) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	query := r.URL.Query()
+	entries := idx.Select(query.Get("accommodationCode"), query.Get("roomRateCode"), "")
+	ndjson := query.Get("format") == "ndjson"
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	err := ratecache.WriteExport(w, reader, fhdr, entries, DecimalPlaces, ndjson)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// MaxIndexEntries is the maximum number of entries returned by one
+// request of the index entries endpoint.
+const MaxIndexEntries = 10000
+
+// IndexEntries is the response of the index entries endpoint. Next is
+// the block number to request next, the client has all entries if Next
+// reaches RateBlockCount.
+type IndexEntries struct {
+	RateBlockCount uint32               `json:"rateBlockCount"`
+	Next           uint32               `json:"next"`
+	Entries        []NewIdxNotification `json:"entries"`
+}
+
+// IndexEntriesHandler returns the index entries of the rate blocks
+// starting with block number from (query parameter), at most limit
+// (query parameter, default and maximum MaxIndexEntries). A search
+// service uses it at start-up to catch up on entries added after its
+// index was loaded. Entries of removed rate blocks have Removed set.
+func (context *HandlerContext) IndexEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 32)
+	if err != nil && len(r.URL.Query().Get("from")) > 0 {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	limit := uint64(MaxIndexEntries)
+	if len(r.URL.Query().Get("limit")) > 0 {
+		limit, err = strconv.ParseUint(r.URL.Query().Get("limit"), 10, 32)
+		if err != nil || limit == 0 {
+			http.Error(w, "Bad Request", 400)
+			return
+		}
+		if limit > MaxIndexEntries {
+			limit = MaxIndexEntries
+		}
+	}
+	indexEntries := IndexEntries{RateBlockCount: context.rateBlockCount(), Entries: []NewIdxNotification{}}
+	indexEntries.Next = indexEntries.RateBlockCount
+	if from+limit < uint64(indexEntries.Next) {
+		indexEntries.Next = uint32(from + limit)
+	}
+	for index := uint32(from); index < indexEntries.Next; index++ {
+		entry, err := context.readIdxEntry(index)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		indexEntries.Entries = append(indexEntries.Entries, NewIdxNotification{AccoCode: entry.AccoCode, RoomRateCode: entry.RoomRateCode, RoomOccIdx: entry.RoomOccIdx,
+			Removed: context.Idx.IsRemoved(index)})
+	}
+	if indexEntries.Next < uint32(from) {
+		indexEntries.Next = uint32(from)
+	}
+	jsonStr, err := json.Marshal(indexEntries)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// SnapshotHandler returns a consistent copy of the cache file and the
+// index file as tar archive, see WriteSnapshot.
+func (context *HandlerContext) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+context.Settings.CacheFilename+".tar\"")
+	w.WriteHeader(http.StatusOK)
+	err := WriteSnapshot(context, w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// ChangeSet is the response of the change stream and contains the journal
+// records starting at Offset. Next is the offset to be requested next
+// and Head the size of the journal after the records were read. The
+// reader is up to date if Next reaches Head.
+type ChangeSet struct {
+	JournalID string                    `json:"journalId"`
+	Offset    int64                     `json:"offset"`
+	Next      int64                     `json:"next"`
+	Head      int64                     `json:"head"`
+	Records   []ratecache.JournalRecord `json:"records"`
+}
+
+// ChangesHandler streams the changes of the cache file, i.e. the records
+// of the journal starting at query parameter offset. If there are no
+// records yet, the request waits up to wait seconds for new records (long
+// poll). If journalId is set and does not match the current journal, e.g.
+// because the cache was cleaned, 409 Conflict is returned and the client
+// has to start again at offset 0.
+func (context *HandlerContext) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	if context.Journal == nil {
+		http.Error(w, "Change stream not enabled", 404)
+		return
+	}
+	query := r.URL.Query()
+	journalID := query.Get("journalId")
+	if len(journalID) == 0 {
+		journalID = context.Journal.ID()
+	}
+	offset, _ := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if offset < ratecache.JournalHeaderSize {
+		offset = ratecache.JournalHeaderSize
+	}
+	wait, _ := strconv.Atoi(query.Get("wait"))
+	if wait > 60 {
+		wait = 60
+	}
+	if wait > 0 {
+		context.Journal.Wait(offset, time.Duration(wait)*time.Second)
+	}
+	records, next, err := context.Journal.Read(journalID, offset, 4<<20)
+	if err == ratecache.ErrJournalChanged {
+		http.Error(w, "Journal has changed", 409)
+		return
+	}
+	if err == ratecache.ErrJournalBroken {
+		http.Error(w, "Journal is broken", 503)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	changeSet := ChangeSet{JournalID: journalID, Offset: offset, Next: next, Head: context.Journal.Size(), Records: records}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(changeSet)
+}
+
+// MemoryInfo is part of VersionInfo and reports the memory used
+// by the index and the heap of the process.
+type MemoryInfo struct {
+	Index        ratecache.IndexMemoryStats `json:"index"`
+	HeapAlloc    uint64                     `json:"heapAlloc"`
+	HeapSys      uint64                     `json:"heapSys"`
+	HeapObjects  uint64                     `json:"heapObjects"`
+	NumGC        uint32                     `json:"numGC"`
+	GCPauseTotal time.Duration              `json:"gcPauseTotalNs"`
+}
+
+// NewMemoryInfo returns the memory info for idx and the current process.
+func NewMemoryInfo(idx *ratecache.CacheIndex) MemoryInfo {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return MemoryInfo{
+		Index:        idx.MemoryStats(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapSys:      m.HeapSys,
+		HeapObjects:  m.HeapObjects,
+		NumGC:        m.NumGC,
+		GCPauseTotal: time.Duration(m.PauseTotalNs),
+	}
+}
+
 type VersionInfo struct {
-	Release            string    `json:"release"`
-	FormatVersion      byte      `json:"formatVersion"`
-	CacheDate          time.Time `json:"cacheDate"`
-	AccommodationCount int       `json:"accommodationCount"`
-	RateBlockCount     uint32    `json:"rateBlockCount"`
-	RateCount          uint64    `json:"rateCount"`
+	Release            string     `json:"release"`
+	FormatVersion      byte       `json:"formatVersion"`
+	CacheDate          time.Time  `json:"cacheDate"`
+	AccommodationCount int        `json:"accommodationCount"`
+	RateBlockCount     uint32     `json:"rateBlockCount"`
+	RateCount          uint64     `json:"rateCount"`
+	Memory             MemoryInfo `json:"memory"`
 }
 
 // VersionHandler for basic cache information
 func (context *HandlerContext) VersionHandler(w http.ResponseWriter, r *http.Request) {
 	versionInfo := VersionInfo{Release: ratecache.Release,
-		FormatVersion:      ratecache.Version,
+		FormatVersion:      context.Fhdr.Version,
 		CacheDate:          context.Fhdr.StartDate,
 		AccommodationCount: context.Idx.GetAccoCount(),
 		RateBlockCount:     context.Fhdr.RateBlockCount,
 		RateCount:          uint64(context.Fhdr.Days) * uint64(context.Fhdr.MaxLos) * uint64(context.Fhdr.RateBlockCount),
+		Memory:             NewMemoryInfo(context.Idx),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
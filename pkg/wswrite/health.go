@@ -0,0 +1,87 @@
+package wswrite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// HealthCheck is the result of one readiness check.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// ReadyInfo is the response of the readiness endpoint. Ready is only
+// true if all checks are ok.
+type ReadyInfo struct {
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// NewReadyInfo returns a ReadyInfo without checks.
+func NewReadyInfo() ReadyInfo {
+	return ReadyInfo{Ready: true, Checks: []HealthCheck{}}
+}
+
+// Add adds the result of a check, which failed if err is not nil.
+// The message of a successful check is optional.
+func (info *ReadyInfo) Add(name string, err error, message string) {
+	check := HealthCheck{Name: name, OK: err == nil, Message: message}
+	if err != nil {
+		check.Message = err.Error()
+		info.Ready = false
+	}
+	info.Checks = append(info.Checks, check)
+}
+
+// Write writes info with status 200 if ready and 503 otherwise.
+func (info *ReadyInfo) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if info.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// WriteHealthy writes the response of the liveness endpoint.
+func WriteHealthy(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// HealthzHandler tells that the service is running. It does not check
+// the cache, see ReadyzHandler.
+func (context *HandlerContext) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	WriteHealthy(w)
+}
+
+// ReadyzHandler checks that the file header of the cache file can be
+// read, the index is loaded and the cache file contains all rate blocks.
+func (context *HandlerContext) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	context.mu.Lock()
+	fhdr := *context.Fhdr
+	context.mu.Unlock()
+	info := NewReadyInfo()
+	_, err := ratecache.ReadFileHeader(context.CacheFile)
+	info.Add("header", err, "")
+	if context.Idx == nil {
+		info.Add("index", errors.New("Index is not loaded"), "")
+	} else {
+		info.Add("index", nil, fmt.Sprintf("%d entries", context.Idx.GetEntryCount()))
+	}
+	size, _ := context.cacheFileSize()
+	info.Add("cacheFile", fhdr.CheckSize(size), fmt.Sprintf("%d rate blocks", fhdr.RateBlockCount))
+	info.Write(w)
+}
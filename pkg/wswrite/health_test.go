@@ -0,0 +1,46 @@
+package wswrite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getReadyInfo(t *testing.T, context *HandlerContext) (int, ReadyInfo) {
+	rsp := httptest.NewRecorder()
+	context.ReadyzHandler(rsp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var info ReadyInfo
+	err := json.Unmarshal(rsp.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.Code, info
+}
+
+func TestReadyzHandler(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	_, err := ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, info := getReadyInfo(t, context)
+	if code != http.StatusOK || !info.Ready || len(info.Checks) != 3 {
+		t.Errorf("Expected ready, got %v %v", code, info)
+	}
+	// a cache file that does not contain all rate blocks is not ready
+	err = context.CacheFile.Truncate(context.Fhdr.GetRateBlockStart(context.Fhdr.RateBlockCount) - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, info = getReadyInfo(t, context)
+	if code != http.StatusServiceUnavailable || info.Ready {
+		t.Errorf("Expected not ready, got %v %v", code, info)
+	}
+	for _, check := range info.Checks {
+		if check.OK != (check.Name != "cacheFile") {
+			t.Errorf("Unexpected result of check %v", check)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package wswrite
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"time"
@@ -16,28 +18,112 @@ func GetToday() time.Time {
 	return t
 }
 
+// LockCache takes the writer lock of the cache, a lock file next to
+// the index file. Only one process at a time can hold it.
+func LockCache(settings Settings) (*ratecache.FileLock, error) {
+	return ratecache.LockWriter(filepath.Join(settings.IndexDir, settings.CacheFilename+".lock"))
+}
+
+// LockMaintenance takes the writer lock and an exclusive lock on the
+// cache file, so that neither wswrite nor wssearch use the cache while
+// a maintenance tool changes it.
+func LockMaintenance(settings Settings) (*ratecache.FileLock, *ratecache.FileLock, error) {
+	lock, err := LockCache(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	cacheFilename := filepath.Join(settings.CacheDir, settings.CacheFilename)
+	cacheLock, err := ratecache.LockFile(cacheFilename, true)
+	if err == ratecache.ErrLocked {
+		err = fmt.Errorf("%v is in use by wssearch", cacheFilename)
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, nil, err
+	}
+	return lock, cacheLock, nil
+}
+
+// recoverIndex rebuilds the index from the rate block headers of the
+// cache file. If the index file is missing, corrupt or differs from the
+// rebuilt index, it is replaced by the rebuilt index.
+func recoverIndex(settings Settings) (*ratecache.CacheIndex, error) {
+	idxFilename := filepath.Join(settings.IndexDir, settings.CacheFilename+".idx")
+	result, err := ratecache.RebuildIndex(filepath.Join(settings.CacheDir, settings.CacheFilename), idxFilename)
+	if err != nil {
+		return nil, err
+	}
+	if result.Diff.IsEmpty() {
+		return result.Loaded, nil
+	}
+	log.Printf("Index file %v does not match cache file, %v. Writing rebuilt index", idxFilename, &result.Diff)
+	return result.Rebuilt, ratecache.WriteIndexFile(result.Rebuilt, result.Header, idxFilename)
+}
+
+// upgradeIdxFile replaces an index file without header by
+// one in the current index file format.
+func upgradeIdxFile(fhdr *ratecache.FileHeader, idx *ratecache.CacheIndex, idxFilename string) error {
+	err := ratecache.WriteIndexFile(idx, fhdr, idxFilename)
+	if err != nil {
+		return err
+	}
+	log.Printf("Index file %v converted to index file version %d", idxFilename, ratecache.IdxVersion)
+	return nil
+}
+
 // LoadOrCreateCache is a convenience function that will return a
 // a file pointer with read/write access to a rate cache file.
-// If no file exists a new rate cache file will be created.
-func LoadOrCreateCache(settings Settings) (*os.File, *ratecache.CacheIndex, error) {
+// If no file exists a new rate cache file will be created. The writer
+// lock is taken first and fails if another wswrite uses the cache. If
+// clean is true, existing cache and index files are removed.
+func LoadOrCreateCache(settings Settings, clean bool) (*os.File, *ratecache.CacheIndex, *ratecache.FileLock, error) {
 	var f *os.File
 	var err error
 	idx := ratecache.NewCacheIndex()
 
+	lock, err := LockCache(settings)
+	if err != nil {
+		return f, idx, lock, err
+	}
+	if clean {
+		os.Remove(filepath.Join(settings.CacheDir, settings.CacheFilename))
+		os.Remove(filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"))
+	}
 	fhdr, err := ratecache.NewFileHeader(settings.Supplier, GetToday(), settings.Currency, settings.MaxLos, settings.Days, settings.AccoCodeLength, settings.RoomRateCodeLength)
 	if err != nil {
-		return f, idx, errors.New("Cannot create file header object")
+		lock.Unlock()
+		return f, idx, nil, errors.New("Cannot create file header object")
 	}
+	idxFilename := filepath.Join(settings.IndexDir, settings.CacheFilename+".idx")
 	_, err = os.Stat(filepath.Join(settings.CacheDir, settings.CacheFilename))
 	if os.IsNotExist(err) {
+		// a journal of a previous cache file must not be continued
+		os.Remove(filepath.Join(settings.IndexDir, settings.CacheFilename+".journal"))
 		ratecache.InitRateFile(fhdr, settings.CacheDir, settings.CacheFilename, settings.InitialRateBlockCapacity)
-		idx.Save(fhdr, filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"))
-	} else {
-		err = idx.Load(fhdr, filepath.Join(settings.IndexDir, settings.CacheFilename+".idx"))
-		if err != nil {
-			return f, idx, err
-		}
+		idx.Save(fhdr, idxFilename)
 	}
 	f, err = os.OpenFile(filepath.Join(settings.CacheDir, settings.CacheFilename), os.O_RDWR, 644)
-	return f, idx, err
+	if err != nil {
+		lock.Unlock()
+		return f, idx, nil, err
+	}
+	buf := make([]byte, ratecache.FileHeaderSize)
+	_, err = f.ReadAt(buf, 0)
+	if err == nil {
+		fhdr, err = ratecache.FileHeaderFromByteStr(buf)
+	}
+	if err == nil && settings.RecoverIndex {
+		idx, err = recoverIndex(settings)
+	} else if err == nil {
+		err = idx.Load(fhdr, idxFilename)
+	}
+	if err == nil && idx.IsLegacyFile() {
+		err = upgradeIdxFile(fhdr, idx, idxFilename)
+	}
+	if err != nil {
+		f.Close()
+		lock.Unlock()
+		return nil, idx, nil, err
+	}
+	return f, idx, lock, nil
 }
@@ -0,0 +1,75 @@
+package wswrite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+func TestRecoverIndexKeepsRemovals(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	_, err := Remove(context, []byte(`{"accommodationCode":"ALC001"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := context.Settings
+	settings.RecoverIndex = true
+	idx, err := recoverIndex(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.GetEntryCount() != 0 || !idx.IsRemoved(0) {
+		t.Errorf("Value: %v, expected: 0 entries", idx.GetEntryCount())
+	}
+}
+
+func TestLoadOrCreateCacheRecoverIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wswrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	settings := Settings{CacheDir: dir, IndexDir: dir, CacheFilename: "test.bin", Supplier: "TEST", Currency: "EUR",
+		DecimalPlaces: 2, MaxLos: 3, Days: 30, AccoCodeLength: 12, RoomRateCodeLength: 12, InitialRateBlockCapacity: 2}
+	f, idx, lock, err := LoadOrCreateCache(settings, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context, err := NewHandlerContext(settings, f, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	f.Close()
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxFilename := filepath.Join(dir, "test.bin.idx")
+	ioutil.WriteFile(idxFilename, []byte("corrupt"), 0644)
+	_, _, lock, err = LoadOrCreateCache(settings, false)
+	if err == nil {
+		lock.Unlock()
+		t.Fatal("Expected error for corrupt index file")
+	}
+	settings.RecoverIndex = true
+	f, idx, lock, err = LoadOrCreateCache(settings, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	defer f.Close()
+	if idx.GetEntryCount() != 1 {
+		t.Errorf("Value: %v, expected: 1", idx.GetEntryCount())
+	}
+	idx2 := ratecache.NewCacheIndex()
+	err = idx2.Load(context.Fhdr, idxFilename)
+	if err != nil || idx2.GetEntryCount() != 1 {
+		t.Errorf("Expected recovered index file with 1 entry, got %v, %v", idx2.GetEntryCount(), err)
+	}
+}
@@ -1,10 +1,8 @@
 package wswrite
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/json"
-	"net/http"
 	"path/filepath"
 	"time"
 
@@ -17,109 +15,182 @@ type Stats struct {
 	ExecutionTime float64
 }
 
+// NewIdxNotification is sent to the addIndexUrls for every new rate block.
+// Removed is set if the rate block has been removed from the index.
 type NewIdxNotification struct {
 	AccoCode     string
 	RoomRateCode string
 	RoomOccIdx   ratecache.RoomOccIdx
+	Removed      bool `json:",omitempty"`
 }
 
-func notifyNewIdx(accoCode string, roomRateCode string, roomOccIdx ratecache.RoomOccIdx, urls []string) error {
-	nf := NewIdxNotification{AccoCode: accoCode, RoomRateCode: roomRateCode, RoomOccIdx: roomOccIdx}
-	jsonMsg, err := json.Marshal(nf)
+// ImportAriData imports the ratecache.RoomRates in data into the cache.
+// If dryRun is true nothing is written and the returned ImportInfo
+// contains the differences the import would cause instead.
+func ImportAriData(context *HandlerContext, data []byte, dryRun bool) (ImportInfo, error) {
+	execStart := time.Now()
+	var roomRates ratecache.RoomRates
+	importInfo := ImportInfo{}
+	err := json.Unmarshal(data, &roomRates)
 	if err != nil {
-		return err
+		return importInfo, RequestError{err}
 	}
-	msgBody := bytes.NewBuffer(jsonMsg)
-	for _, url := range urls {
-		_, err := http.Post(url, "application/json", msgBody)
-		if err != nil {
-			return err
-		}
+	importInfo.Errors = roomRates.Validate()
+	if len(importInfo.Errors) > 0 {
+		context.Metrics.ValidationFailures.Inc("/import")
+		importInfo.Stats.ExecutionTime = time.Since(execStart).Seconds()
+		return importInfo, nil
 	}
-	return nil
-}
-
-func ImportAriData(context *HandlerContext, data []byte) (Stats, []string, error) {
-	execStart := time.Now()
-	var roomRates ratecache.RoomRates
-	stats := Stats{}
-	json.Unmarshal(data, &roomRates)
-	msg := roomRates.Validate()
-	if len(msg) > 0 {
-		stats.ExecutionTime = time.Since(execStart).Seconds()
-		return stats, msg, nil
+	importInfo.Report = checkRoomRates(context, &roomRates)
+	if len(importInfo.Report.Occupancy) > 0 || (context.Settings.StrictImport && importInfo.Report.HasIssues()) {
+		importInfo.Report.Rejected = true
+		context.Metrics.ValidationFailures.Inc("/import")
+		importInfo.Stats.ExecutionTime = time.Since(execStart).Seconds()
+		return importInfo, nil
 	}
+	context.mu.Lock()
+	defer context.mu.Unlock()
+	hdrSize := context.Fhdr.GetBlockHeaderSize()
+	cells := make([]byte, context.Fhdr.GetRateBlockSize()-hdrSize)
 	//Get index first
 	q := ratecache.IndexQuery{AccoCode: roomRates.AccoCode, RoomRateCode: roomRates.RoomRateCode}
 	for _, occupancyItem := range roomRates.Occupancy {
 		q.AddOccItem(occupancyItem.MinAge, occupancyItem.MaxAge, occupancyItem.Count)
 	}
 	index, found := context.Idx.Get(q)
-	if found == false {
+	if dryRun {
+		importInfo.Diff = &ImportDiff{}
+		if found == false {
+			importInfo.Diff.NewBlocks = append(importInfo.Diff.NewBlocks, BlockInfo{AccoCode: q.AccoCode, RoomRateCode: q.RoomRateCode, Occupancy: q.Occupancy})
+		}
+	} else if found == false {
 		rbhdr, _ := ratecache.NewRateBlockHeader(roomRates.AccoCode, roomRates.RoomRateCode)
 		for _, occupancyItem := range roomRates.Occupancy {
 			rbhdr.AddOccupancyItem(occupancyItem.MinAge, occupancyItem.MaxAge, occupancyItem.Count)
 		}
-		byteStr := ratecache.CreateRateBlock(context.Fhdr, rbhdr)
-		var err error
-		index, err = ratecache.AddRateBlockToFile(context.CacheFile, byteStr)
-		if err != nil {
-			stats.ExecutionTime = time.Since(execStart).Seconds()
-			return stats, msg, err
+		index, err = context.addRateBlock(rbhdr)
+		if _, ok := err.(JournalError); err != nil && !ok {
+			importInfo.Stats.ExecutionTime = time.Since(execStart).Seconds()
+			return importInfo, err
 		}
+		journalErr := err
+		context.Fhdr.RateBlockCount = index + 1
+		context.Metrics.NewBlocks.Inc()
 		roomOccIdx := ratecache.RoomOccIdx{Idx: index}
 		for _, occupancyItem := range roomRates.Occupancy {
 			roomOccIdx.AddOccItem(occupancyItem.MinAge, occupancyItem.MaxAge, occupancyItem.Count)
 		}
 		context.Idx.AddRoomOccIdx(q.AccoCode, q.RoomRateCode, roomOccIdx)
-		roomOccIdx.AppendToIdxFile(*context.Fhdr, filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx"), q.AccoCode, q.RoomRateCode)
-		if context.Settings.Notify {
-			notifyNewIdx(roomRates.AccoCode, roomRates.RoomRateCode, roomOccIdx, context.Settings.AddIndexUrls)
+		idxErr := roomOccIdx.AppendToIdxFile(*context.Fhdr, filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx"), q.AccoCode, q.RoomRateCode)
+		if context.Outbox != nil {
+			context.Outbox.Notify()
+		}
+		if idxErr != nil {
+			importInfo.Stats.ExecutionTime = time.Since(execStart).Seconds()
+			return importInfo, idxErr
+		}
+		if journalErr != nil {
+			importInfo.Stats.ExecutionTime = time.Since(execStart).Seconds()
+			return importInfo, journalErr
 		}
 		//context.Idx.Save(context.Fhdr, filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx"))
 	}
-	// Import data into cache
-	importRates(context, &stats, index, roomRates.Rates)
-	importAvail(context, &stats, index, roomRates.Availabilities)
-	stats.ExecutionTime = time.Since(execStart).Seconds()
-	return stats, msg, nil
+	cellsPos := context.Fhdr.GetRateBlockStart(index) + int64(hdrSize)
+	if found {
+		_, err = context.CacheFile.ReadAt(cells, cellsPos)
+		if err != nil {
+			importInfo.Stats.ExecutionTime = time.Since(execStart).Seconds()
+			return importInfo, err
+		}
+	}
+	oldCells := make([]byte, len(cells))
+	copy(oldCells, cells)
+	// Import data into cells
+	importRates(context, &importInfo.Stats, cells, roomRates.Rates)
+	importAvail(context, &importInfo.Stats, cells, roomRates.Availabilities)
+	importClosed(context, cells, roomRates.Closed)
+	if dryRun {
+		diffCells(context, importInfo.Diff, oldCells, cells)
+		for _, drr := range roomRates.Rates {
+			importInfo.Diff.TruncatedRates = append(importInfo.Diff.TruncatedRates, context.Fhdr.GetTruncated(time.Time(drr.FirstCheckIn), time.Time(drr.LastCheckIn), drr.LengthOfStay)...)
+		}
+		for _, dra := range roomRates.Availabilities {
+			importInfo.Diff.TruncatedAvailabilities = append(importInfo.Diff.TruncatedAvailabilities, context.Fhdr.GetTruncated(time.Time(dra.FirstCheckIn), time.Time(dra.LastCheckIn), dra.LengthOfStay)...)
+		}
+	} else {
+		err = writeChangedCells(context, cellsPos, oldCells, cells)
+		context.Metrics.ImportedCells.Add(float64(importInfo.Stats.RatesImported), "rate")
+		context.Metrics.ImportedCells.Add(float64(importInfo.Stats.AvailImported), "availability")
+		if err == nil {
+			err = context.updateTags(roomRates.TagUpdates())
+		}
+	}
+	importInfo.Stats.ExecutionTime = time.Since(execStart).Seconds()
+	return importInfo, err
 }
 
-func importRates(context *HandlerContext, stats *Stats, index uint32, dateRangeRates []ratecache.DateRangeRate) error {
-	hdrSize := context.Fhdr.GetBlockHeaderSize()
-	blockPos := context.Fhdr.GetRateBlockStart(index)
-	uintBuf := make([]byte, 4)
+// writeChangedCells writes the span of cells that differ
+// between oldCells and cells to the cache file.
+func writeChangedCells(context *HandlerContext, cellsPos int64, oldCells []byte, cells []byte) error {
+	first := 0
+	for first < len(cells) && cells[first] == oldCells[first] {
+		first++
+	}
+	if first == len(cells) {
+		return nil
+	}
+	last := len(cells)
+	for cells[last-1] == oldCells[last-1] {
+		last--
+	}
+	first -= first % 4
+	last += (4 - last%4) % 4
+	return context.writeCells(cells[first:last], cellsPos+int64(first))
+}
+
+// importRates writes the rates into the cells of a rate block. Availability
+// and closed flag of the cells are kept.
+func importRates(context *HandlerContext, stats *Stats, cells []byte, dateRangeRates []ratecache.DateRangeRate) {
 	for _, dateRangeRate := range dateRangeRates {
-		offset, explRange := dateRangeRate.ExplodeRate(context.Fhdr.StartDate, hdrSize, context.Fhdr.Days, context.Settings.DecimalPlaces)
+		offset, explRange := dateRangeRate.ExplodeRate(context.Fhdr.StartDate, 0, context.Fhdr.Days, context.Settings.DecimalPlaces, context.Fhdr.GetRateMask())
+		if offset < 0 || offset+len(explRange)*4 > len(cells) {
+			continue
+		}
 		stats.RatesImported += len(explRange)
-		bufsize := len(explRange) * 4
-		rbuf := make([]byte, bufsize)
-		context.CacheFile.ReadAt(rbuf, blockPos+int64(offset))
 		for i, rate := range explRange {
-			avail := binary.BigEndian.Uint32(rbuf[i*4:(i+1)*4]) & ratecache.AvailMask
-			rate := rate | avail
-			binary.BigEndian.PutUint32(uintBuf, rate)
-			context.CacheFile.WriteAt(uintBuf, (blockPos + int64(offset) + int64(4*i)))
+			cell := cells[offset+i*4 : offset+(i+1)*4]
+			avail := binary.BigEndian.Uint32(cell) & (ratecache.AvailMask | context.Fhdr.GetClosedFlag())
+			binary.BigEndian.PutUint32(cell, rate|avail)
 		}
-
 	}
-	return nil
 }
 
-func importAvail(context *HandlerContext, stats *Stats, index uint32, dateRangeAvails []ratecache.DateRangeAvail) error {
-	hdrSize := context.Fhdr.GetBlockHeaderSize()
-	blockPos := context.Fhdr.GetRateBlockStart(index)
+// importAvail writes the availabilities into the cells of a rate block.
+// Rate and closed flag of the cells are kept.
+func importAvail(context *HandlerContext, stats *Stats, cells []byte, dateRangeAvails []ratecache.DateRangeAvail) {
 	for _, dateRangeAvail := range dateRangeAvails {
-		offset, explRange := dateRangeAvail.ExplodeAvail(context.Fhdr.StartDate, hdrSize, context.Fhdr.Days)
+		offset, explRange := dateRangeAvail.ExplodeAvail(context.Fhdr.StartDate, 0, context.Fhdr.Days)
+		if offset < 0 || offset+len(explRange)*4 > len(cells) {
+			continue
+		}
 		stats.AvailImported += len(explRange)
-		bufsize := len(explRange) * 4
-		rbuf := make([]byte, bufsize)
-		context.CacheFile.ReadAt(rbuf, blockPos+int64(offset))
 		for i, avail := range explRange {
-			rate := binary.BigEndian.Uint32(rbuf[i*4:(i+1)*4]) & ratecache.RateMask
-			value := ratecache.PackRate(rate, avail)
-			context.CacheFile.WriteAt(value, blockPos+int64(offset)+int64(i*4))
+			cell := cells[offset+i*4 : offset+(i+1)*4]
+			rate := binary.BigEndian.Uint32(cell) & (ratecache.RateMask | ratecache.ClosedFlag)
+			binary.BigEndian.PutUint32(cell, rate|uint32(avail)<<28)
+		}
+	}
+}
+
+// importClosed sets the closed flag of the cells in the closed ranges.
+func importClosed(context *HandlerContext, cells []byte, closed []ratecache.DateRange) {
+	days := int(context.Fhdr.Days)
+	for _, dateRange := range closed {
+		dayOffset, count := context.Fhdr.ClipCheckIns(time.Time(dateRange.FirstCheckIn), time.Time(dateRange.LastCheckIn))
+		losOffset := int(dateRange.LengthOfStay-1) * days * 4
+		for i := dayOffset; i < dayOffset+count; i++ {
+			cell := cells[losOffset+i*4 : losOffset+(i+1)*4]
+			binary.BigEndian.PutUint32(cell, binary.BigEndian.Uint32(cell)|ratecache.ClosedFlag)
 		}
 	}
-	return nil
 }
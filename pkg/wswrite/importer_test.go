@@ -0,0 +1,59 @@
+package wswrite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestContext(t *testing.T) (*HandlerContext, func()) {
+	dir, err := ioutil.TempDir("", "wswrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := Settings{CacheDir: dir, IndexDir: dir, CacheFilename: "test.bin", Supplier: "TEST", Currency: "EUR",
+		DecimalPlaces: 2, MaxLos: 3, Days: 30, AccoCodeLength: 12, RoomRateCodeLength: 12, InitialRateBlockCapacity: 2}
+	f, idx, lock, err := LoadOrCreateCache(settings, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context, err := NewHandlerContext(settings, f, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return context, func() {
+		f.Close()
+		lock.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+func testImportData(context *HandlerContext, rate string, available string) []byte {
+	firstCheckIn := context.Fhdr.StartDate.AddDate(0, 0, 2).Format("2006-01-02")
+	lastCheckIn := context.Fhdr.StartDate.AddDate(0, 0, 5).Format("2006-01-02")
+	return []byte(`{"accommodationCode":"ALC001","roomRateCode":"DBLSTHB",
+		"Occupancy":[{"minAge":18,"maxAge":100,"count":2}],
+		"rates":[{"firstCheckIn":"` + firstCheckIn + `","lastCheckIn":"` + lastCheckIn + `","lengthOfStay":1,"rate":` + rate + `}],
+		"availabilities":[{"firstCheckIn":"` + firstCheckIn + `","lastCheckIn":"` + lastCheckIn + `","lengthOfStay":1,"available":` + available + `}]}`)
+}
+
+func TestImportIndexFileError(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	// a torn record at the end of the index file
+	f, err := os.OpenFile(filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("ALC"))
+	f.Close()
+	w := httptest.NewRecorder()
+	context.ImportHandler(w, httptest.NewRequest(http.MethodPost, "/import", bytes.NewReader(testImportData(context, "31.02", "5"))))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Value: %v, expected: 500", w.Code)
+	}
+}
@@ -0,0 +1,193 @@
+package wswrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// OpenJournal opens the journal of the cache file. If the journal is new,
+// the current content of the cache file, the removed rate blocks of idx
+// and the tags are written to it first, so that replicas can rebuild the
+// complete cache from the journal.
+// Otherwise the tags are appended, so that replicas have all of them even
+// if the journal was started before tags were added to it.
+func OpenJournal(settings Settings, cacheFile *os.File, idx *ratecache.CacheIndex, tags *ratecache.TagStore) (*ratecache.Journal, error) {
+	journal, err := ratecache.OpenJournal(filepath.Join(settings.IndexDir, settings.CacheFilename+".journal"))
+	if err != nil {
+		return nil, err
+	}
+	if journal.Size() > ratecache.JournalHeaderSize {
+		err = appendTags(journal, tags.Updates(""))
+	} else {
+		err = fillJournal(journal, cacheFile, idx, tags)
+	}
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	return journal, nil
+}
+
+// appendTags adds updates to the journal as JournalTags record.
+func appendTags(journal *ratecache.Journal, updates []ratecache.TagUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(updates)
+	if err != nil {
+		return err
+	}
+	return journal.Append(ratecache.JournalRecord{Type: ratecache.JournalTags, Data: data})
+}
+
+// fillJournal writes the current content of the cache file, the
+// removed rate blocks of idx and the tags to an empty journal.
+func fillJournal(journal *ratecache.Journal, cacheFile *os.File, idx *ratecache.CacheIndex, tags *ratecache.TagStore) error {
+	buf := make([]byte, ratecache.FileHeaderSize)
+	_, err := cacheFile.ReadAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	fhdr, err := ratecache.FileHeaderFromByteStr(buf)
+	if err != nil {
+		return err
+	}
+	statInfo, err := cacheFile.Stat()
+	if err != nil {
+		return err
+	}
+	blockSize := int64(fhdr.GetRateBlockSize())
+	capacity := (statInfo.Size() - ratecache.FileHeaderSize) / blockSize
+	err = journal.Append(ratecache.JournalRecord{Type: ratecache.JournalInit, Index: uint32(capacity), Data: buf})
+	if err != nil {
+		return err
+	}
+	hdrSize := fhdr.GetBlockHeaderSize()
+	block := make([]byte, blockSize)
+	empty := make([]byte, int(blockSize)-hdrSize)
+	for i := uint32(0); i < fhdr.RateBlockCount; i++ {
+		blockPos := fhdr.GetRateBlockStart(i)
+		_, err = cacheFile.ReadAt(block, blockPos)
+		if err != nil {
+			return err
+		}
+		err = journal.Append(ratecache.JournalRecord{Type: ratecache.JournalBlock, Index: i, Data: block[:hdrSize]})
+		if err != nil {
+			return err
+		}
+		if idx.IsRemoved(i) {
+			err = journal.Append(ratecache.JournalRecord{Type: ratecache.JournalRemove, Index: i})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if bytes.Equal(block[hdrSize:], empty) {
+			continue
+		}
+		err = journal.Append(ratecache.JournalRecord{Type: ratecache.JournalCells, Pos: blockPos + int64(hdrSize), Data: block[hdrSize:]})
+		if err != nil {
+			return err
+		}
+	}
+	return appendTags(journal, tags.Updates(""))
+}
+
+// writeCells writes cells of one rate block to the cache file at pos
+// and adds them to the journal.
+func (context *HandlerContext) writeCells(buf []byte, pos int64) error {
+	index := context.Fhdr.GetBlockIndex(pos)
+	err := context.preserveBlock(index)
+	if err != nil {
+		return err
+	}
+	err = context.Fhdr.WriteCellsAt(context.CacheFile, index, buf, pos)
+	if err != nil {
+		return err
+	}
+	return context.appendJournal(ratecache.JournalRecord{Type: ratecache.JournalCells, Pos: pos, Data: buf})
+}
+
+// addRateBlock adds an empty rate block to the cache file and to the
+// journal and returns the index of the new block. In case of a
+// JournalError the block has been added to the cache file.
+func (context *HandlerContext) addRateBlock(rbhdr *ratecache.RateBlockHeader) (uint32, error) {
+	byteStr := ratecache.CreateRateBlock(context.Fhdr, rbhdr)
+	index, err := ratecache.AddRateBlockToFile(context.CacheFile, byteStr)
+	if err != nil {
+		return index, err
+	}
+	hdrSize := context.Fhdr.GetBlockHeaderSize()
+	return index, context.appendJournal(ratecache.JournalRecord{Type: ratecache.JournalBlock, Index: index, Data: byteStr[:hdrSize]})
+}
+
+// JournalError is returned if a change was written to the cache file
+// but could not be added to the journal.
+type JournalError struct {
+	Err error
+}
+
+func (e JournalError) Error() string {
+	return "Could not append to journal: " + e.Err.Error()
+}
+
+// appendJournal adds a change that was already written to the cache file
+// to the journal. If that fails, the journal no longer matches the cache
+// file. It is reset and filled with the content of the cache file, so
+// that replicas rebuild their copy, and a JournalError is returned.
+func (context *HandlerContext) appendJournal(rec ratecache.JournalRecord) error {
+	if context.Journal == nil {
+		return nil
+	}
+	err := context.Journal.Append(rec)
+	if err == nil {
+		return context.compactJournal()
+	}
+	log.Printf("Could not append to journal, resetting it: %v", err)
+	resetErr := context.ResetJournal()
+	if resetErr != nil {
+		log.Printf("Could not reset journal, change stream is unavailable: %v", resetErr)
+	}
+	return JournalError{err}
+}
+
+// compactJournal creates the journal anew with the current content of the
+// cache file once the changes in it exceed MaxJournalSize, so that neither
+// the journal file nor its record offsets grow forever. Replicas get 409
+// for the old journal id and rebuild their copy. The caller holds mu.
+func (context *HandlerContext) compactJournal() error {
+	maxSize := context.Settings.MaxJournalSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxJournalSize
+	}
+	// size of the journal right after it was filled with the cache file
+	fhdr := context.Fhdr
+	compacted := ratecache.JournalHeaderSize + fhdr.GetRateBlockStart(fhdr.RateBlockCount) + int64(2*fhdr.RateBlockCount+1)*ratecache.JournalRecHdrSize
+	if context.Journal.Size()-compacted <= maxSize<<20 {
+		return nil
+	}
+	oldID := context.Journal.ID()
+	err := context.ResetJournal()
+	if err != nil {
+		log.Printf("Could not compact journal, change stream is unavailable: %v", err)
+		return JournalError{err}
+	}
+	log.Printf("Journal %v compacted, new journal %v", oldID, context.Journal.ID())
+	return nil
+}
+
+// ResetJournal creates the journal anew with the current content of the
+// cache file. Replicas notice the new journal id and rebuild their copy.
+// The caller holds mu.
+func (context *HandlerContext) ResetJournal() error {
+	err := context.Journal.Reset()
+	if err != nil {
+		return err
+	}
+	return fillJournal(context.Journal, context.CacheFile, context.Idx, context.Tags)
+}
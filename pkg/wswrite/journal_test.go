@@ -0,0 +1,54 @@
+package wswrite
+
+import (
+	"testing"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+func TestCompactJournal(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	var err error
+	context.Journal, err = OpenJournal(context.Settings, context.CacheFile, context.Idx, context.Tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.Journal.Close()
+	context.Settings.MaxJournalSize = 1
+	_, err = ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := context.Journal.ID()
+	// every import changes the same cells, so the journal grows by about
+	// 33 bytes per import and is compacted after about 32000 imports
+	var maxSize int64
+	for i := 0; i < 50000 && context.Journal.ID() == id; i++ {
+		rate := "31.02"
+		if i%2 == 0 {
+			rate = "40.00"
+		}
+		_, err = ImportAriData(context, testImportData(context, rate, "5"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if context.Journal.Size() > maxSize {
+			maxSize = context.Journal.Size()
+		}
+	}
+	if context.Journal.ID() == id {
+		t.Fatal("Journal was not compacted")
+	}
+	if maxSize > 1<<20+context.Fhdr.GetRateBlockStart(1)+1024 {
+		t.Errorf("Journal grew to %v bytes", maxSize)
+	}
+	// the compacted journal rebuilds the current cache file
+	records, _, err := context.Journal.Read("", 0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Type != ratecache.JournalInit || records[2].Type != ratecache.JournalCells {
+		t.Errorf("Unexpected records after compaction: %v", len(records))
+	}
+}
@@ -0,0 +1,63 @@
+package wswrite
+
+import (
+	"github.com/navegotel/openratecache/pkg/metrics"
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// Metrics contains the metrics of the writer, which are returned by
+// the /metrics endpoint.
+type Metrics struct {
+	Registry *metrics.Registry
+	HTTP     *metrics.HTTPMetrics
+	// ValidationFailures counts rejected requests by handler
+	ValidationFailures *metrics.Counter
+	// ImportedCells counts the imported cells by type rate or availability
+	ImportedCells *metrics.Counter
+	NewBlocks     *metrics.Counter
+	// NotificationFailures counts failed deliveries by url
+	NotificationFailures *metrics.Counter
+}
+
+// NewMetrics creates the metrics of the writer of context.
+func NewMetrics(context *HandlerContext) *Metrics {
+	registry := metrics.NewRegistry("openratecache")
+	m := Metrics{
+		Registry:             registry,
+		HTTP:                 metrics.NewHTTPMetrics(registry),
+		ValidationFailures:   registry.NewCounter("validation_failures_total", "Number of requests rejected by validation.", "handler"),
+		ImportedCells:        registry.NewCounter("imported_cells_total", "Number of imported cells by type.", "type"),
+		NewBlocks:            registry.NewCounter("rate_blocks_created_total", "Number of rate blocks created by imports."),
+		NotificationFailures: registry.NewCounter("notification_failures_total", "Number of failed deliveries of index entries.", "url"),
+	}
+	registry.NewGaugeFunc("index_accommodations", "Number of accommodations in the index.", func() float64 {
+		return float64(context.Idx.GetAccoCount())
+	})
+	registry.NewGaugeFunc("index_entries", "Number of rate blocks in the index.", func() float64 {
+		return float64(context.Idx.GetEntryCount())
+	})
+	registry.NewGaugeFunc("rate_blocks", "Number of rate blocks in the cache file.", func() float64 {
+		return float64(context.rateBlockCount())
+	})
+	registry.NewGaugeFunc("cache_file_bytes", "Size of the cache file.", func() float64 {
+		size, _ := context.cacheFileSize()
+		return float64(size)
+	})
+	registry.NewGaugeFunc("rate_block_capacity", "Number of rate blocks the cache file has room for.", func() float64 {
+		size, blockSize := context.cacheFileSize()
+		if blockSize == 0 {
+			return 0
+		}
+		return float64((size - ratecache.FileHeaderSize) / blockSize)
+	})
+	return &m
+}
+
+// cacheFileSize returns the size of the cache file and of a rate block.
+func (context *HandlerContext) cacheFileSize() (int64, int64) {
+	fileInfo, err := context.CacheFile.Stat()
+	if err != nil {
+		return 0, 0
+	}
+	return fileInfo.Size(), int64(context.Fhdr.GetRateBlockSize())
+}
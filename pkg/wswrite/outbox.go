@@ -0,0 +1,331 @@
+package wswrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// Outbox delivers the index entries of new rate blocks to the
+// addIndexUrls. Rate blocks are only ever appended, so the entries
+// themselves are read from the cache file and the outbox only keeps
+// the index of the next block to deliver for every subscriber. Entries
+// of removed rate blocks are sent with Removed set, both for new blocks
+// that were removed before delivery and for blocks removed after; the
+// latter are kept as pending removals per subscriber. Offsets and pending
+// removals are saved in <cacheFilename>.outbox in the index directory,
+// so entries that could not be delivered are sent again after a restart.
+// Entries are sent in batches of up to outboxBatchSize as JSON array,
+// new rate blocks before removals. Failed deliveries are retried with
+// exponential backoff. Delivery runs from Start until Stop.
+type Outbox struct {
+	context  *HandlerContext
+	filename string
+	offsets  map[string]uint32
+	removals map[string][]uint32
+	wake     map[string]chan struct{}
+	client   *http.Client
+	mu       sync.Mutex
+	// stop is closed by Stop, nil while delivery is not running
+	stop    chan struct{}
+	running sync.WaitGroup
+	// minBackoff and maxBackoff limit the wait time between retries
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// outboxState is the content of the outbox file. Outbox files written
+// before removals were delivered only contain the offsets map.
+type outboxState struct {
+	Offsets  map[string]uint32   `json:"offsets"`
+	Removals map[string][]uint32 `json:"removals,omitempty"`
+}
+
+// NewOutbox creates the outbox for the addIndexUrls in the settings and
+// loads the saved offsets and pending removals. Subscribers without saved
+// offset start with the next new rate block.
+func NewOutbox(context *HandlerContext) (*Outbox, error) {
+	outbox := Outbox{
+		context:    context,
+		filename:   filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".outbox"),
+		offsets:    make(map[string]uint32),
+		removals:   make(map[string][]uint32),
+		wake:       make(map[string]chan struct{}),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+	}
+	var saved outboxState
+	buf, err := ioutil.ReadFile(outbox.filename)
+	if err == nil {
+		err = json.Unmarshal(buf, &saved)
+		if err == nil && saved.Offsets == nil {
+			err = json.Unmarshal(buf, &saved.Offsets)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	count := context.rateBlockCount()
+	for _, url := range context.Settings.AddIndexUrls {
+		offset, ok := saved.Offsets[url]
+		if !ok || offset > count {
+			offset = count
+		}
+		outbox.offsets[url] = offset
+		if len(saved.Removals[url]) > 0 {
+			outbox.removals[url] = saved.Removals[url]
+		}
+		outbox.wake[url] = make(chan struct{}, 1)
+	}
+	return &outbox, outbox.save()
+}
+
+// Start starts delivering entries to all subscribers in the background.
+// It does nothing if delivery is already running.
+func (outbox *Outbox) Start() {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	if outbox.stop != nil {
+		return
+	}
+	outbox.stop = make(chan struct{})
+	for url := range outbox.offsets {
+		outbox.running.Add(1)
+		go outbox.deliver(url, outbox.stop)
+	}
+}
+
+// Stop stops delivery and waits until a running request is finished.
+// Delivery continues from the saved offsets on the next Start.
+func (outbox *Outbox) Stop() {
+	outbox.mu.Lock()
+	stop := outbox.stop
+	outbox.stop = nil
+	outbox.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	outbox.running.Wait()
+}
+
+// Notify wakes up delivery after a new rate block was added.
+func (outbox *Outbox) Notify() {
+	for _, wake := range outbox.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NotifyRemoved adds the removal of a rate block to the pending removals
+// of all subscribers and wakes up delivery. The removal is also added if
+// the block has not been delivered yet; it is then sent as removed entry
+// twice, which the receiver ignores.
+func (outbox *Outbox) NotifyRemoved(index uint32) error {
+	outbox.mu.Lock()
+	for url := range outbox.offsets {
+		outbox.removals[url] = append(outbox.removals[url], index)
+	}
+	err := outbox.save()
+	outbox.mu.Unlock()
+	outbox.Notify()
+	return err
+}
+
+// Offset returns the index of the next rate block to deliver to url.
+func (outbox *Outbox) Offset(url string) uint32 {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	return outbox.offsets[url]
+}
+
+func (outbox *Outbox) setOffset(url string, offset uint32) error {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	outbox.offsets[url] = offset
+	return outbox.save()
+}
+
+// Removals returns the indexes of the removed rate blocks that still
+// have to be delivered to url.
+func (outbox *Outbox) Removals(url string) []uint32 {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	return append([]uint32(nil), outbox.removals[url]...)
+}
+
+// dropRemovals removes the first n pending removals of url after they
+// have been delivered.
+func (outbox *Outbox) dropRemovals(url string, n int) error {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	outbox.removals[url] = outbox.removals[url][n:]
+	if len(outbox.removals[url]) == 0 {
+		delete(outbox.removals, url)
+	}
+	return outbox.save()
+}
+
+// save writes offsets and pending removals to the outbox file. The caller
+// must hold the lock unless delivery has not started yet.
+func (outbox *Outbox) save() error {
+	jsonStr, err := json.Marshal(outboxState{Offsets: outbox.offsets, Removals: outbox.removals})
+	if err != nil {
+		return err
+	}
+	tmpFilename := outbox.filename + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, jsonStr, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, outbox.filename)
+}
+
+// outboxBatchSize is the maximum number of entries sent in one request.
+const outboxBatchSize = 1000
+
+// deliver sends the entries of all rate blocks after the offset of url
+// and then the pending removals in batches and waits for new blocks or
+// removals if url is up to date. It returns once stop is closed.
+func (outbox *Outbox) deliver(url string, stop chan struct{}) {
+	defer outbox.running.Done()
+	backoff := time.Duration(0)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		offset := outbox.Offset(url)
+		count := outbox.context.rateBlockCount()
+		removals := outbox.Removals(url)
+		if offset >= count && len(removals) == 0 {
+			select {
+			case <-outbox.wake[url]:
+			case <-time.After(30 * time.Second):
+			case <-stop:
+				return
+			}
+			continue
+		}
+		var msgs []NewIdxNotification
+		var delivered func() error
+		var err error
+		if offset < count {
+			end := count
+			if end-offset > outboxBatchSize {
+				end = offset + outboxBatchSize
+			}
+			msgs, err = outbox.newEntries(offset, end)
+			delivered = func() error { return outbox.setOffset(url, end) }
+		} else {
+			if len(removals) > outboxBatchSize {
+				removals = removals[:outboxBatchSize]
+			}
+			msgs, err = outbox.removedEntries(removals)
+			delivered = func() error { return outbox.dropRemovals(url, len(removals)) }
+		}
+		if err == nil {
+			err = outbox.post(url, msgs)
+		}
+		if err != nil {
+			outbox.context.Metrics.NotificationFailures.Inc(url)
+			if backoff < outbox.minBackoff {
+				backoff = outbox.minBackoff
+			} else if backoff*2 <= outbox.maxBackoff {
+				backoff *= 2
+			} else {
+				backoff = outbox.maxBackoff
+			}
+			log.Printf("Delivery of %d index entries to %v failed, retrying in %v: %v", len(msgs), url, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return
+			}
+			continue
+		}
+		backoff = 0
+		err = delivered()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// newEntries returns the entries of the rate blocks from start to end
+// (exclusive). Blocks removed in the meantime are marked as removed.
+func (outbox *Outbox) newEntries(start uint32, end uint32) ([]NewIdxNotification, error) {
+	msgs := make([]NewIdxNotification, 0, end-start)
+	for index := start; index < end; index++ {
+		entry, err := outbox.context.readIdxEntry(index)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, NewIdxNotification{AccoCode: entry.AccoCode, RoomRateCode: entry.RoomRateCode, RoomOccIdx: entry.RoomOccIdx,
+			Removed: outbox.context.Idx.IsRemoved(index)})
+	}
+	return msgs, nil
+}
+
+// removedEntries returns the entries of the removed rate blocks in indexes.
+func (outbox *Outbox) removedEntries(indexes []uint32) ([]NewIdxNotification, error) {
+	msgs := make([]NewIdxNotification, 0, len(indexes))
+	for _, index := range indexes {
+		entry, err := outbox.context.readIdxEntry(index)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, NewIdxNotification{AccoCode: entry.AccoCode, RoomRateCode: entry.RoomRateCode, RoomOccIdx: entry.RoomOccIdx, Removed: true})
+	}
+	return msgs, nil
+}
+
+// post sends msgs to url.
+func (outbox *Outbox) post(url string, msgs []NewIdxNotification) error {
+	jsonMsg, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	rsp, err := outbox.client.Post(url, "application/json", bytes.NewReader(jsonMsg))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response status %v", rsp.Status)
+	}
+	return nil
+}
+
+// rateBlockCount returns the number of rate blocks in the cache file.
+func (context *HandlerContext) rateBlockCount() uint32 {
+	context.mu.Lock()
+	defer context.mu.Unlock()
+	return context.Fhdr.RateBlockCount
+}
+
+// readIdxEntry reads the index entry of a rate block from its header.
+// Rate block headers never change once the block has been added.
+func (context *HandlerContext) readIdxEntry(index uint32) (ratecache.IdxEntry, error) {
+	buf := make([]byte, context.Fhdr.GetBlockHeaderSize())
+	_, err := context.CacheFile.ReadAt(buf, context.Fhdr.GetRateBlockStart(index))
+	if err != nil {
+		return ratecache.IdxEntry{}, err
+	}
+	return ratecache.IdxEntryFromBlockHeader(buf, context.Fhdr.AccoCodeLength, context.Fhdr.RoomRateCodeLength, index), nil
+}
@@ -0,0 +1,170 @@
+package wswrite
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	var mu sync.Mutex
+	var received []NewIdxNotification
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "Service Unavailable", 503)
+			return
+		}
+		var msgs []NewIdxNotification
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &msgs)
+		received = append(received, msgs...)
+	}))
+	defer server.Close()
+	context.Settings.AddIndexUrls = []string{server.URL}
+	outbox, err := NewOutbox(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.minBackoff = time.Millisecond
+	context.Outbox = outbox
+	outbox.Start()
+	defer outbox.Stop()
+	_, err = ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for outbox.Offset(server.URL) < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("Value: %v, expected one delivered entry", len(received))
+	}
+	if received[0].AccoCode != "ALC001" || received[0].RoomRateCode != "DBLSTHB" || received[0].RoomOccIdx.Idx != 0 {
+		t.Errorf("Unexpected entry %v", received[0])
+	}
+	// the offset is saved and used again
+	reopened, err := NewOutbox(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Offset(server.URL) != 1 {
+		t.Errorf("Value: %v, expected: 1", reopened.Offset(server.URL))
+	}
+}
+
+func TestOutboxRemovals(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	var mu sync.Mutex
+	var received []NewIdxNotification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var msgs []NewIdxNotification
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &msgs)
+		received = append(received, msgs...)
+	}))
+	defer server.Close()
+	context.Settings.AddIndexUrls = []string{server.URL}
+	// outbox files with offsets only are read
+	outboxFilename := filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".outbox")
+	err := ioutil.WriteFile(outboxFilename, []byte(`{"`+server.URL+`":0}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := NewOutbox(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Offset(server.URL) != 0 {
+		t.Errorf("Value: %v, expected: 0", outbox.Offset(server.URL))
+	}
+	context.Outbox = outbox
+	_, err = ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Remove(context, []byte(`{"accommodationCode":"ALC001"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pending removals are saved
+	reopened, err := NewOutbox(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removals := reopened.Removals(server.URL); len(removals) != 1 || removals[0] != 0 {
+		t.Errorf("Value: %v, expected: [0]", removals)
+	}
+
+	// the new rate block is sent as removed and then the removal
+	outbox.Start()
+	defer outbox.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for (outbox.Offset(server.URL) < 1 || len(outbox.Removals(server.URL)) > 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || !received[0].Removed || !received[1].Removed || received[1].AccoCode != "ALC001" || received[1].RoomOccIdx.Idx != 0 {
+		t.Errorf("Value: %v, expected two removed entries of rate block 0", received)
+	}
+}
+
+// deliveries waits up to a second until there are want delivery
+// goroutines and returns their number.
+func deliveries(want int) int {
+	buf := make([]byte, 1<<20)
+	n := 0
+	for i := 0; i < 100; i++ {
+		n = strings.Count(string(buf[:runtime.Stack(buf, true)]), "created by github.com/navegotel/openratecache/pkg/wswrite.(*Outbox).Start")
+		if n == want {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n
+}
+
+func TestOutboxStop(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	context.Settings.AddIndexUrls = []string{"http://localhost:1/addindex", "http://localhost:2/addindex"}
+	outbox, err := NewOutbox(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// starting twice does not start more goroutines
+	outbox.Start()
+	outbox.Start()
+	if n := deliveries(2); n != 2 {
+		t.Errorf("Value: %v, expected: 2", n)
+	}
+	outbox.Stop()
+	if n := deliveries(0); n != 0 {
+		t.Errorf("Value: %v, expected: 0", n)
+	}
+	// delivery can be started again after Stop
+	outbox.Start()
+	outbox.Stop()
+	if n := deliveries(0); n != 0 {
+		t.Errorf("Value: %v, expected: 0", n)
+	}
+}
@@ -0,0 +1,107 @@
+package wswrite
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// Range operations that can be applied to the cells of rate blocks.
+const (
+	// OpClose closes cells for sale but keeps rate and availability.
+	OpClose = iota
+	// OpOpen re-opens closed cells.
+	OpOpen
+	// OpClear resets cells to unknown, i.e. rate and availability 0.
+	OpClear
+)
+
+// opHandlers are the endpoints of the range operations.
+var opHandlers = map[int]string{OpClose: "/close", OpOpen: "/open", OpClear: "/clear"}
+
+// RangeOpInfo is returned as response to a range operation.
+type RangeOpInfo struct {
+	Errors        []string `json:"errors"`
+	Changed       int      `json:"changed"`
+	ExecutionTime float64  `json:"executionTime"`
+}
+
+func applyOp(op int, cell uint32) uint32 {
+	switch op {
+	case OpClose:
+		return cell | ratecache.ClosedFlag
+	case OpOpen:
+		return cell &^ ratecache.ClosedFlag
+	default:
+		return 0
+	}
+}
+
+// ApplyRangeOperation applies the operation op to all cells selected
+// by the ratecache.RangeOperation in data and returns the number of cells
+// that changed. A RequestError is returned if data cannot be decoded.
+func ApplyRangeOperation(context *HandlerContext, op int, data []byte) (RangeOpInfo, error) {
+	execStart := time.Now()
+	var rangeOp ratecache.RangeOperation
+	info := RangeOpInfo{}
+	err := json.Unmarshal(data, &rangeOp)
+	if err != nil {
+		return info, RequestError{err}
+	}
+	info.Errors = rangeOp.Validate(context.Fhdr.MaxLos)
+	if op != OpClear && !context.Fhdr.HasClosedFlag() {
+		info.Errors = append(info.Errors, fmt.Sprintf("Cells of cache format version %d cannot be closed or opened", context.Fhdr.Version))
+	}
+	if len(info.Errors) > 0 {
+		context.Metrics.ValidationFailures.Inc(opHandlers[op])
+		info.ExecutionTime = time.Since(execStart).Seconds()
+		return info, nil
+	}
+	losList := rangeOp.LengthsOfStay
+	if len(losList) == 0 {
+		for los := uint8(1); los <= context.Fhdr.MaxLos; los++ {
+			losList = append(losList, los)
+		}
+	}
+	dayOffset, count := context.Fhdr.ClipCheckIns(time.Time(rangeOp.FirstCheckIn), time.Time(rangeOp.LastCheckIn))
+	if count == 0 {
+		info.ExecutionTime = time.Since(execStart).Seconds()
+		return info, nil
+	}
+	entries := context.Idx.Select(rangeOp.AccoCode, rangeOp.RoomRateCode, rangeOp.RoomRateCodePrefix)
+	buf := make([]byte, count*4)
+	context.mu.Lock()
+	defer context.mu.Unlock()
+	for _, entry := range entries {
+		blockPos := context.Fhdr.GetRateBlockStart(entry.RoomOccIdx.Idx)
+		for _, los := range losList {
+			pos := blockPos + context.Fhdr.GetLosOffset(los) + int64(dayOffset*4)
+			_, err = context.CacheFile.ReadAt(buf, pos)
+			if err != nil {
+				return info, err
+			}
+			changed := 0
+			for i := 0; i < count; i++ {
+				cell := binary.BigEndian.Uint32(buf[i*4 : (i+1)*4])
+				newCell := applyOp(op, cell)
+				if newCell != cell {
+					binary.BigEndian.PutUint32(buf[i*4:(i+1)*4], newCell)
+					changed++
+				}
+			}
+			if changed == 0 {
+				continue
+			}
+			err = context.writeCells(buf, pos)
+			if err != nil {
+				return info, err
+			}
+			info.Changed += changed
+		}
+	}
+	info.ExecutionTime = time.Since(execStart).Seconds()
+	return info, nil
+}
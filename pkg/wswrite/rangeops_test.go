@@ -0,0 +1,58 @@
+package wswrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRangeOperation(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	rangeOp := []byte(`{"accommodationCode":"ALC001","firstCheckIn":"` + context.Fhdr.StartDate.Format("2006-01-02") +
+		`","lastCheckIn":"` + context.Fhdr.StartDate.AddDate(0, 0, 3).Format("2006-01-02") + `","lengthsOfStay":[1]}`)
+	info, err := ApplyRangeOperation(context, OpClose, rangeOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Changed != 4 {
+		t.Errorf("Value: %v, expected: 4", info.Changed)
+	}
+	info, _ = ApplyRangeOperation(context, OpOpen, rangeOp)
+	if info.Changed != 4 {
+		t.Errorf("Value: %v, expected: 4", info.Changed)
+	}
+	info, _ = ApplyRangeOperation(context, OpClear, rangeOp)
+	if info.Changed != 2 {
+		t.Errorf("Value: %v, expected: 2", info.Changed)
+	}
+	// version 8 has no closed flag
+	context.Fhdr.Version = 8
+	info, _ = ApplyRangeOperation(context, OpClose, rangeOp)
+	if len(info.Errors) != 1 || info.Changed != 0 {
+		t.Errorf("Expected an error for version 8, got %v", info)
+	}
+}
+
+func TestRangeOperationHandlerStatus(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		context.CloseHandler(w, httptest.NewRequest(http.MethodPost, "/close", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := post(`{"accommodationCode":`); code != http.StatusBadRequest {
+		t.Errorf("Value: %v, expected: 400", code)
+	}
+	// the cache file cannot be read any more
+	context.CacheFile.Close()
+	body := `{"accommodationCode":"ALC001","firstCheckIn":"` + context.Fhdr.StartDate.Format("2006-01-02") +
+		`","lastCheckIn":"` + context.Fhdr.StartDate.AddDate(0, 0, 3).Format("2006-01-02") + `"}`
+	if code := post(body); code != http.StatusInternalServerError {
+		t.Errorf("Value: %v, expected: 500", code)
+	}
+}
@@ -0,0 +1,75 @@
+package wswrite
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// RemoveRq selects the room rates to remove from the index, either one
+// room rate, all room rates with a code prefix or the whole
+// accommodation.
+type RemoveRq struct {
+	AccoCode           string `json:"accommodationCode"`
+	RoomRateCode       string `json:"roomRateCode"`
+	RoomRateCodePrefix string `json:"roomRateCodePrefix"`
+}
+
+// RemoveInfo is returned as response to a remove request.
+type RemoveInfo struct {
+	Errors        []string `json:"errors"`
+	Removed       int      `json:"removed"`
+	ExecutionTime float64  `json:"executionTime"`
+}
+
+// Remove removes the index entries of the rate blocks selected by the
+// RemoveRq in data. A tombstone record is appended to the index file for
+// every entry and the removal is added to the journal and the outbox.
+// The rate blocks stay in the cache file, but are not found any more;
+// importing the room rate again adds new rate blocks. A RequestError is
+// returned if data cannot be decoded.
+func Remove(context *HandlerContext, data []byte) (RemoveInfo, error) {
+	execStart := time.Now()
+	var removeRq RemoveRq
+	info := RemoveInfo{}
+	err := json.Unmarshal(data, &removeRq)
+	if err != nil {
+		return info, RequestError{err}
+	}
+	if len(removeRq.AccoCode) == 0 {
+		info.Errors = append(info.Errors, "accommodationCode is required")
+	}
+	if len(removeRq.RoomRateCode) > 0 && len(removeRq.RoomRateCodePrefix) > 0 {
+		info.Errors = append(info.Errors, "roomRateCode and roomRateCodePrefix cannot be combined")
+	}
+	if len(info.Errors) > 0 {
+		context.Metrics.ValidationFailures.Inc("/remove")
+		info.ExecutionTime = time.Since(execStart).Seconds()
+		return info, nil
+	}
+	idxFilename := filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx")
+	context.mu.Lock()
+	defer context.mu.Unlock()
+	for _, entry := range context.Idx.Select(removeRq.AccoCode, removeRq.RoomRateCode, removeRq.RoomRateCodePrefix) {
+		err = ratecache.AppendIdxRecord(context.Fhdr, idxFilename, ratecache.IdxRecord{Entry: entry, Tombstone: true})
+		if err != nil {
+			return info, err
+		}
+		context.Idx.RemoveRoomOccIdx(entry.AccoCode, entry.RoomRateCode, entry.RoomOccIdx.Idx)
+		info.Removed++
+		err = context.appendJournal(ratecache.JournalRecord{Type: ratecache.JournalRemove, Index: entry.RoomOccIdx.Idx})
+		if err != nil {
+			return info, err
+		}
+		if context.Outbox != nil {
+			err = context.Outbox.NotifyRemoved(entry.RoomOccIdx.Idx)
+			if err != nil {
+				return info, err
+			}
+		}
+	}
+	info.ExecutionTime = time.Since(execStart).Seconds()
+	return info, nil
+}
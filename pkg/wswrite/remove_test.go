@@ -0,0 +1,82 @@
+package wswrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+func TestRemove(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	var err error
+	context.Journal, err = OpenJournal(context.Settings, context.CacheFile, context.Idx, context.Tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.Journal.Close()
+	ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	offset := context.Journal.Size()
+	info, err := Remove(context, []byte(`{"roomRateCode":"DBLSTHB"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Errors) != 1 || info.Removed != 0 {
+		t.Errorf("Expected an error without accommodationCode, got %v", info)
+	}
+	info, err = Remove(context, []byte(`{"accommodationCode":"ALC001","roomRateCode":"DBLSTHB"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Removed != 1 || context.Idx.GetEntryCount() != 0 || !context.Idx.IsRemoved(0) {
+		t.Errorf("Value: %v, expected: 1 removed entry", info)
+	}
+	recs, _, err := context.Journal.Read(context.Journal.ID(), offset, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Type != ratecache.JournalRemove || recs[0].Index != 0 {
+		t.Errorf("Value: %v, expected: one JournalRemove record", recs)
+	}
+
+	// the tombstone is in the index file and survives saving the index
+	cacheFilename := filepath.Join(context.Settings.CacheDir, context.Settings.CacheFilename)
+	idxFilename := filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx")
+	for i := 0; i < 2; i++ {
+		idx := ratecache.NewCacheIndex()
+		err = idx.Load(context.Fhdr, idxFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx.GetEntryCount() != 0 || len(idx.Removed()) != 1 {
+			t.Errorf("Value: %v entries, %v removed, expected: 0 entries, 1 removed", idx.GetEntryCount(), len(idx.Removed()))
+		}
+		report, err := ratecache.CheckCache(cacheFilename, idxFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Errorf("Unexpected issues: %v", report.Issues)
+		}
+		err = ratecache.WriteIndexFile(idx, context.Fhdr, idxFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// importing the room rate again adds a new rate block
+	ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if results := context.Idx.Select("ALC001", "DBLSTHB", ""); len(results) != 1 || results[0].RoomOccIdx.Idx != 1 {
+		t.Errorf("Value: %v, expected: entry for rate block 1", results)
+	}
+
+	w := httptest.NewRecorder()
+	context.RemoveHandler(w, httptest.NewRequest(http.MethodPost, "/remove", strings.NewReader(`{"accommodationCode":`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Value: %v, expected: 400", w.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package wswrite
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// RangeIssue is a range of check-in dates from the import data that
+// could not be imported completely. Type is either "rate" or
+// "availability".
+type RangeIssue struct {
+	Type string `json:"type"`
+	ratecache.DateRange
+}
+
+// ImportReport lists all data of an import that was cut off or ignored.
+// In strict mode the whole item is rejected if the report is not empty.
+type ImportReport struct {
+	// OutOfWindow contains check-in dates before the cache date or
+	// beyond the configured number of days.
+	OutOfWindow []RangeIssue `json:"outOfWindow"`
+	// InvalidLos contains ranges with length of stay 0 or above maxLos.
+	InvalidLos []RangeIssue `json:"invalidLos"`
+	// InvertedRanges contains ranges whose firstCheckIn is after the
+	// lastCheckIn. They are ignored.
+	InvertedRanges []RangeIssue `json:"invertedRanges"`
+	// InvalidRates contains ranges with negative rates or rates that
+	// are too big to be stored in the cache.
+	InvalidRates []RangeIssue `json:"invalidRates"`
+	// ClampedAvailabilities contains ranges with an availability above
+	// 15, which is stored as 15.
+	ClampedAvailabilities []RangeIssue `json:"clampedAvailabilities"`
+	// UnsupportedClosed contains closed ranges for cache files of format
+	// version 8, which cannot store the closed flag. They are ignored.
+	UnsupportedClosed []RangeIssue `json:"unsupportedClosed"`
+	// Occupancy contains errors in the occupancy. Items with an invalid
+	// occupancy are always rejected.
+	Occupancy []string `json:"occupancy"`
+	// LongCodes contains codes that are longer than the configured
+	// code lengths and are cut off at the last complete UTF-8 character.
+	// Distinct codes may be stored as the same code.
+	LongCodes []string `json:"longCodes"`
+	Rejected  bool     `json:"rejected"`
+}
+
+// HasIssues returns true if anything was reported.
+func (report *ImportReport) HasIssues() bool {
+	return len(report.OutOfWindow) > 0 || len(report.InvalidLos) > 0 || len(report.InvertedRanges) > 0 ||
+		len(report.InvalidRates) > 0 || len(report.ClampedAvailabilities) > 0 || len(report.UnsupportedClosed) > 0 || len(report.Occupancy) > 0 || len(report.LongCodes) > 0
+}
+
+func (report *ImportReport) checkRange(context *HandlerContext, issueType string, dateRange ratecache.DateRange) bool {
+	if dateRange.LengthOfStay == 0 || dateRange.LengthOfStay > context.Fhdr.MaxLos {
+		report.InvalidLos = append(report.InvalidLos, RangeIssue{Type: issueType, DateRange: dateRange})
+		return false
+	}
+	if time.Time(dateRange.LastCheckIn).Before(time.Time(dateRange.FirstCheckIn)) {
+		report.InvertedRanges = append(report.InvertedRanges, RangeIssue{Type: issueType, DateRange: dateRange})
+		return false
+	}
+	for _, truncated := range context.Fhdr.GetTruncated(time.Time(dateRange.FirstCheckIn), time.Time(dateRange.LastCheckIn), dateRange.LengthOfStay) {
+		report.OutOfWindow = append(report.OutOfWindow, RangeIssue{Type: issueType, DateRange: truncated})
+	}
+	return true
+}
+
+// truncateCode cuts code to at most length bytes without splitting
+// a UTF-8 encoded character.
+func truncateCode(code string, length int) string {
+	for length > 0 && !utf8.RuneStart(code[length]) {
+		length--
+	}
+	return code[:length]
+}
+
+// checkRoomRates checks roomRates against the limits of the cache and
+// returns a report. Codes that are too long are cut off and ranges that
+// cannot be imported are removed from roomRates.
+func checkRoomRates(context *HandlerContext, roomRates *ratecache.RoomRates) ImportReport {
+	report := ImportReport{}
+	if len(roomRates.AccoCode) > int(context.Fhdr.AccoCodeLength) {
+		code := truncateCode(roomRates.AccoCode, int(context.Fhdr.AccoCodeLength))
+		report.LongCodes = append(report.LongCodes, fmt.Sprintf("accommodationCode %v is longer than %d bytes and is stored as %v", roomRates.AccoCode, context.Fhdr.AccoCodeLength, code))
+		roomRates.AccoCode = code
+	}
+	if len(roomRates.RoomRateCode) > int(context.Fhdr.RoomRateCodeLength) {
+		code := truncateCode(roomRates.RoomRateCode, int(context.Fhdr.RoomRateCodeLength))
+		report.LongCodes = append(report.LongCodes, fmt.Sprintf("roomRateCode %v is longer than %d bytes and is stored as %v", roomRates.RoomRateCode, context.Fhdr.RoomRateCodeLength, code))
+		roomRates.RoomRateCode = code
+	}
+	if len(roomRates.Occupancy) > 8 {
+		report.Occupancy = append(report.Occupancy, fmt.Sprintf("Occupancy has %d items, no more than 8 are allowed", len(roomRates.Occupancy)))
+	}
+	for _, item := range roomRates.Occupancy {
+		if item.MinAge > item.MaxAge || item.Count == 0 {
+			report.Occupancy = append(report.Occupancy, fmt.Sprintf("Invalid occupancy item %d-%d x%d", item.MinAge, item.MaxAge, item.Count))
+		}
+	}
+	var rates []ratecache.DateRangeRate
+	for _, drr := range roomRates.Rates {
+		dateRange := ratecache.DateRange{FirstCheckIn: drr.FirstCheckIn, LastCheckIn: drr.LastCheckIn, LengthOfStay: drr.LengthOfStay}
+		if !report.checkRange(context, "rate", dateRange) {
+			continue
+		}
+		if _, ok := drr.GetRate(context.Settings.DecimalPlaces, context.Fhdr.GetRateMask()); !ok {
+			report.InvalidRates = append(report.InvalidRates, RangeIssue{Type: "rate", DateRange: dateRange})
+			continue
+		}
+		rates = append(rates, drr)
+	}
+	roomRates.Rates = rates
+	var avails []ratecache.DateRangeAvail
+	for _, dra := range roomRates.Availabilities {
+		dateRange := ratecache.DateRange{FirstCheckIn: dra.FirstCheckIn, LastCheckIn: dra.LastCheckIn, LengthOfStay: dra.LengthOfStay}
+		if !report.checkRange(context, "availability", dateRange) {
+			continue
+		}
+		if dra.Available > 15 {
+			report.ClampedAvailabilities = append(report.ClampedAvailabilities, RangeIssue{Type: "availability", DateRange: dateRange})
+		}
+		avails = append(avails, dra)
+	}
+	roomRates.Availabilities = avails
+	var closed []ratecache.DateRange
+	for _, dateRange := range roomRates.Closed {
+		if !report.checkRange(context, "closed", dateRange) {
+			continue
+		}
+		if !context.Fhdr.HasClosedFlag() {
+			report.UnsupportedClosed = append(report.UnsupportedClosed, RangeIssue{Type: "closed", DateRange: dateRange})
+			continue
+		}
+		closed = append(closed, dateRange)
+	}
+	roomRates.Closed = closed
+	return report
+}
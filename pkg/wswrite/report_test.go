@@ -0,0 +1,46 @@
+package wswrite
+
+import (
+	"testing"
+)
+
+func TestImportReport(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	data := []byte(`{"accommodationCode":"ALC001","roomRateCode":"DBLSTHBNONREFUNDABLE",
+		"Occupancy":[{"minAge":18,"maxAge":100,"count":2}],
+		"rates":[{"firstCheckIn":"2000-01-01","lastCheckIn":"2000-01-05","lengthOfStay":1,"rate":20},
+			{"firstCheckIn":"2000-01-01","lastCheckIn":"2000-01-05","lengthOfStay":0,"rate":20},
+			{"firstCheckIn":"2000-01-01","lastCheckIn":"2000-01-05","lengthOfStay":1,"rate":5000000},
+			{"firstCheckIn":"2000-01-05","lastCheckIn":"2000-01-01","lengthOfStay":1,"rate":20}],
+		"availabilities":[{"firstCheckIn":"2000-01-01","lastCheckIn":"2000-01-05","lengthOfStay":1,"available":20}]}`)
+	importInfo, err := ImportAriData(context, data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := importInfo.Report
+	if len(report.OutOfWindow) != 3 || len(report.InvalidLos) != 1 || len(report.InvalidRates) != 1 || len(report.LongCodes) != 1 ||
+		len(report.InvertedRanges) != 1 || len(report.ClampedAvailabilities) != 1 {
+		t.Errorf("Unexpected report: %v", report)
+	}
+	if report.Rejected {
+		t.Error("Expected item to be imported")
+	}
+	if len(context.Idx.GetAccommodation("ALC001")["DBLSTHBNONRE"]) != 1 {
+		t.Error("Expected room rate code to be cut off")
+	}
+	context.Settings.StrictImport = true
+	importInfo, _ = ImportAriData(context, data, false)
+	if !importInfo.Report.Rejected {
+		t.Error("Expected item to be rejected")
+	}
+}
+
+func TestTruncateCode(t *testing.T) {
+	if code := truncateCode("DBLSTÄNDARD", 6); code != "DBLST" {
+		t.Errorf("Value: %v, expected: DBLST", code)
+	}
+	if code := truncateCode("DBLSTÄNDARD", 7); code != "DBLSTÄ" {
+		t.Errorf("Value: %v, expected: DBLSTÄ", code)
+	}
+}
@@ -0,0 +1,274 @@
+package wswrite
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// Names of the entries of a snapshot archive. The manifest is
+// always the last entry.
+const (
+	SnapshotCacheFile    = "cache.bin"
+	SnapshotIndexFile    = "cache.bin.idx"
+	SnapshotTagFile      = "cache.bin.tags"
+	SnapshotManifestFile = "manifest.json"
+)
+
+// SnapshotFile is the size and SHA-256 checksum of a file in a snapshot.
+type SnapshotFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// SnapshotManifest describes a snapshot. If the change stream is enabled,
+// JournalID and JournalOffset are the position in the journal when the
+// snapshot was taken; the snapshot contains exactly the changes before it.
+type SnapshotManifest struct {
+	Created        time.Time      `json:"created"`
+	FormatVersion  uint8          `json:"formatVersion"`
+	RateBlockCount uint32         `json:"rateBlockCount"`
+	JournalID      string         `json:"journalId,omitempty"`
+	JournalOffset  int64          `json:"journalOffset,omitempty"`
+	Files          []SnapshotFile `json:"files"`
+}
+
+// writeSnapshotFile writes size bytes from r as entry name to the
+// archive and returns size and checksum of the entry.
+func writeSnapshotFile(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) (SnapshotFile, error) {
+	file := SnapshotFile{Name: name, Size: size}
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg})
+	if err != nil {
+		return file, err
+	}
+	hash := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tw, hash), r, size)
+	if err != nil {
+		return file, err
+	}
+	file.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return file, nil
+}
+
+// snapshotChunkSize is the approximate size of the chunks in which the
+// cache file is read for a snapshot.
+const snapshotChunkSize = 1 << 20
+
+// snapshotReader reads the used part of the cache file in chunks of whole
+// rate blocks. Every chunk is read under the lock of the context, so no
+// block is read while it is written, but the lock is not held while the
+// chunk is sent. Blocks that are written before the snapshot has read
+// them are saved first (see preserveBlock), so the snapshot contains the
+// blocks as they were at its start. The rate block count in the file
+// header is replaced with the count at the start of the snapshot.
+type snapshotReader struct {
+	context *HandlerContext
+	fhdr    ratecache.FileHeader
+	pos     int64
+	end     int64
+	buf     []byte
+	data    []byte
+	// saved contains the original content of blocks that were
+	// changed before they were read. It is guarded by context.mu.
+	saved map[uint32][]byte
+}
+
+func newSnapshotReader(context *HandlerContext, fhdr ratecache.FileHeader) *snapshotReader {
+	blockSize := int64(fhdr.GetRateBlockSize())
+	chunkBlocks := snapshotChunkSize / blockSize
+	if chunkBlocks == 0 {
+		chunkBlocks = 1
+	}
+	return &snapshotReader{context: context, fhdr: fhdr, end: fhdr.GetRateBlockStart(fhdr.RateBlockCount), buf: make([]byte, ratecache.FileHeaderSize+chunkBlocks*blockSize), saved: make(map[uint32][]byte)}
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+		n := int64(len(r.buf)) - ratecache.FileHeaderSize
+		if r.pos == 0 {
+			n = int64(len(r.buf))
+		}
+		if n > r.end-r.pos {
+			n = r.end - r.pos
+		}
+		err := r.readChunk(r.buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		if r.pos == 0 {
+			copy(r.buf, r.fhdr.ToByteStr())
+		}
+		r.data = r.buf[:n]
+		r.pos += n
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// readChunk reads the chunk at r.pos into buf and replaces blocks that
+// were changed since the start of the snapshot by their saved content.
+func (r *snapshotReader) readChunk(buf []byte) error {
+	r.context.mu.Lock()
+	defer r.context.mu.Unlock()
+	_, err := r.context.CacheFile.ReadAt(buf, r.pos)
+	if err != nil {
+		return err
+	}
+	for index, block := range r.saved {
+		blockPos := r.fhdr.GetRateBlockStart(index)
+		if blockPos >= r.pos && blockPos < r.pos+int64(len(buf)) {
+			copy(buf[blockPos-r.pos:], block)
+			delete(r.saved, index)
+		}
+	}
+	return nil
+}
+
+// preserveBlock saves the content of rate block index for every running
+// snapshot that has not read the block yet, so that the snapshots are not
+// affected when the block is written. The caller holds mu.
+func (context *HandlerContext) preserveBlock(index uint32) error {
+	for r := range context.snapshots {
+		blockPos := r.fhdr.GetRateBlockStart(index)
+		if index >= r.fhdr.RateBlockCount || blockPos < r.pos {
+			continue
+		}
+		if _, ok := r.saved[index]; ok {
+			continue
+		}
+		block := make([]byte, r.fhdr.GetRateBlockSize())
+		_, err := context.CacheFile.ReadAt(block, blockPos)
+		if err != nil {
+			return err
+		}
+		r.saved[index] = block
+	}
+	return nil
+}
+
+// WriteSnapshot writes a point-in-time copy of the cache file, the
+// index file and the tag file as tar archive to w. Write operations
+// continue while the snapshot is sent; the blocks they change are saved
+// before and sent in their state at the start of the snapshot. Index file
+// and tag file are read into memory at the start, so they match the cache
+// file and the journal position. Without tag file the entry is empty.
+func WriteSnapshot(context *HandlerContext, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	manifest, err := writeSnapshotData(context, tw)
+	if err != nil {
+		return err
+	}
+	jsonStr, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: SnapshotManifestFile, Mode: 0644, Size: int64(len(jsonStr)), ModTime: manifest.Created, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(jsonStr)
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeSnapshotData(context *HandlerContext, tw *tar.Writer) (SnapshotManifest, error) {
+	// blocks, index records and journal position at the start
+	context.mu.Lock()
+	fhdr := *context.Fhdr
+	manifest := SnapshotManifest{Created: time.Now().UTC(), FormatVersion: fhdr.Version, RateBlockCount: fhdr.RateBlockCount}
+	if context.Journal != nil {
+		manifest.JournalID = context.Journal.ID()
+		manifest.JournalOffset = context.Journal.Size()
+	}
+	idxData, err := ioutil.ReadFile(filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".idx"))
+	if err != nil {
+		context.mu.Unlock()
+		return manifest, err
+	}
+	tagData, err := ioutil.ReadFile(filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".tags"))
+	if err != nil && !os.IsNotExist(err) {
+		context.mu.Unlock()
+		return manifest, err
+	}
+	reader := newSnapshotReader(context, fhdr)
+	context.snapshots[reader] = struct{}{}
+	context.mu.Unlock()
+	defer func() {
+		context.mu.Lock()
+		delete(context.snapshots, reader)
+		context.mu.Unlock()
+	}()
+	cacheSize := fhdr.GetRateBlockStart(fhdr.RateBlockCount)
+	file, err := writeSnapshotFile(tw, SnapshotCacheFile, reader, cacheSize, manifest.Created)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Files = append(manifest.Files, file)
+	file, err = writeSnapshotFile(tw, SnapshotIndexFile, bytes.NewReader(idxData), int64(len(idxData)), manifest.Created)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Files = append(manifest.Files, file)
+	file, err = writeSnapshotFile(tw, SnapshotTagFile, bytes.NewReader(tagData), int64(len(tagData)), manifest.Created)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Files = append(manifest.Files, file)
+	return manifest, nil
+}
+
+// CheckSnapshotFiles checks that the cache file and the index file of a
+// snapshot fit the manifest and each other.
+func CheckSnapshotFiles(manifest SnapshotManifest, cacheFilename string, idxFilename string) error {
+	f, err := os.Open(cacheFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, ratecache.FileHeaderSize)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	fhdr, err := ratecache.FileHeaderFromByteStr(buf)
+	if err != nil {
+		return err
+	}
+	if fhdr.RateBlockCount != manifest.RateBlockCount {
+		return errors.New("Rate block count of cache file does not match manifest")
+	}
+	statInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if statInfo.Size() < fhdr.GetRateBlockStart(fhdr.RateBlockCount) {
+		return errors.New("Cache file is too short for its rate block count")
+	}
+	idx := ratecache.NewCacheIndex()
+	err = idx.Load(fhdr, idxFilename)
+	if err != nil {
+		return err
+	}
+	// every rate block has an entry unless it was removed
+	if idx.GetEntryCount()+len(idx.RemovedBlocks()) != int(fhdr.RateBlockCount) {
+		return errors.New("Index file does not match cache file")
+	}
+	return nil
+}
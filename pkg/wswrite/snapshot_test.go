@@ -0,0 +1,161 @@
+package wswrite
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	_, err := ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = WriteSnapshot(context, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		files[hdr.Name], _ = ioutil.ReadAll(tr)
+		names = append(names, hdr.Name)
+	}
+	if len(names) != 4 || names[3] != SnapshotManifestFile {
+		t.Fatalf("Value: %v, expected cache, index, tags and manifest", names)
+	}
+	var manifest SnapshotManifest
+	err = json.Unmarshal(files[SnapshotManifestFile], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.RateBlockCount != 1 {
+		t.Errorf("Value: %v, expected: 1", manifest.RateBlockCount)
+	}
+	if int64(len(files[SnapshotCacheFile])) != context.Fhdr.GetRateBlockStart(1) {
+		t.Errorf("Value: %v, expected: %v", len(files[SnapshotCacheFile]), context.Fhdr.GetRateBlockStart(1))
+	}
+	cacheFilename := filepath.Join(context.Settings.CacheDir, "snapshot.bin")
+	idxFilename := filepath.Join(context.Settings.CacheDir, "snapshot.bin.idx")
+	ioutil.WriteFile(cacheFilename, files[SnapshotCacheFile], 0644)
+	ioutil.WriteFile(idxFilename, files[SnapshotIndexFile], 0644)
+	err = CheckSnapshotFiles(manifest, cacheFilename, idxFilename)
+	if err != nil {
+		t.Error(err)
+	}
+	manifest.RateBlockCount = 2
+	err = CheckSnapshotFiles(manifest, cacheFilename, idxFilename)
+	if err == nil {
+		t.Error("Expected error for wrong rate block count")
+	}
+
+	// removed rate blocks have no index entry
+	_, err = Remove(context, []byte(`{"accommodationCode":"ALC001"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = WriteSnapshot(context, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = readSnapshot(t, &buf)
+	json.Unmarshal(files[SnapshotManifestFile], &manifest)
+	ioutil.WriteFile(cacheFilename, files[SnapshotCacheFile], 0644)
+	ioutil.WriteFile(idxFilename, files[SnapshotIndexFile], 0644)
+	err = CheckSnapshotFiles(manifest, cacheFilename, idxFilename)
+	if err != nil {
+		t.Errorf("Unexpected error after removal: %v", err)
+	}
+}
+
+// readSnapshot returns the entries of a snapshot archive by name.
+func readSnapshot(t *testing.T, r io.Reader) map[string][]byte {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotDoesNotBlockWrites(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	ImportAriData(context, testImportData(context, "31.02", "5"), false)
+	before := make([]byte, context.Fhdr.GetRateBlockStart(1))
+	_, err := context.CacheFile.ReadAt(before, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(WriteSnapshot(context, pw))
+	}()
+	// the snapshot has started and waits for the reader
+	start := make([]byte, 512)
+	_, err = io.ReadFull(pr, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := ImportAriData(context, testImportData(context, "40.00", "3"), false)
+		if err == nil {
+			newBlock := bytes.Replace(testImportData(context, "50.00", "1"), []byte("ALC001"), []byte("ALC002"), 1)
+			_, err = ImportAriData(context, newBlock, false)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Import is blocked by snapshot")
+	}
+	files := readSnapshot(t, io.MultiReader(bytes.NewReader(start), pr))
+	// the snapshot contains the cache as it was at its start
+	if !bytes.Equal(files[SnapshotCacheFile], before) {
+		t.Error("Snapshot contains changes made after its start")
+	}
+	var manifest SnapshotManifest
+	err = json.Unmarshal(files[SnapshotManifestFile], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheFilename := filepath.Join(context.Settings.CacheDir, "snapshot.bin")
+	idxFilename := filepath.Join(context.Settings.CacheDir, "snapshot.bin.idx")
+	ioutil.WriteFile(cacheFilename, files[SnapshotCacheFile], 0644)
+	ioutil.WriteFile(idxFilename, files[SnapshotIndexFile], 0644)
+	err = CheckSnapshotFiles(manifest, cacheFilename, idxFilename)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(context.snapshots) != 0 {
+		t.Error("Finished snapshot is still registered")
+	}
+}
@@ -0,0 +1,101 @@
+package wswrite
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+// TagInfo is the response to a tag update.
+type TagInfo struct {
+	Errors  []string `json:"errors"`
+	Updated int      `json:"updated"`
+}
+
+// LoadTags loads the tags from the tag file in the index directory and
+// writes the file anew without the updates that were overwritten later.
+func LoadTags(settings Settings) (*ratecache.TagStore, error) {
+	tagFilename := filepath.Join(settings.IndexDir, settings.CacheFilename+".tags")
+	tags := ratecache.NewTagStore()
+	_, err := tags.ReadTagFile(tagFilename, 0)
+	if err != nil {
+		return tags, err
+	}
+	return tags, ratecache.WriteTagFile(tagFilename, tags)
+}
+
+// updateTags appends updates to the tag file, applies them to the
+// tags and adds them to the journal for replicas. The caller must
+// hold the lock of context.
+func (context *HandlerContext) updateTags(updates []ratecache.TagUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	err := ratecache.AppendTagFile(filepath.Join(context.Settings.IndexDir, context.Settings.CacheFilename+".tags"), updates)
+	if err != nil {
+		return err
+	}
+	for _, update := range updates {
+		context.Tags.Apply(update)
+	}
+	if context.Journal == nil {
+		return nil
+	}
+	data, err := json.Marshal(updates)
+	if err != nil {
+		return err
+	}
+	return context.appendJournal(ratecache.JournalRecord{Type: ratecache.JournalTags, Data: data})
+}
+
+// TagsHandler returns the tags of all accommodations or of the one in
+// query parameter accoCode on GET. On POST it applies a list of
+// ratecache.TagUpdate.
+func (context *HandlerContext) TagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(context.Tags.Updates(r.URL.Query().Get("accoCode")))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	rqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	defer r.Body.Close()
+	var updates []ratecache.TagUpdate
+	err = json.Unmarshal(rqBody, &updates)
+	if err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	tagInfo := TagInfo{Errors: []string{}}
+	for _, update := range updates {
+		tagInfo.Errors = append(tagInfo.Errors, update.Validate()...)
+	}
+	if len(tagInfo.Errors) > 0 {
+		context.Metrics.ValidationFailures.Inc("/tags")
+	} else {
+		context.mu.Lock()
+		err = context.updateTags(updates)
+		context.mu.Unlock()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		tagInfo.Updated = len(updates)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tagInfo)
+}
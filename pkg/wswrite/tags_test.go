@@ -0,0 +1,63 @@
+package wswrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/navegotel/openratecache/pkg/ratecache"
+)
+
+func TestImportTags(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	data := bytes.Replace(testImportData(context, "31.02", "5"), []byte(`"roomRateCode":"DBLSTHB",`),
+		[]byte(`"roomRateCode":"DBLSTHB","tags":{"refundable":"no"},"accommodationTags":{"channel":"B2B"},`), 1)
+	importInfo, err := ImportAriData(context, data, true)
+	if err != nil || len(context.Tags.Updates("")) != 0 {
+		t.Fatalf("Dry run must not change tags: %v %v", importInfo, err)
+	}
+	_, err = ImportAriData(context, data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.Tags.RoomRateTags("ALC001", "DBLSTHB")["refundable"] != "no" || context.Tags.AccoTags("ALC001")["channel"] != "B2B" {
+		t.Errorf("Unexpected tags %v", context.Tags.Updates(""))
+	}
+	tags, err := LoadTags(context.Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags.Updates("ALC001")) != 2 {
+		t.Errorf("Unexpected tags loaded from file %v", tags.Updates(""))
+	}
+}
+
+func TestTagsHandler(t *testing.T) {
+	context, cleanup := newTestContext(t)
+	defer cleanup()
+	post := func(body string) (int, TagInfo) {
+		w := httptest.NewRecorder()
+		context.TagsHandler(w, httptest.NewRequest(http.MethodPost, "/tags", strings.NewReader(body)))
+		var info TagInfo
+		json.NewDecoder(w.Body).Decode(&info)
+		return w.Code, info
+	}
+	if code, _ := post(`[{"accoCode":`); code != http.StatusBadRequest {
+		t.Errorf("Value: %v, expected: 400", code)
+	}
+	code, info := post(`[{"accoCode":"ALC001","tags":{"channel":"B2B"}}]`)
+	if code != http.StatusOK || info.Updated != 1 {
+		t.Errorf("Value: %v %v, expected: 200 with 1 update", code, info)
+	}
+	w := httptest.NewRecorder()
+	context.TagsHandler(w, httptest.NewRequest(http.MethodGet, "/tags?accoCode=ALC001", nil))
+	var updates []ratecache.TagUpdate
+	json.NewDecoder(w.Body).Decode(&updates)
+	if len(updates) != 1 || updates[0].Tags["channel"] != "B2B" {
+		t.Errorf("Unexpected tags %v", updates)
+	}
+}